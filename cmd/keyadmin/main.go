@@ -0,0 +1,135 @@
+// Command keyadmin manages the master keys assets are encrypted under.
+//
+//	keyadmin generate -version v2    prints a new key line to append to the key file
+//	keyadmin report                  counts the assets per master key
+//	keyadmin rewrap                  schedules re-wrapping the data keys with the active master key
+//	keyadmin encrypt                 schedules encrypting the assets stored before encryption was enabled
+//
+// A master key is rotated by appending a new version to the key file and restarting the service,
+// then running rewrap. The old version can be removed once report no longer lists it.
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/hitesh-goel/ekanek/internal/db"
+	"github.com/hitesh-goel/ekanek/internal/handlers/assets"
+	"github.com/hitesh-goel/ekanek/internal/pkg/envelope"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	cfg = config{
+		DbHost:     flag.String("db-host", "", "DB host"),
+		DbName:     flag.String("db-name", "", "DB name"),
+		DbPass:     flag.String("db-pass", "", "DB password"),
+		DbUser:     flag.String("db-user", "", "DB user"),
+		KMSKeyFile: flag.String("kms-key-file", "", "Key file, report marks the active key when set"),
+		Version:    flag.String("version", "", "Version of the generated key (e.g., v2)"),
+	}
+
+	errUsage = errors.New("usage: keyadmin [flags] generate|report|rewrap|encrypt")
+)
+
+type config struct {
+	DbHost     *string
+	DbName     *string
+	DbPass     *string
+	DbUser     *string
+	KMSKeyFile *string
+	Version    *string
+}
+
+func main() {
+	flag.Parse()
+	if err := run(flag.Arg(0)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(cmd string) error {
+	switch cmd {
+	case "generate":
+		return generate(*cfg.Version)
+	case "report", "rewrap", "encrypt":
+	default:
+		return errUsage
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	db, err := db.New(db.Config{
+		Host:     *cfg.DbHost,
+		Name:     *cfg.DbName,
+		Password: *cfg.DbPass,
+		User:     *cfg.DbUser,
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if cmd == "rewrap" || cmd == "encrypt" {
+		enqueue := assets.EnqueueRewrap
+		if cmd == "encrypt" {
+			enqueue = assets.EnqueueEncrypt
+		}
+		id, err := enqueue(ctx, db)
+		if err != nil {
+			return err
+		}
+		fmt.Println("enqueued job", id)
+		return nil
+	}
+
+	active := ""
+	if *cfg.KMSKeyFile != "" {
+		kms, err := envelope.NewLocalKMS(*cfg.KMSKeyFile)
+		if err != nil {
+			return err
+		}
+		active = kms.KeyId()
+	}
+	usage, err := assets.KeyReport(ctx, db)
+	if err != nil {
+		return err
+	}
+	return report(os.Stdout, usage, active)
+}
+
+func generate(version string) error {
+	key, err := envelope.NewDataKey()
+	if err != nil {
+		return err
+	}
+	line := base64.StdEncoding.EncodeToString(key)
+	if version != "" {
+		line = version + " " + line
+	}
+	fmt.Println(line)
+	return nil
+}
+
+func report(w io.Writer, usage []assets.KeyUsage, active string) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tASSETS\tSTORED BYTES\t")
+	for _, u := range usage {
+		name := u.KeyId
+		switch {
+		case name == "":
+			name = "(unencrypted)"
+		case name == active:
+			name += " (active)"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t\n", name, u.Assets, u.StoredBytes)
+	}
+	return tw.Flush()
+}
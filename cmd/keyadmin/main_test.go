@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"github.com/hitesh-goel/ekanek/internal/handlers/assets"
+	"strings"
+	"testing"
+)
+
+func TestReport(t *testing.T) {
+	var b bytes.Buffer
+	usage := []assets.KeyUsage{
+		{KeyId: "", Assets: 3, StoredBytes: 300},
+		{KeyId: "local:v1", Assets: 2, StoredBytes: 20},
+		{KeyId: "local:v2", Assets: 1, StoredBytes: 1},
+	}
+	if err := report(&b, usage, "local:v2"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"KEY                ASSETS  STORED BYTES",
+		"(unencrypted)      3       300",
+		"local:v1           2       20",
+		"local:v2 (active)  1       1",
+	}
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("report:\n%s", b.String())
+	}
+	for i := range want {
+		if strings.TrimRight(lines[i], " ") != want[i] {
+			t.Errorf("line %d = %q, want %q", i, lines[i], want[i])
+		}
+	}
+}
+
+func TestRunUsage(t *testing.T) {
+	for _, cmd := range []string{"", "rotate"} {
+		if err := run(cmd); err != errUsage {
+			t.Errorf("run(%q) = %v, want %v", cmd, err, errUsage)
+		}
+	}
+}
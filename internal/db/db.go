@@ -32,9 +32,24 @@ func (c Config) isValid() bool {
 
 // New initializes a database abstraction.
 func New(c Config) (*sql.DB, error) {
-	if !c.isValid() {
+	dsn, err := ConnString(c)
+	if err != nil {
 		fmt.Println(c)
-		return nil, errConfigInvalid
+		return nil, err
+	}
+
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// ConnString returns the connection url, e.g. for a pq.Listener which needs a connection of its own.
+func ConnString(c Config) (string, error) {
+	if !c.isValid() {
+		return "", errConfigInvalid
 	}
 
 	sslMode := "disable"
@@ -50,11 +65,5 @@ func New(c Config) (*sql.DB, error) {
 		Path:     c.Name,
 		RawQuery: q.Encode(),
 	}
-
-	db, err := sql.Open(driverName, u.String())
-	if err != nil {
-		return nil, err
-	}
-
-	return db, nil
+	return u.String(), nil
 }
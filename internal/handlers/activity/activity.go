@@ -0,0 +1,193 @@
+package activity
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	keepAliveInterval = 15 * time.Second
+	retryMillis       = 3000
+	batchSize         = 100
+	lookback          = 30 * time.Second
+)
+
+// Event is the data of a server-sent event.
+type Event struct {
+	Id        int64           `json:"id"`
+	Type      string          `json:"type"`
+	AssetId   string          `json:"asset_id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// stream is the position of one client in the outbox.
+type stream struct {
+	db  *sql.DB
+	uid string
+	// floor is where the client started, nothing at or below it is sent.
+	floor int64
+	last  int64
+	sent  map[int64]time.Time
+}
+
+// HandleActivity streams the caller's asset events. Streams are closed before the server's write
+// timeout cuts them, clients reconnect with Last-Event-ID and continue where they left off.
+func HandleActivity(db *sql.DB, hub *Hub, writeTimeout time.Duration) (string, func(http.ResponseWriter, *http.Request)) {
+	streamFor := writeTimeout - 5*time.Second
+	if streamFor < writeTimeout/2 {
+		streamFor = writeTimeout * 9 / 10
+	}
+	return "/api/v1/asset/activity", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		streamActivity(w, r, db, hub, streamFor)
+	}
+}
+
+func streamActivity(w http.ResponseWriter, r *http.Request, db *sql.DB, hub *Hub, streamFor time.Duration) {
+	ctx := r.Context()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		response.RespondWithError(w, r, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	uid, err := auth.GetUID(ctx)
+	if err != nil {
+		log.Println("Error accessing UserID: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	lastId := r.Header.Get("Last-Event-ID")
+	if lastId == "" {
+		lastId = r.URL.Query().Get("last_event_id")
+	}
+
+	// Subscribe before reading the position, so nothing written in between is missed.
+	wake, unsubscribe := hub.subscribe(uid)
+	defer unsubscribe()
+
+	var last int64
+	if lastId != "" {
+		last, err = strconv.ParseInt(lastId, 10, 64)
+		if err != nil || last < 0 {
+			response.RespondWithError(w, r, "invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	} else {
+		err = db.QueryRowContext(ctx, `select COALESCE(MAX(id), 0) from outbox where uid = $1`, uid).Scan(&last)
+		if err != nil {
+			log.Println("Error selecting activity position", err.Error())
+			response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintf(w, "retry: %d\n\n", retryMillis)
+	flusher.Flush()
+
+	deadline := time.NewTimer(streamFor)
+	defer deadline.Stop()
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	s := &stream{db: db, uid: uid, floor: last, last: last, sent: make(map[int64]time.Time)}
+	for {
+		if err = s.sendEvents(ctx, w); err != nil {
+			if ctx.Err() == nil {
+				log.Println("Error streaming activity", err.Error())
+			}
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline.C:
+			return
+		case <-keepAlive.C:
+			if _, err = fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-wake:
+		}
+	}
+}
+
+// sendEvents writes the asset events after last. Ids are assigned when an event is written but only
+// become visible on commit, so a slow transaction can commit an event below last. Events of the last
+// lookback are read again to pick those up, the ones already sent are skipped.
+func (s *stream) sendEvents(ctx context.Context, w http.ResponseWriter) error {
+	var query = `
+		select id, type, aggregate_id, created_at, payload from outbox
+		where uid = $1 and aggregate_type = 'asset' and id > $2
+		  and (id > $3 or created_at > NOW() - make_interval(secs => $4))
+		order by id limit $5`
+	cursor := s.floor
+	for {
+		rows, err := s.db.QueryContext(ctx, query, s.uid, cursor, s.last, lookback.Seconds(), batchSize)
+		if err != nil {
+			return err
+		}
+		var events []Event
+		for rows.Next() {
+			var e Event
+			if err = rows.Scan(&e.Id, &e.Type, &e.AssetId, &e.CreatedAt, &e.Data); err != nil {
+				rows.Close()
+				return err
+			}
+			events = append(events, e)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for _, e := range events {
+			cursor = e.Id
+			if _, ok := s.sent[e.Id]; ok {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if _, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Id, e.Type, data); err != nil {
+				return err
+			}
+			s.sent[e.Id] = e.CreatedAt
+			if e.Id > s.last {
+				s.last = e.Id
+			}
+		}
+		if len(events) < batchSize {
+			break
+		}
+	}
+
+	for id, created := range s.sent {
+		if time.Since(created) > 2*lookback {
+			delete(s.sent, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package activity
+
+import (
+	"context"
+	"database/sql"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/outbox"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var eventIds = regexp.MustCompile(`(?m)^id: (\d+)$`)
+
+func activity(h func(http.ResponseWriter, *http.Request), method, uid, lastId string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/api/v1/asset/activity", nil)
+	r = r.WithContext(auth.WithUID(r.Context(), uid))
+	if lastId != "" {
+		r.Header.Set("Last-Event-ID", lastId)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func writeEvent(t *testing.T, db *sql.DB, aggregateType, uid, typ string) {
+	t.Helper()
+	err := outbox.Write(context.Background(), db, outbox.Event{
+		AggregateType: aggregateType, AggregateId: "asset-" + uid, UserID: uid, Type: typ, Data: map[string]string{"k": "v"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sentIds(body string) []string {
+	var ids []string
+	for _, m := range eventIds.FindAllStringSubmatch(body, -1) {
+		ids = append(ids, m[1])
+	}
+	return ids
+}
+
+func TestActivityRequest(t *testing.T) {
+	_, h := HandleActivity(nil, NewHub(""), time.Second)
+	if w := activity(h, http.MethodPost, "uid", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	for _, lastId := range []string{"x", "-1"} {
+		if w := activity(h, http.MethodGet, "uid", lastId); w.Code != http.StatusBadRequest {
+			t.Fatalf("Last-Event-ID %q status = %d, want %d", lastId, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestStreamActivity(t *testing.T) {
+	db := dbtest.New(t)
+	uid := dbtest.User(t, db, "activity@example.com")
+	other := dbtest.User(t, db, "other@example.com")
+	writeEvent(t, db, "asset", uid, "asset.created")
+	writeEvent(t, db, "user", uid, "user.updated")
+	writeEvent(t, db, "asset", other, "asset.created")
+	writeEvent(t, db, "asset", uid, "asset.ready")
+
+	// The stream is closed before the write timeout, resuming from 0 replays the user's asset events.
+	_, h := HandleActivity(db, NewHub(""), time.Second)
+	w := activity(h, http.MethodGet, uid, "0")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status = %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	ids := sentIds(w.Body.String())
+	if len(ids) != 2 {
+		t.Fatalf("sent events %v, want the user's two asset events", ids)
+	}
+	if got := sentIds(activity(h, http.MethodGet, uid, ids[0]).Body.String()); len(got) != 1 || got[0] != ids[1] {
+		t.Fatalf("resumed after %s with %v, want %s", ids[0], got, ids[1])
+	}
+}
+
+func TestSendEventsOnce(t *testing.T) {
+	db := dbtest.New(t)
+	uid := dbtest.User(t, db, "activity@example.com")
+	writeEvent(t, db, "asset", uid, "asset.created")
+
+	var last int64
+	if err := db.QueryRow(`select MAX(id) from outbox`).Scan(&last); err != nil {
+		t.Fatal(err)
+	}
+	s := &stream{db: db, uid: uid, floor: last, last: last, sent: make(map[int64]time.Time)}
+	writeEvent(t, db, "asset", uid, "asset.ready")
+
+	ctx := context.Background()
+	w := httptest.NewRecorder()
+	if err := s.sendEvents(ctx, w); err != nil {
+		t.Fatal(err)
+	}
+	if ids := sentIds(w.Body.String()); len(ids) != 1 {
+		t.Fatalf("sent %v, want only the event after the stream started", ids)
+	}
+	// Recent events are read again, the ones already sent are skipped.
+	w = httptest.NewRecorder()
+	if err := s.sendEvents(ctx, w); err != nil {
+		t.Fatal(err)
+	}
+	if w.Body.Len() != 0 {
+		t.Fatalf("sent %q again", w.Body.String())
+	}
+}
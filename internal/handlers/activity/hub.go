@@ -0,0 +1,124 @@
+package activity
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/lib/pq"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	notifyChannel = "outbox_events"
+
+	minReconnect = 10 * time.Second
+	maxReconnect = time.Minute
+	pingInterval = 90 * time.Second
+)
+
+type notification struct {
+	Id     int64  `json:"id"`
+	UserId string `json:"uid"`
+}
+
+// Hub listens for outbox notifications and wakes up the streams of the user an event belongs to.
+// Every replica runs its own hub, so a stream is woken up whichever replica wrote the event.
+type Hub struct {
+	connStr string
+	mu      sync.Mutex
+	subs    map[string]map[chan struct{}]struct{}
+}
+
+// NewHub initializes a hub, connStr is the url of a dedicated listener connection.
+func NewHub(connStr string) *Hub {
+	return &Hub{connStr: connStr, subs: make(map[string]map[chan struct{}]struct{})}
+}
+
+// Run listens until ctx is cancelled, the listener reconnects on its own when the connection drops.
+func (h *Hub) Run(ctx context.Context) {
+	l := pq.NewListener(h.connStr, minReconnect, maxReconnect, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("Activity listener error: ", err.Error())
+		}
+	})
+	defer l.Close()
+
+	if err := l.Listen(notifyChannel); err != nil {
+		log.Println("Error listening for activity: ", err.Error())
+		return
+	}
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-l.Notify:
+			if n == nil {
+				// The connection was re-established, notifications may have been missed.
+				h.wakeAll()
+				continue
+			}
+			var msg notification
+			if err := json.Unmarshal([]byte(n.Extra), &msg); err != nil {
+				log.Println("Error decoding activity notification: ", err.Error())
+				continue
+			}
+			h.wake(msg.UserId)
+		case <-ticker.C:
+			go func() {
+				if err := l.Ping(); err != nil {
+					log.Println("Activity listener ping failed: ", err.Error())
+				}
+			}()
+		}
+	}
+}
+
+// subscribe returns a channel which receives a value when there may be new events for the user.
+// Wake ups are coalesced, the subscriber reads the events themselves from the outbox.
+func (h *Hub) subscribe(uid string) (<-chan struct{}, func()) {
+	c := make(chan struct{}, 1)
+	h.mu.Lock()
+	if h.subs[uid] == nil {
+		h.subs[uid] = make(map[chan struct{}]struct{})
+	}
+	h.subs[uid][c] = struct{}{}
+	h.mu.Unlock()
+
+	return c, func() {
+		h.mu.Lock()
+		delete(h.subs[uid], c)
+		if len(h.subs[uid]) == 0 {
+			delete(h.subs, uid)
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *Hub) wake(uid string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.subs[uid] {
+		signal(c)
+	}
+}
+
+func (h *Hub) wakeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, subs := range h.subs {
+		for c := range subs {
+			signal(c)
+		}
+	}
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
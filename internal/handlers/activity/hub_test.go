@@ -0,0 +1,47 @@
+package activity
+
+import (
+	"testing"
+)
+
+func woken(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestHubWake(t *testing.T) {
+	h := NewHub("")
+	a1, unsubscribeA1 := h.subscribe("a")
+	a2, unsubscribeA2 := h.subscribe("a")
+	b, unsubscribeB := h.subscribe("b")
+	defer unsubscribeB()
+
+	// Wake ups are coalesced and only reach the user's streams.
+	h.wake("a")
+	h.wake("a")
+	if !woken(a1) || !woken(a2) {
+		t.Fatal("a stream of the user wasn't woken up")
+	}
+	if woken(a1) || woken(b) {
+		t.Fatal("a stream was woken up twice or for another user")
+	}
+
+	h.wakeAll()
+	if !woken(a1) || !woken(a2) || !woken(b) {
+		t.Fatal("wakeAll missed a stream")
+	}
+
+	unsubscribeA1()
+	h.wake("a")
+	if woken(a1) || !woken(a2) {
+		t.Fatal("an unsubscribed stream was woken up")
+	}
+	unsubscribeA2()
+	if _, ok := h.subs["a"]; ok {
+		t.Fatal("the user's subscriptions outlived their streams")
+	}
+}
@@ -0,0 +1,214 @@
+package assets
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	"github.com/lib/pq"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	maxArchiveAssets = 500
+)
+
+var (
+	errNotAuthenticated = errors.New("pass the Authorization header to archive a folder or tag")
+)
+
+type archiveRequest struct {
+	AssetIds []string `json:"asset_ids"`
+	Folder   *string  `json:"folder"`
+	Tag      string   `json:"tag"`
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func HandleAssetArchive(ar *AssetResources) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/asset/archive", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		downloadArchive(w, r, ar)
+	}
+}
+
+// downloadArchive streams a zip of the decompressed originals straight to the response.
+// Access is checked for every asset up front, since the status can't change once streaming started.
+func downloadArchive(w http.ResponseWriter, r *http.Request, ar *AssetResources) {
+	ctx := r.Context()
+	var req archiveRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err == nil && len(req.AssetIds) == 0 && (req.Folder != nil || req.Tag != "") {
+		req.AssetIds, err = selectArchiveIds(r, ar, req)
+		if errors.Is(err, errNotAuthenticated) {
+			response.RespondWithError(w, r, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Println("Error selecting assets", err.Error())
+			response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err != nil || len(req.AssetIds) == 0 {
+		response.RespondWithError(w, r, "pass a list of asset_ids, a folder or a tag", http.StatusBadRequest)
+		return
+	}
+	if len(req.AssetIds) > maxArchiveAssets {
+		response.RespondWithError(w, r, fmt.Sprintf("at most %d assets can be archived at once", maxArchiveAssets), http.StatusBadRequest)
+		return
+	}
+
+	for i, id := range req.AssetIds {
+		if !validAssetId(id) {
+			response.RespondWithError(w, r, "asset not found: "+id, http.StatusNotFound)
+			return
+		}
+		req.AssetIds[i] = strings.ToLower(id)
+	}
+
+	var query = `
+		select id, uid, public, s3_path, name, scan_status, key_id, data_key
+		from assets where id = ANY($1) and is_active = true`
+	rows, err := ar.DTO.QueryContext(ctx, query, pq.Array(req.AssetIds))
+	if err != nil {
+		log.Println("Error selecting assets", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	byId := make(map[string]Asset)
+	for rows.Next() {
+		var a Asset
+		err = rows.Scan(&a.Id, &a.UserId, &a.Public, &a.Path, &a.Name, &a.ScanStatus, &a.KeyId, &a.DataKey)
+		if err != nil {
+			log.Println("Error while scanning Asset Rows: ", err.Error())
+			response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+			return
+		}
+		byId[a.Id] = a
+	}
+	rows.Close()
+
+	userId, authErr := ar.Auth.Verify(r, auth.ScopeAssetsRead)
+	var selected []Asset
+	seen := make(map[string]bool)
+	for _, id := range req.AssetIds {
+		a, ok := byId[id]
+		if !ok {
+			response.RespondWithError(w, r, "asset not found: "+id, http.StatusNotFound)
+			return
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		owner := authErr == nil && userId == a.UserId
+		if !a.Public && !owner {
+			response.RespondWithError(w, r, "you are not authenticated to access asset "+id, http.StatusForbidden)
+			return
+		}
+		if err = servable(a.ScanStatus, owner); err != nil {
+			response.RespondWithError(w, r, err.Error()+": "+id, http.StatusForbidden)
+			return
+		}
+		selected = append(selected, a)
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=assets-%s.zip", time.Now().UTC().Format("20060102-150405")))
+
+	zw := zip.NewWriter(w)
+	names := make(map[string]bool)
+	for _, a := range selected {
+		sent, err := addToArchive(ctx, zw, a, uniqueName(names, a.Name), ar)
+		recordAccess(r, ar, accessEvent{AssetId: a.Id, OwnerId: a.UserId, Kind: eventArchive, Owner: authErr == nil && userId == a.UserId,
+			UserId: userId, BytesSent: sent})
+		if err != nil {
+			// The response is already partially written, all we can do is cut it short.
+			log.Println("Error writing archive entry", a.Id, err.Error())
+			return
+		}
+	}
+	if err = zw.Close(); err != nil {
+		log.Println("Error closing archive", err.Error())
+	}
+}
+
+// selectArchiveIds returns the caller's assets in a folder and/or carrying a tag.
+func selectArchiveIds(r *http.Request, ar *AssetResources, req archiveRequest) ([]string, error) {
+	uid, err := ar.Auth.Verify(r, auth.ScopeAssetsRead)
+	if err != nil {
+		return nil, errNotAuthenticated
+	}
+
+	folder := ""
+	if req.Folder != nil {
+		folder = normalizeFolder(*req.Folder)
+	}
+	var query = `
+		select id from assets
+		where uid = $1 and is_active = true and (NOT $2 OR folder = $3) and ($4 = '' OR $4 = ANY(tags))
+		order by created_at limit $5`
+	rows, err := ar.DTO.QueryContext(r.Context(), query, uid, req.Folder != nil, folder, strings.ToLower(req.Tag), maxArchiveAssets)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// addToArchive writes one asset to the zip and returns the decompressed bytes written.
+func addToArchive(ctx context.Context, zw *zip.Writer, a Asset, name string, ar *AssetResources) (int64, error) {
+	src, err := openOriginal(ctx, ar, a)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(fw, src)
+}
+
+// uniqueName suffixes repeated file names, e.g. photo.png, photo (2).png.
+func uniqueName(used map[string]bool, name string) string {
+	candidate := name
+	ext := path.Ext(name)
+	for i := 2; used[candidate]; i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	used[candidate] = true
+	return candidate
+}
@@ -0,0 +1,93 @@
+package assets
+
+import (
+	"context"
+	"fmt"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestUniqueName(t *testing.T) {
+	used := make(map[string]bool)
+	var got []string
+	for _, name := range []string{"photo.png", "photo.png", "photo (2).png", "photo.png", "notes"} {
+		got = append(got, uniqueName(used, name))
+	}
+	if want := "[photo.png photo (2).png photo (2) (2).png photo (3).png notes]"; fmt.Sprint(got) != want {
+		t.Fatalf("names %v, want %s", got, want)
+	}
+}
+
+func TestSelectArchiveIds(t *testing.T) {
+	db := dbtest.New(t)
+	ctx := context.Background()
+	keys, err := auth.NewKeySet("test-secret", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := auth.New(auth.Config{Keys: keys, AccessTTL: time.Minute, RefreshTTL: time.Hour}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar := &AssetResources{DTO: db, Auth: a}
+
+	uid := dbtest.User(t, db, "archive@example.com")
+	assets := map[string]string{}
+	for _, f := range []struct{ name, folder, tags string }{
+		{"a.png", "2020", "{logo}"},
+		{"b.png", "2020", "{}"},
+		{"c.png", "", "{logo}"},
+	} {
+		id, _, err := reserveAsset(ctx, ar, CreateAsset{UserId: uid, Name: f.name, Path: uid + "/" + f.name, OriginalBytes: 1}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.Exec(`UPDATE assets set folder = $1, tags = $2 where id = $3`, f.folder, f.tags, id); err != nil {
+			t.Fatal(err)
+		}
+		assets[id] = f.name
+	}
+	other := dbtest.User(t, db, "other@example.com")
+	if _, _, err = reserveAsset(ctx, ar, CreateAsset{UserId: other, Name: "d.png", Path: other + "/d", Folder: "2020", OriginalBytes: 1}, 1); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := a.IssueTokens(ctx, uid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	folder := "/2020/"
+	for _, tt := range []struct {
+		name string
+		req  archiveRequest
+		want string
+	}{
+		{name: "folder", req: archiveRequest{Folder: &folder}, want: "[a.png b.png]"},
+		{name: "tag", req: archiveRequest{Tag: "LOGO"}, want: "[a.png c.png]"},
+		{name: "folder and tag", req: archiveRequest{Folder: &folder, Tag: "logo"}, want: "[a.png]"},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+tokens.Jwt)
+		ids, err := selectArchiveIds(r, ar, tt.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, id := range ids {
+			names = append(names, assets[id])
+		}
+		sort.Strings(names)
+		if fmt.Sprint(names) != tt.want {
+			t.Errorf("%s: selected %v, want %s", tt.name, names, tt.want)
+		}
+	}
+
+	if _, err = selectArchiveIds(httptest.NewRequest(http.MethodPost, "/", nil), ar, archiveRequest{Tag: "logo"}); err != errNotAuthenticated {
+		t.Fatalf("err = %v without a token, want %v", err, errNotAuthenticated)
+	}
+}
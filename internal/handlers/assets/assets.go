@@ -4,40 +4,77 @@ import (
 	"compress/gzip"
 	"database/sql"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
 	"github.com/hitesh-goel/ekanek/internal/handlers/response"
-	awss3 "github.com/hitesh-goel/ekanek/internal/pkg/aws"
+	"github.com/hitesh-goel/ekanek/internal/pkg/envelope"
+	"github.com/hitesh-goel/ekanek/internal/pkg/scan"
+	"github.com/hitesh-goel/ekanek/internal/queue"
+	"github.com/lib/pq"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type AssetResources struct {
-	Session *session.Session
-	DTO     *sql.DB
+	Session      *session.Session
+	DTO          *sql.DB
+	TransformKey string
+	PurgeAfter   time.Duration
+	Scanner      scan.Scanner
+	DefaultQuota int64
+	UploadLimits map[string]int64
+	// Auth verifies the optional Authorization header of handlers serving public assets.
+	Auth *auth.Authenticator
+	// KMS wraps the data keys objects are encrypted with, nil stores objects unencrypted.
+	KMS envelope.KMS
+	// VerifiedUpload and VerifiedShare restrict uploads and making assets public to users with a verified email.
+	VerifiedUpload bool
+	VerifiedShare  bool
+}
+
+type jobResponse struct {
+	JobId string `json:"job_id"`
 }
 
 type CreateAsset struct {
-	Title       string `db:"title"`
-	Description string `db:"description"`
-	Name        string `db:"name"`
-	Public      bool   `db:"public"`
-	UserId      string `db:"uid"`
-	Path        string `db:"s3_path"`
+	Title         string  `db:"title"`
+	Description   string  `db:"description"`
+	Name          string  `db:"name"`
+	Public        bool    `db:"public"`
+	UserId        string  `db:"uid"`
+	Path          string  `db:"s3_path"`
+	Metadata      []byte  `db:"metadata"`
+	ContentType   string  `db:"content_type"`
+	OriginalBytes int64   `db:"original_bytes"`
+	Folder        string  `db:"folder"`
+	KeyId         *string `db:"key_id"`
+	DataKey       []byte  `db:"data_key"`
 }
 
 type Asset struct {
-	Id          string `json:"asset_id" db:"id"`
-	Title       string `json:"title" db:"title"`
-	Description string `json:"description" db:"description"`
-	Name        string `json:"asset_name" db:"name"`
-	Public      bool   `json:"is_public" db:"public"`
-	UserId      string `json:"uid" db:"uid"`
-	Path        string `json:"s3_path" db:"s3_path"`
+	Id            string          `json:"asset_id" db:"id"`
+	Title         string          `json:"title" db:"title"`
+	Description   string          `json:"description" db:"description"`
+	Name          string          `json:"asset_name" db:"name"`
+	Public        bool            `json:"is_public" db:"public"`
+	UserId        string          `json:"uid" db:"uid"`
+	Path          string          `json:"s3_path" db:"s3_path"`
+	Metadata      json.RawMessage `json:"metadata,omitempty" db:"metadata"`
+	ScanStatus    string          `json:"scan_status" db:"scan_status"`
+	ContentType   string          `json:"content_type" db:"content_type"`
+	OriginalBytes int64           `json:"original_bytes" db:"original_bytes"`
+	StoredBytes   int64           `json:"stored_bytes" db:"stored_bytes"`
+	Tags          []string        `json:"tags" db:"tags"`
+	Folder        string          `json:"folder" db:"folder"`
+	Status        string          `json:"status" db:"status"`
+	KeyId         *string         `json:"-" db:"key_id"`
+	DataKey       []byte          `json:"-" db:"data_key"`
 }
 
 func HandleAssetUpload(ar *AssetResources) (string, func(http.ResponseWriter, *http.Request)) {
@@ -99,154 +136,119 @@ func downloadFile(w http.ResponseWriter, r *http.Request, ar *AssetResources) {
 		return
 	}
 
-	var asset CreateAsset
-	var query = `select public, s3_path, name from assets where id = $1`
+	var asset Asset
+	// Assets of accounts scheduled for deletion can't be downloaded anymore, not even by the owner.
+	var query = `
+		select a.uid, a.public, a.s3_path, a.name, a.scan_status, a.key_id, a.data_key
+		from assets a join users u on u.uid = a.uid
+		where a.id = $1 and a.is_active = true and u.deleted_at IS NULL`
 	row := ar.DTO.QueryRow(query, assetId)
-	err := row.Scan(&asset.Public, &asset.Path, &asset.Name)
+	err := row.Scan(&asset.UserId, &asset.Public, &asset.Path, &asset.Name, &asset.ScanStatus, &asset.KeyId, &asset.DataKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, r, "asset not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		log.Println("Database error", err.Error())
 		response.RespondWithError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if !asset.Public {
-		userId, err := auth.Verify(r)
-		if err != nil || !strings.HasPrefix(asset.Path, userId) {
-			log.Println("user not authorised")
-			response.RespondWithError(w, r, "you are not authenticated to access this asset", http.StatusForbidden)
-			return
-		}
+	userId, err := ar.Auth.Verify(r, auth.ScopeAssetsRead)
+	owner := err == nil && userId == asset.UserId
+	if !asset.Public && !owner {
+		log.Println("user not authorised")
+		response.RespondWithError(w, r, "you are not authenticated to access this asset", http.StatusForbidden)
+		return
 	}
 
-	f, err := os.Create(assetId)
-	if err != nil {
-		log.Println("Local File Creation Error", err.Error())
-		response.RespondWithError(w, r, "Something went wrong creating the local file", http.StatusBadRequest)
+	if err = servable(asset.ScanStatus, owner); err != nil {
+		response.RespondWithError(w, r, err.Error(), http.StatusForbidden)
 		return
 	}
 
-	err = awss3.DownloadFromS3(asset.Path, f, ar.Session)
+	reader, err := openOriginal(r.Context(), ar, asset)
 	if err != nil {
 		log.Println("S3 download Error: ", err.Error())
 		response.RespondWithError(w, r, "Something went wrong retrieving the file from S3", http.StatusBadRequest)
 		return
 	}
-
-	reader := unCompressFile(f)
-
-	defer f.Close()
-	defer os.Remove(assetId)
+	defer reader.Close()
 
 	w.Header().Set("Content-Disposition", "attachment; filename="+asset.Name)
-	_, _ = io.Copy(w, reader)
+	sent, err := io.Copy(w, reader)
+	if err != nil {
+		log.Println("Error streaming asset", assetId, err.Error())
+	}
+	recordAccess(r, ar, accessEvent{AssetId: assetId, OwnerId: asset.UserId, Kind: eventDownload, Owner: owner, UserId: userId, BytesSent: sent})
 }
 
 func uploadFile(w http.ResponseWriter, r *http.Request, ar *AssetResources) {
 	ctx := r.Context()
-	http.MaxBytesReader(w, r.Body, 1024<<20) // request body should not be greater than 1GB
 
-	file, handler, err := r.FormFile("file")
-	if err != nil {
-		log.Println("Error while reading FormFile: ", err.Error())
-		response.RespondWithError(w, r, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	//Detect Content Type of the file uploaded
-	buffer := make([]byte, 512)
-	_, err = file.Read(buffer)
+	uid, err := auth.GetUID(ctx)
 	if err != nil {
-		log.Println("Error while reading file buffer", err.Error())
+		log.Println("Error accessing userId", err.Error())
 		response.RespondWithError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	contentType := http.DetectContentType(buffer)
-
-	if !strings.HasPrefix(contentType, "image") {
-		response.RespondWithError(w, r, "Not a valid Video Format File", http.StatusInternalServerError)
+	if !requireVerified(w, r, ar, uid, ar.VerifiedUpload) {
 		return
 	}
 
-	title := r.FormValue("title")
-	description := r.FormValue("description")
-
-	defer file.Close()
-
-	uid, err := auth.GetUID(ctx)
+	limit, err := uploadLimit(ctx, ar, uid)
 	if err != nil {
-		log.Println("Error accessing userId", err.Error())
-		response.RespondWithError(w, r, err.Error(), http.StatusInternalServerError)
+		log.Println("Error reading upload limit", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
 
-	fileName := handler.Filename
-	compressed := compressFile(file)
-	s3Key := fmt.Sprintf("%s/%s.gz", uid, fileName)
-
-	asset := CreateAsset{
-		Title:       title,
-		Description: description,
-		Name:        fileName,
-		UserId:      uid,
-		Path:        s3Key,
-	}
-
-	//TODO: Implement transactions support so that we should insert a new record only after a successful upload
-	var query = `
-		WITH uuid AS (
-			SELECT * FROM uuid_generate_v1mc()
-		)
-		INSERT INTO assets (
-			id,
-            uid,
-            name,
-            s3_path,
-            title,
-            description
-        ) VALUES (
-			(SELECT * FROM uuid),
-            $1,
-            $2,
-            $3,
-            $4,
-            $5
-        ) RETURNING id`
+	var stored upload
 	fileId := ""
-	err = ar.DTO.QueryRow(query, asset.UserId, asset.Name, asset.Path, asset.Title, asset.Description).Scan(&fileId)
+	fields, err := streamForm(r, limit, func(part *multipart.Part, fields map[string]string) error {
+		stripMetadata, _ := strconv.ParseBool(fields["strip_metadata"])
+		stored = upload{
+			UserId:        uid,
+			Name:          part.FileName(),
+			Title:         fields["title"],
+			Description:   fields["description"],
+			Folder:        normalizeFolder(fields["folder"]),
+			StripMetadata: stripMetadata,
+			Body:          part,
+			MaxSize:       r.ContentLength,
+			Limit:         limit,
+		}
+		var err error
+		fileId, err = storeAsset(ctx, ar, stored)
+		return err
+	})
 	if err != nil {
-		log.Println("Error Inserting record to postgres: ", err.Error())
-		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		log.Println("Error while uploading file: ", err.Error())
+		response.RespondWithError(w, r, err.Error(), uploadStatus(err))
 		return
 	}
 
-	//TODO: should error out on same filename or title?
-	_, err = awss3.SaveToS3(s3Key, compressed, ar.Session)
-	if err != nil {
-		log.Println("Error while uploading file to s3", err.Error())
-		response.RespondWithError(w, r, "failed to upload", http.StatusInternalServerError)
-		return
+	// Text fields sent after the file part are applied once the upload is done.
+	if fields["title"] != stored.Title || fields["description"] != stored.Description {
+		var query = `UPDATE assets set title = $1, description = $2 where id = $3`
+		if _, err = ar.DTO.ExecContext(ctx, query, fields["title"], fields["description"], fileId); err != nil {
+			log.Println("Error updating asset fields", err.Error())
+		}
 	}
 
-	response.RespondWithSuccess(w, r, "Successfully uploaded", "", http.StatusOK)
+	response.RespondWithSuccess(w, r, "Successfully uploaded", &uploadResponse{AssetId: fileId, Status: statusProcessing}, http.StatusOK)
 }
 
 func compressFile(srcFile io.Reader) *io.PipeReader {
 	reader, writer := io.Pipe()
 	go func() {
 		gw := gzip.NewWriter(writer)
-		_, _ = io.Copy(gw, srcFile)
-		_ = gw.Close()
-		_ = writer.Close()
-	}()
-	return reader
-}
-
-func unCompressFile(f *os.File) *io.PipeReader {
-	reader, writer := io.Pipe()
-	go func() {
-		gw, _ := gzip.NewReader(f)
-		_, _ = io.Copy(writer, gw)
-		defer writer.Close()
+		_, err := io.Copy(gw, srcFile)
+		if err == nil {
+			err = gw.Close()
+		}
+		// A read error is passed on to the consumer instead of ending the stream early.
+		_ = writer.CloseWithError(err)
 	}()
 	return reader
 }
@@ -260,8 +262,21 @@ func getUserAssets(w http.ResponseWriter, r *http.Request, ar *AssetResources) {
 		return
 	}
 
-	var query = `select id, uid, title, description, name, s3_path, public from assets where uid = $1`
-	rows, err := ar.DTO.Query(query, uid)
+	// Optional filters, folder=a/b lists a single folder and tag=x assets carrying the tag.
+	queryValues := r.URL.Query()
+	folder, filterFolder := queryValues["folder"]
+	if filterFolder {
+		folder[0] = normalizeFolder(folder[0])
+	} else {
+		folder = []string{""}
+	}
+
+	var query = `
+		select id, uid, title, description, name, s3_path, public, metadata, scan_status,
+		       COALESCE(content_type, ''), original_bytes, stored_bytes, tags, folder, status
+		from assets
+		where uid = $1 and (NOT $2 OR folder = $3) and ($4 = '' OR $4 = ANY(tags))`
+	rows, err := ar.DTO.Query(query, uid, filterFolder, folder[0], strings.ToLower(queryValues.Get("tag")))
 	if err != nil {
 		log.Println("Error selecting postgres record", err.Error())
 		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
@@ -271,12 +286,15 @@ func getUserAssets(w http.ResponseWriter, r *http.Request, ar *AssetResources) {
 	var data []Asset
 	for rows.Next() {
 		var res Asset
-		err = rows.Scan(&res.Id, &res.UserId, &res.Title, &res.Description, &res.Name, &res.Path, &res.Public)
+		var metadata []byte
+		err = rows.Scan(&res.Id, &res.UserId, &res.Title, &res.Description, &res.Name, &res.Path, &res.Public, &metadata, &res.ScanStatus,
+			&res.ContentType, &res.OriginalBytes, &res.StoredBytes, pq.Array(&res.Tags), &res.Folder, &res.Status)
 		if err != nil {
 			log.Println("Error while scanning Asset Rows: ", err.Error())
 			response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
 			return
 		}
+		res.Metadata = metadata
 		data = append(data, res)
 	}
 
@@ -292,21 +310,55 @@ func grantPublicAccess(w http.ResponseWriter, r *http.Request, ar *AssetResource
 		return
 	}
 
-	var query = `UPDATE assets set public = true where id = $1`
-	rows, err := ar.DTO.Query(query, asset.Id)
-	defer rows.Close()
+	uid, err := auth.GetUID(r.Context())
+	if err != nil {
+		log.Println("Error accessing UserID: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if !requireVerified(w, r, ar, uid, ar.VerifiedShare) {
+		return
+	}
+
+	tx, err := ar.DTO.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Println("Error starting transaction", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var query = `UPDATE assets set public = true where id = $1 and uid = $2 and is_active = true RETURNING id`
+	err = tx.QueryRowContext(r.Context(), query, asset.Id, uid).Scan(&asset.Id)
+	if errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, r, "asset not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		log.Println("Error executing query", err.Error())
 		response.RespondWithError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if err = writeAssetEvent(r.Context(), tx, uid, eventAssetMadePublic, assetEvent{AssetId: asset.Id}); err != nil {
+		log.Println("Error writing asset event", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Println("Error committing transaction", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+
 	//TODO: build a tiny URL and save it to DB
 
 	response.RespondWithSuccess(w, r, "Successfully granted public access", "", http.StatusOK)
 }
 
 func deleteAsset(w http.ResponseWriter, r *http.Request, ar *AssetResources) {
+	ctx := r.Context()
 	var asset Asset
 	err := json.NewDecoder(r.Body).Decode(&asset)
 	if err != nil {
@@ -315,16 +367,59 @@ func deleteAsset(w http.ResponseWriter, r *http.Request, ar *AssetResources) {
 		return
 	}
 
-	var query = `UPDATE assets set is_active = false where id = $1`
-	rows, err := ar.DTO.Query(query, asset.Id)
-	defer rows.Close()
+	uid, err := auth.GetUID(ctx)
+	if err != nil {
+		log.Println("Error accessing UserID: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := ar.DTO.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Error starting transaction", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var query = `UPDATE assets set is_active = false where id = $1 and uid = $2 and is_active = true RETURNING id`
+	err = tx.QueryRowContext(ctx, query, asset.Id, uid).Scan(&asset.Id)
+	if errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, r, "asset not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		log.Println("Error updating asset record", err.Error())
 		response.RespondWithError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	// TODO: build a worker which will access the deleted files from is_active flag and deletes from the s3 later after 30 days or a set duration.
-	response.RespondWithSuccess(w, r, "success", "", http.StatusOK)
+
+	// The s3 objects are purged by a background job once the grace period is over.
+	jobId, err := queue.Enqueue(ctx, tx, queue.Entry{
+		UserID:  uid,
+		Kind:    jobPurgeAsset,
+		Payload: assetJob{AssetId: asset.Id},
+		RunAt:   time.Now().Add(ar.PurgeAfter),
+	})
+	if err != nil {
+		log.Println("Error enqueueing purge job", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	err = writeAssetEvent(ctx, tx, uid, eventAssetDeleted, assetEvent{AssetId: asset.Id})
+	if err != nil {
+		log.Println("Error writing asset event", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Println("Error committing transaction", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	response.RespondWithSuccess(w, r, "success", &jobResponse{JobId: jobId}, http.StatusOK)
 }
 
 // TODO: remove public access for the asset
@@ -0,0 +1,78 @@
+package assets
+
+import (
+	"context"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDownloadHidesUnavailableAssets(t *testing.T) {
+	db := dbtest.New(t)
+	ar := &AssetResources{DTO: db}
+	ctx := context.Background()
+
+	deleted := dbtest.User(t, db, "deleted@example.com")
+	owned, _, err := reserveAsset(ctx, ar, CreateAsset{UserId: deleted, Name: "a.png", Path: deleted + "/a", OriginalBytes: 1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(`UPDATE assets set public = true where id = $1`, owned); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(`UPDATE users set deleted_at = NOW() where uid = $1`, deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	active := dbtest.User(t, db, "active@example.com")
+	inactive, _, err := reserveAsset(ctx, ar, CreateAsset{UserId: active, Name: "b.png", Path: active + "/b", OriginalBytes: 1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(`UPDATE assets set public = true, is_active = false where id = $1`, inactive); err != nil {
+		t.Fatal(err)
+	}
+
+	path, h := HandleAssetDownload(ar)
+	for name, id := range map[string]string{"owner deleted": owned, "asset deleted": inactive, "unknown": "5b0e2ac4-4ad2-4c5f-b36a-7b1c0b5f6d1e"} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, path+"?asset_id="+id, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: status = %d, want %d", name, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestDeleteAssetOnce(t *testing.T) {
+	db := dbtest.New(t)
+	ar := &AssetResources{DTO: db}
+	ctx := context.Background()
+	uid := dbtest.User(t, db, "delete@example.com")
+	id, _, err := reserveAsset(ctx, ar, CreateAsset{UserId: uid, Name: "a.png", Path: uid + "/a", OriginalBytes: 1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path, h := HandleDeleteAsset(ar)
+	for i, want := range []int{http.StatusOK, http.StatusNotFound} {
+		r := httptest.NewRequest(http.MethodPut, path, strings.NewReader(`{"asset_id":"`+id+`"}`))
+		w := httptest.NewRecorder()
+		h(w, r.WithContext(auth.WithUID(r.Context(), uid)))
+		if w.Code != want {
+			t.Fatalf("delete %d: status = %d, want %d", i+1, w.Code, want)
+		}
+	}
+	var jobs, events int
+	if err = db.QueryRow(`select COUNT(*) from jobs where payload ->> 'asset_id' = $1 and kind = $2`, id, jobPurgeAsset).Scan(&jobs); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.QueryRow(`select COUNT(*) from outbox where aggregate_id = $1 and type = $2`, id, eventAssetDeleted).Scan(&events); err != nil {
+		t.Fatal(err)
+	}
+	if jobs != 1 || events != 1 {
+		t.Fatalf("%d purge jobs and %d deleted events, want 1 of each", jobs, events)
+	}
+}
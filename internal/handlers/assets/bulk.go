@@ -0,0 +1,294 @@
+package assets
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	"github.com/hitesh-goel/ekanek/internal/queue"
+	"github.com/lib/pq"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	maxBulkAssets = 1000
+	maxTags       = 50
+	maxTagLength  = 64
+
+	opDelete  = "delete"
+	opPublic  = "public"
+	opPrivate = "private"
+	opTag     = "tag"
+	opUntag   = "untag"
+	opMove    = "move"
+
+	itemOK        = "ok"
+	itemNotFound  = "not_found"
+	itemForbidden = "forbidden"
+)
+
+var (
+	errBulkInvalid = errors.New("invalid bulk request")
+
+	bulkEvents = map[string]string{
+		opDelete:  eventAssetDeleted,
+		opPublic:  eventAssetMadePublic,
+		opPrivate: eventAssetMadePrivate,
+		opTag:     eventAssetTagged,
+		opUntag:   eventAssetUntagged,
+		opMove:    eventAssetMoved,
+	}
+)
+
+type bulkRequest struct {
+	Operation string   `json:"operation"`
+	AssetIds  []string `json:"asset_ids"`
+	Tags      []string `json:"tags"`
+	Folder    string   `json:"folder"`
+}
+
+type bulkResult struct {
+	AssetId string `json:"asset_id"`
+	Status  string `json:"status"`
+	JobId   string `json:"job_id,omitempty"`
+}
+
+func HandleBulkAssets(ar *AssetResources) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/asset/bulk", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		bulkAssets(w, r, ar)
+	}
+}
+
+func (b *bulkRequest) validate() error {
+	if len(b.AssetIds) == 0 || len(b.AssetIds) > maxBulkAssets {
+		return fmt.Errorf("%v: pass between 1 and %d asset_ids", errBulkInvalid, maxBulkAssets)
+	}
+	// Ids which aren't uuids can't match an asset, they are reported as not found.
+	for i, id := range b.AssetIds {
+		if validAssetId(id) {
+			b.AssetIds[i] = strings.ToLower(id)
+		}
+	}
+	switch b.Operation {
+	case opDelete, opPublic, opPrivate:
+	case opTag, opUntag:
+		if len(b.Tags) == 0 || len(b.Tags) > maxTags {
+			return fmt.Errorf("%v: pass between 1 and %d tags", errBulkInvalid, maxTags)
+		}
+		for i, t := range b.Tags {
+			b.Tags[i] = strings.ToLower(strings.TrimSpace(t))
+			if b.Tags[i] == "" || len(b.Tags[i]) > maxTagLength {
+				return fmt.Errorf("%v: tags must be 1 to %d characters", errBulkInvalid, maxTagLength)
+			}
+		}
+	case opMove:
+		b.Folder = normalizeFolder(b.Folder)
+	default:
+		return fmt.Errorf("%v: unknown operation %q", errBulkInvalid, b.Operation)
+	}
+	return nil
+}
+
+// normalizeFolder turns "/a//b/" into "a/b", the root folder is the empty string.
+func normalizeFolder(f string) string {
+	var parts []string
+	for _, p := range strings.Split(f, "/") {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// validAssetId reports whether id is a uuid in its canonical form, e.g. 5b0e2ac4-4ad2-4c5f-b36a-7b1c0b5f6d1e.
+// Postgres rejects anything else compared to a uuid column.
+func validAssetId(id string) bool {
+	if len(id) != 36 {
+		return false
+	}
+	for i, c := range id {
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return false
+			}
+		case '0' <= c && c <= '9', 'a' <= c && c <= 'f', 'A' <= c && c <= 'F':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// bulkAssets applies one operation to many assets in a single transaction. Assets the caller
+// doesn't own are reported per item and skipped, any database error rolls back the whole batch.
+func bulkAssets(w http.ResponseWriter, r *http.Request, ar *AssetResources) {
+	ctx := r.Context()
+	var req bulkRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		log.Println("Error decoding json data", err.Error())
+		response.RespondWithError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = req.validate(); err != nil {
+		response.RespondWithError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	uid, err := auth.GetUID(ctx)
+	if err != nil {
+		log.Println("Error accessing UserID: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if !requireVerified(w, r, ar, uid, ar.VerifiedShare && req.Operation == opPublic) {
+		return
+	}
+
+	tx, err := ar.DTO.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Error starting transaction", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	results, owned, err := lockAssets(ctx, tx, uid, req.AssetIds)
+	if err != nil {
+		log.Println("Error locking assets", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	if len(owned) > 0 {
+		if err = applyBulk(ctx, tx, ar, uid, req, owned, results); err != nil {
+			log.Println("Error applying bulk operation", err.Error())
+			response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Println("Error committing transaction", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	response.RespondWithSuccess(w, r, "success", results, http.StatusOK)
+}
+
+// lockAssets locks the requested active assets and sorts them into per item results.
+func lockAssets(ctx context.Context, tx *sql.Tx, uid string, ids []string) ([]*bulkResult, []string, error) {
+	var valid []string
+	for _, id := range ids {
+		if validAssetId(id) {
+			valid = append(valid, id)
+		}
+	}
+	var query = `select id, uid from assets where id = ANY($1) and is_active = true FOR UPDATE`
+	rows, err := tx.QueryContext(ctx, query, pq.Array(valid))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	owners := make(map[string]string)
+	for rows.Next() {
+		var id, owner string
+		if err = rows.Scan(&id, &owner); err != nil {
+			return nil, nil, err
+		}
+		owners[id] = owner
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var results []*bulkResult
+	var owned []string
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		res := &bulkResult{AssetId: id, Status: itemOK}
+		switch owner, ok := owners[id]; {
+		case !ok:
+			res.Status = itemNotFound
+		case owner != uid:
+			res.Status = itemForbidden
+		default:
+			owned = append(owned, id)
+		}
+		results = append(results, res)
+	}
+	return results, owned, nil
+}
+
+func applyBulk(ctx context.Context, tx *sql.Tx, ar *AssetResources, uid string, req bulkRequest, ids []string, results []*bulkResult) error {
+	var err error
+	switch req.Operation {
+	case opPublic:
+		_, err = tx.ExecContext(ctx, `UPDATE assets set public = true where id = ANY($1)`, pq.Array(ids))
+	case opPrivate:
+		_, err = tx.ExecContext(ctx, `UPDATE assets set public = false where id = ANY($1)`, pq.Array(ids))
+	case opMove:
+		_, err = tx.ExecContext(ctx, `UPDATE assets set folder = $2 where id = ANY($1)`, pq.Array(ids), req.Folder)
+	case opTag:
+		var query = `UPDATE assets set tags = ARRAY(SELECT DISTINCT unnest(tags || $2::text[]) ORDER BY 1) where id = ANY($1)`
+		_, err = tx.ExecContext(ctx, query, pq.Array(ids), pq.Array(req.Tags))
+	case opUntag:
+		var query = `UPDATE assets set tags = ARRAY(SELECT unnest(tags) EXCEPT SELECT unnest($2::text[]) ORDER BY 1) where id = ANY($1)`
+		_, err = tx.ExecContext(ctx, query, pq.Array(ids), pq.Array(req.Tags))
+	case opDelete:
+		_, err = tx.ExecContext(ctx, `UPDATE assets set is_active = false where id = ANY($1)`, pq.Array(ids))
+		if err != nil {
+			return err
+		}
+		jobIds := make(map[string]string)
+		for _, id := range ids {
+			jobIds[id], err = queue.Enqueue(ctx, tx, queue.Entry{
+				UserID:  uid,
+				Kind:    jobPurgeAsset,
+				Payload: assetJob{AssetId: id},
+				RunAt:   time.Now().Add(ar.PurgeAfter),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for _, res := range results {
+			res.JobId = jobIds[res.AssetId]
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// One event per asset, consumers see bulk changes the same way as single ones.
+	for _, id := range ids {
+		data := assetEvent{AssetId: id}
+		switch req.Operation {
+		case opTag, opUntag:
+			data.Tags = req.Tags
+		case opMove:
+			data.Folder = &req.Folder
+		}
+		if err = writeAssetEvent(ctx, tx, uid, bulkEvents[req.Operation], data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
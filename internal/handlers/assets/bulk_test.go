@@ -0,0 +1,99 @@
+package assets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidAssetId(t *testing.T) {
+	for id, want := range map[string]bool{
+		"5b0e2ac4-4ad2-4c5f-b36a-7b1c0b5f6d1e":   true,
+		"5B0E2AC4-4AD2-4C5F-B36A-7B1C0B5F6D1E":   true,
+		"5b0e2ac44ad24c5fb36a7b1c0b5f6d1e":       false,
+		"{5b0e2ac4-4ad2-4c5f-b36a-7b1c0b5f6d1e}": false,
+		"5b0e2ac4-4ad2-4c5f-b36a-7b1c0b5f6d1g":   false,
+		"5b0e2ac4-4ad2-4c5f-b36a_7b1c0b5f6d1e":   false,
+		"not-a-uuid":                             false,
+		"":                                       false,
+	} {
+		if got := validAssetId(id); got != want {
+			t.Errorf("validAssetId(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestArchiveRejectsInvalidIds(t *testing.T) {
+	path, h := HandleAssetArchive(&AssetResources{})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"asset_ids": ["1; drop table assets"]}`)))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestBulkReportsPerItemResults(t *testing.T) {
+	db := dbtest.New(t)
+	ar := &AssetResources{DTO: db}
+	ctx := context.Background()
+
+	uid := dbtest.User(t, db, "bulk@example.com")
+	owned, _, err := reserveAsset(ctx, ar, CreateAsset{UserId: uid, Name: "a.png", Path: uid + "/a", OriginalBytes: 1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := dbtest.User(t, db, "other@example.com")
+	foreign, _, err := reserveAsset(ctx, ar, CreateAsset{UserId: other, Name: "b.png", Path: other + "/b", OriginalBytes: 1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unknown := "5b0e2ac4-4ad2-4c5f-b36a-7b1c0b5f6d1e"
+	body, err := json.Marshal(bulkRequest{Operation: opTag, Tags: []string{"Logo"},
+		AssetIds: []string{strings.ToUpper(owned), foreign, unknown, "not-a-uuid", owned}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, h := HandleBulkAssets(ar)
+	r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	h(w, r.WithContext(auth.WithUID(r.Context(), uid)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	var resp struct {
+		Data []bulkResult `json:"data"`
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := []bulkResult{
+		{AssetId: owned, Status: itemOK},
+		{AssetId: foreign, Status: itemForbidden},
+		{AssetId: unknown, Status: itemNotFound},
+		{AssetId: "not-a-uuid", Status: itemNotFound},
+	}
+	if len(resp.Data) != len(want) {
+		t.Fatalf("results %+v, want %+v", resp.Data, want)
+	}
+	for i := range want {
+		if resp.Data[i] != want[i] {
+			t.Errorf("result %d = %+v, want %+v", i, resp.Data[i], want[i])
+		}
+	}
+
+	var tags string
+	if err = db.QueryRow(`select array_to_string(tags, ',') from assets where id = $1`, owned).Scan(&tags); err != nil || tags != "logo" {
+		t.Fatalf("tags = %q, err = %v, want logo", tags, err)
+	}
+	if err = db.QueryRow(`select array_to_string(tags, ',') from assets where id = $1`, foreign).Scan(&tags); err != nil || tags != "" {
+		t.Fatalf("tagged an asset of another user: %q, err = %v", tags, err)
+	}
+}
@@ -0,0 +1,98 @@
+package assets
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	awss3 "github.com/hitesh-goel/ekanek/internal/pkg/aws"
+	"github.com/hitesh-goel/ekanek/internal/pkg/envelope"
+	"io"
+)
+
+var errKeyUnavailable = errors.New("asset key is unavailable")
+
+// newDataKey returns a fresh data key for an upload of the user along with its wrapped form,
+// the key is nil when encryption at rest is disabled.
+func newDataKey(ctx context.Context, ar *AssetResources, uid string) ([]byte, *string, []byte, error) {
+	if ar.KMS == nil {
+		return nil, nil, nil, nil
+	}
+	key, err := envelope.NewDataKey()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keyId, wrapped, err := ar.KMS.WrapKey(ctx, uid, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return key, &keyId, wrapped, nil
+}
+
+// assetKey unwraps the data key of an asset, it is nil for assets stored before encryption was enabled.
+func assetKey(ctx context.Context, ar *AssetResources, a Asset) ([]byte, error) {
+	if a.KeyId == nil {
+		return nil, nil
+	}
+	if ar.KMS == nil {
+		return nil, errKeyUnavailable
+	}
+	return ar.KMS.UnwrapKey(ctx, a.UserId, *a.KeyId, a.DataKey)
+}
+
+// objectKey returns a new s3 key for an object of the user, it doesn't reveal the file name.
+func objectKey(uid string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s", uid, hex.EncodeToString(b)), nil
+}
+
+func encryptFile(srcFile io.Reader, key []byte) *io.PipeReader {
+	reader, writer := io.Pipe()
+	go func() {
+		ew, err := envelope.NewWriter(writer, key)
+		if err == nil {
+			_, err = io.Copy(ew, srcFile)
+			if err == nil {
+				err = ew.Close()
+			}
+		}
+		_ = writer.CloseWithError(err)
+	}()
+	return reader
+}
+
+// decryptFile returns the plain content of a stored object, as is when key is nil.
+func decryptFile(body io.Reader, key []byte) (io.Reader, error) {
+	if key == nil {
+		return body, nil
+	}
+	return envelope.NewReader(body, key)
+}
+
+// openOriginal returns a streaming reader of the decrypted and decompressed original, the caller must close it.
+func openOriginal(ctx context.Context, ar *AssetResources, a Asset) (io.ReadCloser, error) {
+	key, err := assetKey(ctx, ar, a)
+	if err != nil {
+		return nil, err
+	}
+	body, err := awss3.GetFromS3(a.Path, ar.Session)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := decryptFile(body, key)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	gr, err := gzip.NewReader(plain)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return readCloser{Reader: gr, Closer: body}, nil
+}
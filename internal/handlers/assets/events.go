@@ -0,0 +1,248 @@
+package assets
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	"github.com/hitesh-goel/ekanek/internal/outbox"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	eventDownload = "download"
+	eventArchive  = "archive"
+
+	viaOwner  = "owner"
+	viaPublic = "public"
+
+	aggregateAsset = "asset"
+
+	eventAssetUploaded    = "asset.uploaded"
+	eventAssetMadePublic  = "asset.made_public"
+	eventAssetMadePrivate = "asset.made_private"
+	eventAssetTagged      = "asset.tagged"
+	eventAssetUntagged    = "asset.untagged"
+	eventAssetMoved       = "asset.moved"
+	eventAssetDeleted     = "asset.deleted"
+	eventAssetPurged      = "asset.purged"
+	eventAssetDownloaded  = "asset.downloaded"
+	eventAssetScanned     = "asset.scanned"
+	eventAssetReady       = "asset.ready"
+	eventAssetFailed      = "asset.processing_failed"
+
+	defaultStatsDays = 30
+	maxStatsDays     = 365
+	maxUserAgent     = 256
+)
+
+type DailyStats struct {
+	Date      string `json:"date"`
+	Downloads int64  `json:"downloads"`
+	Unique    int64  `json:"unique"`
+}
+
+type AssetStats struct {
+	AssetId         string       `json:"asset_id"`
+	TotalDownloads  int64        `json:"total_downloads"`
+	UniqueDownloads int64        `json:"unique_downloads"`
+	SharedDownloads int64        `json:"shared_downloads"`
+	BytesSent       int64        `json:"bytes_sent"`
+	LastDownloadAt  *time.Time   `json:"last_download_at"`
+	Daily           []DailyStats `json:"daily"`
+}
+
+// accessEvent is a single access to an asset's content.
+type accessEvent struct {
+	AssetId   string
+	OwnerId   string
+	Kind      string
+	Owner     bool
+	UserId    string
+	BytesSent int64
+}
+
+// assetEvent is the data of the asset events written to the outbox.
+type assetEvent struct {
+	AssetId       string   `json:"asset_id"`
+	Name          string   `json:"name,omitempty"`
+	Folder        *string  `json:"folder,omitempty"`
+	Tags          []string `json:"tags,omitempty"`
+	ContentType   string   `json:"content_type,omitempty"`
+	Status        string   `json:"status,omitempty"`
+	ScanStatus    string   `json:"scan_status,omitempty"`
+	OriginalBytes int64    `json:"original_bytes,omitempty"`
+	Kind          string   `json:"kind,omitempty"`
+	Via           string   `json:"via,omitempty"`
+	BytesSent     int64    `json:"bytes_sent,omitempty"`
+}
+
+// writeAssetEvent records an event of the user's asset in the outbox.
+func writeAssetEvent(ctx context.Context, db outbox.Execer, uid string, event string, data assetEvent) error {
+	return outbox.Write(ctx, db, outbox.Event{
+		AggregateType: aggregateAsset,
+		AggregateId:   data.AssetId,
+		UserID:        uid,
+		Type:          event,
+		Data:          data,
+	})
+}
+
+func HandleAssetStats(ar *AssetResources) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/asset/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		assetStats(w, r, ar)
+	}
+}
+
+// recordAccess stores an access event. It runs after the content was streamed, so it uses its own
+// context: a client hanging up mid download is still recorded with the bytes it received.
+func recordAccess(r *http.Request, ar *AssetResources, e accessEvent) {
+	via := viaPublic
+	if e.Owner {
+		via = viaOwner
+	}
+	var uid sql.NullString
+	if e.UserId != "" {
+		uid = sql.NullString{String: e.UserId, Valid: true}
+	}
+	ua := r.UserAgent()
+	if len(ua) > maxUserAgent {
+		ua = ua[:maxUserAgent]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tx, err := ar.DTO.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Error starting transaction", err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	var query = `
+		INSERT INTO asset_events (asset_id, kind, via, uid, bytes_sent, user_agent, client_ip)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	_, err = tx.ExecContext(ctx, query, e.AssetId, e.Kind, via, uid, e.BytesSent, ua, coarseIP(r.RemoteAddr))
+	if err == nil {
+		err = writeAssetEvent(ctx, tx, e.OwnerId, eventAssetDownloaded, assetEvent{
+			AssetId:   e.AssetId,
+			Kind:      e.Kind,
+			Via:       via,
+			BytesSent: e.BytesSent,
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println("Error recording asset event", err.Error())
+	}
+}
+
+// coarseIP truncates the client address to its /24 (IPv4) or /48 (IPv6) network,
+// enough to tell visitors apart without storing who they are.
+func coarseIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// assetStats reports download counts for one of the caller's assets. Unique downloads count distinct
+// users, anonymous visitors are told apart by network and user agent.
+func assetStats(w http.ResponseWriter, r *http.Request, ar *AssetResources) {
+	ctx := r.Context()
+	queryValues := r.URL.Query()
+	assetId := queryValues.Get("asset_id")
+	if assetId == "" {
+		response.RespondWithError(w, r, "pass valid asset_id in query param", http.StatusBadRequest)
+		return
+	}
+
+	days := defaultStatsDays
+	if d := queryValues.Get("days"); d != "" {
+		n, err := strconv.Atoi(d)
+		if err != nil || n < 1 || n > maxStatsDays {
+			response.RespondWithError(w, r, "days must be between 1 and "+strconv.Itoa(maxStatsDays), http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	uid, err := auth.GetUID(ctx)
+	if err != nil {
+		log.Println("Error accessing UserID: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	var owner string
+	err = ar.DTO.QueryRowContext(ctx, `select uid from assets where id = $1 and is_active = true`, assetId).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && owner != uid) {
+		response.RespondWithError(w, r, "asset not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Database error", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	stats := AssetStats{AssetId: assetId, Daily: []DailyStats{}}
+	var query = `
+		select COUNT(*),
+		       COUNT(DISTINCT COALESCE(uid::text, client_ip || ' ' || user_agent)),
+		       COUNT(*) FILTER (WHERE via <> 'owner'),
+		       COALESCE(SUM(bytes_sent), 0),
+		       MAX(created_at)
+		from asset_events where asset_id = $1`
+	err = ar.DTO.QueryRowContext(ctx, query, assetId).Scan(&stats.TotalDownloads, &stats.UniqueDownloads,
+		&stats.SharedDownloads, &stats.BytesSent, &stats.LastDownloadAt)
+	if err != nil {
+		log.Println("Error selecting asset stats", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	query = `
+		select to_char(day, 'YYYY-MM-DD'), COUNT(e.id),
+		       COUNT(DISTINCT COALESCE(e.uid::text, e.client_ip || ' ' || e.user_agent))
+		from generate_series(date_trunc('day', NOW() - ($2 - 1) * interval '1 day'), date_trunc('day', NOW()), interval '1 day') day
+		left join asset_events e on e.asset_id = $1 and date_trunc('day', e.created_at) = day
+		group by day order by day`
+	rows, err := ar.DTO.QueryContext(ctx, query, assetId, days)
+	if err != nil {
+		log.Println("Error selecting daily asset stats", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d DailyStats
+		if err = rows.Scan(&d.Date, &d.Downloads, &d.Unique); err != nil {
+			log.Println("Error while scanning asset stats rows: ", err.Error())
+			response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+			return
+		}
+		stats.Daily = append(stats.Daily, d)
+	}
+
+	response.RespondWithSuccess(w, r, "success", stats, http.StatusOK)
+}
@@ -0,0 +1,302 @@
+package assets
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxArchiveEntries = 1000
+	maxExpansionRatio = 100
+	// minExpansionCheck is the decompressed size below which the ratio is not checked,
+	// tiny files compress far better than 1:100 without being a threat.
+	minExpansionCheck = 1 << 20
+
+	entryStored   = "stored"
+	entrySkipped  = "skipped"
+	entryRejected = "rejected"
+)
+
+var (
+	errArchiveFormat  = errors.New("pass a zip, tar or tar.gz archive")
+	errExpansionRatio = errors.New("archive exceeds the maximum compression ratio")
+	errNotRegular     = errors.New("not a regular file")
+)
+
+type entryResult struct {
+	Name    string `json:"name"`
+	AssetId string `json:"asset_id,omitempty"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+type extractResult struct {
+	Entries []*entryResult `json:"entries"`
+	// Truncated is set when extraction stopped early, Error says why.
+	Truncated bool   `json:"truncated"`
+	Error     string `json:"error,omitempty"`
+}
+
+// extractor stores the entries of one archive as individual assets.
+type extractor struct {
+	ctx    context.Context
+	ar     *AssetResources
+	uid    string
+	folder string
+	strip  bool
+	limit  int64
+	result extractResult
+	seen   int
+	// names are the asset names handed out so far, names are unique per user across folders.
+	names map[string]bool
+}
+
+// ratioReader fails once the decompressed stream outgrows its compressed input by maxExpansionRatio.
+type ratioReader struct {
+	r  io.Reader
+	in *countingReader
+	n  int64
+}
+
+func (rr *ratioReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.n += int64(n)
+	if !expansionAllowed(rr.in.n, rr.n) {
+		return n, errExpansionRatio
+	}
+	return n, err
+}
+
+func expansionAllowed(compressed, n int64) bool {
+	return n <= minExpansionCheck || n <= compressed*maxExpansionRatio
+}
+
+func HandleArchiveUpload(ar *AssetResources) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/asset/upload/archive", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		uploadArchive(w, r, ar)
+	}
+}
+
+// uploadArchive expands an uploaded zip, tar or tar.gz into one asset per file. Every entry goes
+// through the same checks as a single upload and is reported individually, so one bad file
+// doesn't fail the rest of the archive.
+func uploadArchive(w http.ResponseWriter, r *http.Request, ar *AssetResources) {
+	ctx := r.Context()
+
+	uid, err := auth.GetUID(ctx)
+	if err != nil {
+		log.Println("Error accessing userId", err.Error())
+		response.RespondWithError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !requireVerified(w, r, ar, uid, ar.VerifiedUpload) {
+		return
+	}
+
+	limit, err := uploadLimit(ctx, ar, uid)
+	if err != nil {
+		log.Println("Error reading upload limit", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	var ex *extractor
+	_, err = streamForm(r, limit, func(part *multipart.Part, fields map[string]string) error {
+		strip, _ := strconv.ParseBool(fields["strip_metadata"])
+		ex = &extractor{ctx: ctx, ar: ar, uid: uid, folder: fields["folder"], strip: strip, limit: limit, names: make(map[string]bool)}
+		return ex.extract(part)
+	})
+	if err != nil && (ex == nil || len(ex.result.Entries) == 0) {
+		log.Println("Error while extracting archive: ", err.Error())
+		response.RespondWithError(w, r, err.Error(), uploadStatus(err))
+		return
+	}
+	if err != nil {
+		// Entries which were stored stay stored, report them along with the reason extraction stopped.
+		log.Println("Error while extracting archive: ", err.Error())
+		ex.result.Truncated, ex.result.Error = true, err.Error()
+	}
+	response.RespondWithSuccess(w, r, "Archive extracted", &ex.result, http.StatusOK)
+}
+
+// extract sniffs the archive format and stores its entries.
+func (ex *extractor) extract(body io.Reader) error {
+	br := bufio.NewReaderSize(body, 1024)
+	head, _ := br.Peek(512)
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		return ex.extractZip(br)
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		in := &countingReader{r: br}
+		gr, err := gzip.NewReader(in)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errArchiveFormat, err)
+		}
+		return ex.extractTar(&ratioReader{r: gr, in: in})
+	case len(head) > 262 && string(head[257:262]) == "ustar":
+		return ex.extractTar(br)
+	default:
+		return errArchiveFormat
+	}
+}
+
+// extractZip spools the archive to a temp file first, the zip directory is at the end of the file.
+func (ex *extractor) extractZip(body io.Reader) error {
+	tmp, err := ioutil.TempFile("", "upload-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, body)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errArchiveFormat, err)
+	}
+
+	for _, f := range zr.File {
+		if !ex.next() {
+			return nil
+		}
+		if f.FileInfo().IsDir() || hiddenEntry(f.Name) {
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			ex.report(f.Name, "", errNotRegular)
+			continue
+		}
+		// The zip reader fails entries which decompress to more than their declared size,
+		// so checking the declared sizes is enough.
+		if !expansionAllowed(int64(f.CompressedSize64), int64(f.UncompressedSize64)) {
+			ex.report(f.Name, "", errExpansionRatio)
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			ex.report(f.Name, "", err)
+			continue
+		}
+		id, err := ex.store(f.Name, rc, int64(f.UncompressedSize64))
+		rc.Close()
+		ex.report(f.Name, id, err)
+	}
+	return nil
+}
+
+// extractTar streams the entries straight from the request body.
+func (ex *extractor) extractTar(body io.Reader) error {
+	tr := tar.NewReader(body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return formatError(err)
+		}
+		if !ex.next() {
+			return nil
+		}
+		if hdr.Typeflag == tar.TypeDir || hiddenEntry(hdr.Name) {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			ex.report(hdr.Name, "", errNotRegular)
+			continue
+		}
+		id, err := ex.store(hdr.Name, tr, hdr.Size)
+		// Errors from the archive stream itself are sticky, they stop extraction on the next header.
+		ex.report(hdr.Name, id, err)
+	}
+}
+
+// formatError marks the errors of a corrupt or truncated archive stream as errArchiveFormat, other
+// errors, e.g. reading the request body or the compression ratio, are returned as they are.
+func formatError(err error) error {
+	var corrupt flate.CorruptInputError
+	if errors.Is(err, tar.ErrHeader) || errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &corrupt) {
+		return fmt.Errorf("%w: %v", errArchiveFormat, err)
+	}
+	return err
+}
+
+// next counts an entry and reports whether it is within maxArchiveEntries.
+func (ex *extractor) next() bool {
+	ex.seen++
+	if ex.seen > maxArchiveEntries {
+		ex.result.Truncated = true
+		ex.result.Error = fmt.Sprintf("only the first %d entries of an archive are extracted", maxArchiveEntries)
+		return false
+	}
+	return true
+}
+
+func (ex *extractor) store(name string, body io.Reader, size int64) (string, error) {
+	if size > ex.limit {
+		return "", errUploadTooLarge
+	}
+	return storeAsset(ex.ctx, ex.ar, ex.upload(name, body, size))
+}
+
+// upload describes the asset an entry is stored as, the directory of the entry becomes its folder and
+// names repeated in several directories are suffixed, e.g. a/photo.png and b/photo.png are stored as
+// photo.png and photo (2).png.
+func (ex *extractor) upload(name string, body io.Reader, size int64) upload {
+	name = path.Clean("/" + name)
+	return upload{
+		UserId:        ex.uid,
+		Name:          uniqueName(ex.names, path.Base(name)),
+		Folder:        normalizeFolder(ex.folder + "/" + path.Dir(name)),
+		StripMetadata: ex.strip,
+		Body:          body,
+		SizeHint:      size,
+		Limit:         ex.limit,
+	}
+}
+
+func (ex *extractor) report(name string, assetId string, err error) {
+	res := &entryResult{Name: name, AssetId: assetId, Status: entryStored}
+	switch {
+	case errors.Is(err, errNotRegular):
+		res.Status, res.Error = entrySkipped, err.Error()
+	case err != nil:
+		res.Status, res.Error = entryRejected, err.Error()
+		if uploadStatus(err) == http.StatusInternalServerError {
+			log.Println("Error storing archive entry", name, err.Error())
+			res.Error = errUploadFailed.Error()
+		}
+	}
+	ex.result.Entries = append(ex.result.Entries, res)
+}
+
+// hiddenEntry matches dotfiles and the resource forks macOS adds to zips.
+func hiddenEntry(name string) bool {
+	return strings.HasPrefix(path.Base(name), ".") || strings.HasPrefix(name, "__MACOSX/")
+}
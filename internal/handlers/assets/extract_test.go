@@ -0,0 +1,161 @@
+package assets
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExtractorUpload(t *testing.T) {
+	ex := &extractor{uid: "uid", folder: "holidays", names: make(map[string]bool)}
+	var got []string
+	for _, entry := range []string{"photo.png", "a/photo.png", "b/photo.png", "../../b/c/photo.png", "a/other.png"} {
+		u := ex.upload(entry, nil, 0)
+		got = append(got, u.Folder+":"+u.Name)
+	}
+	want := "[holidays:photo.png holidays/a:photo (2).png holidays/b:photo (3).png holidays/b/c:photo (4).png holidays/a:other.png]"
+	if fmt.Sprint(got) != want {
+		t.Fatalf("uploads %v, want %s", got, want)
+	}
+}
+
+func TestExtractTarReportsEntries(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "photos/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "photos/.DS_Store", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		{Name: "photos/link.png", Typeflag: tar.TypeSymlink, Linkname: "large.png"},
+		{Name: "photos/large.png", Typeflag: tar.TypeReg, Mode: 0644, Size: 16},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(make([]byte, hdr.Size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ex := &extractor{ctx: context.Background(), uid: "uid", limit: 8, names: make(map[string]bool)}
+	if err := ex.extract(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range ex.result.Entries {
+		got = append(got, e.Name+":"+e.Status)
+	}
+	if want := "[photos/link.png:skipped photos/large.png:rejected]"; fmt.Sprint(got) != want {
+		t.Fatalf("entries %v, want %s", got, want)
+	}
+	if ex.result.Entries[1].Error != errUploadTooLarge.Error() {
+		t.Fatalf("error %q, want %q", ex.result.Entries[1].Error, errUploadTooLarge)
+	}
+}
+
+func TestExpansionAllowed(t *testing.T) {
+	for _, tt := range []struct {
+		compressed, n int64
+		want          bool
+	}{
+		{compressed: 1, n: minExpansionCheck, want: true},
+		{compressed: 1, n: minExpansionCheck + 1, want: false},
+		{compressed: 1 << 20, n: 100 << 20, want: true},
+		{compressed: 1 << 20, n: 100<<20 + 1, want: false},
+	} {
+		if got := expansionAllowed(tt.compressed, tt.n); got != tt.want {
+			t.Errorf("expansionAllowed(%d, %d) = %v, want %v", tt.compressed, tt.n, got, tt.want)
+		}
+	}
+}
+
+func testZip(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	f, err := zw.Create("photo.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write(bytes.Repeat([]byte("x"), 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testTarGz(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{Name: "photo.png", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractRejectsCorruptArchives(t *testing.T) {
+	for name, archive := range map[string][]byte{
+		"truncated zip":    testZip(t)[:40],
+		"gzip header":      append([]byte{0x1f, 0x8b, 0}, make([]byte, 32)...),
+		"truncated tar.gz": testTarGz(t)[:20],
+	} {
+		ex := &extractor{ctx: context.Background(), uid: "uid", limit: 8, names: make(map[string]bool)}
+		err := ex.extract(bytes.NewReader(archive))
+		if !errors.Is(err, errArchiveFormat) || uploadStatus(err) != http.StatusUnsupportedMediaType {
+			t.Errorf("%s: err = %v, want %v", name, err, errArchiveFormat)
+		}
+	}
+}
+
+func TestUploadArchiveRejectsTruncatedZip(t *testing.T) {
+	db := dbtest.New(t)
+	ar := &AssetResources{DTO: db, UploadLimits: map[string]int64{defaultPlan: 1 << 20}}
+	uid := dbtest.User(t, db, "archive@example.com")
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", "photos.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = part.Write(testZip(t)[:40]); err != nil {
+		t.Fatal(err)
+	}
+	if err = mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path, h := HandleArchiveUpload(ar)
+	r := httptest.NewRequest(http.MethodPost, path, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	h(w, r.WithContext(auth.WithUID(r.Context(), uid)))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("status = %d, body %s, want %d", w.Code, w.Body.String(), http.StatusUnsupportedMediaType)
+	}
+}
@@ -0,0 +1,208 @@
+package assets
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	awss3 "github.com/hitesh-goel/ekanek/internal/pkg/aws"
+	"github.com/hitesh-goel/ekanek/internal/queue"
+	"io"
+	"log"
+)
+
+const (
+	jobHashAsset  = "asset.hash"
+	jobPurgeAsset = "asset.purge"
+)
+
+type assetJob struct {
+	AssetId string `json:"asset_id"`
+}
+
+// RegisterJobs registers the asset post-processing handlers on the queue.
+func RegisterJobs(q *queue.Queue, ar *AssetResources) {
+	q.Register(jobHashAsset, processingJob(ar, hashAsset))
+	q.Register(jobPurgeAsset, func(ctx context.Context, j queue.Job) error {
+		return purgeAsset(ctx, j, ar)
+	})
+	q.Register(jobRewrapKeys, func(ctx context.Context, j queue.Job) error {
+		return rewrapKeys(ctx, j, ar)
+	})
+	q.Register(jobEncryptAssets, func(ctx context.Context, j queue.Job) error {
+		return encryptAssets(ctx, j, ar)
+	})
+	q.Register(jobScanAsset, processingJob(ar, scanAsset))
+}
+
+// processingJob wraps a job processing an uploaded asset, the asset is marked failed once the job
+// is out of attempts, it would otherwise stay in processing forever.
+func processingJob(ar *AssetResources, h func(ctx context.Context, j queue.Job, ar *AssetResources) error) queue.Handler {
+	return func(ctx context.Context, j queue.Job) error {
+		err := h(ctx, j, ar)
+		if err != nil && j.Attempts >= j.MaxAttempts {
+			if ferr := failProcessing(ctx, ar, j); ferr != nil {
+				log.Println("Error marking asset processing failed", ferr.Error())
+			}
+		}
+		return err
+	}
+}
+
+// hashAsset stores the sha256 checksum of the original (uncompressed) content,
+// along with the original and stored sizes.
+func hashAsset(ctx context.Context, j queue.Job, ar *AssetResources) error {
+	var p assetJob
+	if err := j.Decode(&p); err != nil {
+		return err
+	}
+
+	var a Asset
+	var query = `select s3_path, uid, key_id, data_key from assets where id = $1`
+	err := ar.DTO.QueryRowContext(ctx, query, p.AssetId).Scan(&a.Path, &a.UserId, &a.KeyId, &a.DataKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	key, err := assetKey(ctx, ar, a)
+	if err != nil {
+		return err
+	}
+
+	body, err := awss3.GetFromS3(a.Path, ar.Session)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	stored := &countingReader{r: body}
+	plain, err := decryptFile(stored, key)
+	if err != nil {
+		return err
+	}
+	gr, err := gzip.NewReader(plain)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	original, err := io.Copy(h, gr)
+	if err != nil {
+		return err
+	}
+
+	return recordChecksum(ctx, ar, p.AssetId, hex.EncodeToString(h.Sum(nil)), original, stored.n)
+}
+
+// recordChecksum stores the checksum and sizes, the asset is ready when it was scanned clean already.
+func recordChecksum(ctx context.Context, ar *AssetResources, assetId string, checksum string, original, stored int64) error {
+	tx, err := ar.DTO.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	p, err := lockProcessed(ctx, tx, assetId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var query = `UPDATE assets set checksum = $1, original_bytes = $2, stored_bytes = $3 where id = $4`
+	if _, err = tx.ExecContext(ctx, query, checksum, original, stored, assetId); err != nil {
+		return err
+	}
+	p.Hashed = true
+	if p.ready() {
+		if err = markReady(ctx, tx, p.UserId, assetId); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// purgeAsset removes a deleted asset and its cached variants from s3, then drops the record.
+// Assets which were re-activated in the meantime are left alone.
+func purgeAsset(ctx context.Context, j queue.Job, ar *AssetResources) error {
+	var p assetJob
+	if err := j.Decode(&p); err != nil {
+		return err
+	}
+
+	var path, uid string
+	var active bool
+	err := ar.DTO.QueryRowContext(ctx, `select s3_path, uid, is_active from assets where id = $1`, p.AssetId).Scan(&path, &uid, &active)
+	if errors.Is(err, sql.ErrNoRows) || active {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = awss3.DeleteFromS3(path, ar.Session); err != nil {
+		return err
+	}
+	if err = awss3.DeletePrefixFromS3("variants/"+p.AssetId+"/", ar.Session); err != nil {
+		return err
+	}
+
+	tx, err := ar.DTO.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM assets where id = $1 and is_active = false`, p.AssetId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		if err = writeAssetEvent(ctx, tx, uid, eventAssetPurged, assetEvent{AssetId: p.AssetId}); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// PurgeUserAssets removes every asset of a user and its cached variants from s3 and drops the
+// records, when the account is deleted.
+func PurgeUserAssets(ctx context.Context, ar *AssetResources, uid string) error {
+	for {
+		rows, err := ar.DTO.QueryContext(ctx, `select id, s3_path from assets where uid = $1 limit 100`, uid)
+		if err != nil {
+			return err
+		}
+		var ids, paths []string
+		for rows.Next() {
+			var id, path string
+			if err = rows.Scan(&id, &path); err != nil {
+				rows.Close()
+				return err
+			}
+			ids, paths = append(ids, id), append(paths, path)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		for i, id := range ids {
+			if err = awss3.DeleteFromS3(paths[i], ar.Session); err != nil {
+				return err
+			}
+			if err = awss3.DeletePrefixFromS3("variants/"+id+"/", ar.Session); err != nil {
+				return err
+			}
+			if _, err = ar.DTO.ExecContext(ctx, `DELETE FROM assets where id = $1`, id); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package assets
+
+import (
+	"context"
+	"database/sql"
+	awss3 "github.com/hitesh-goel/ekanek/internal/pkg/aws"
+	"github.com/hitesh-goel/ekanek/internal/queue"
+	"log"
+	"strings"
+)
+
+const (
+	jobRewrapKeys    = "asset.rewrap_keys"
+	jobEncryptAssets = "asset.encrypt"
+
+	rewrapBatchSize = 100
+	// encryptBatchSize is smaller, every asset of a batch is downloaded and uploaded again.
+	encryptBatchSize = 20
+
+	// firstAssetId sorts before every asset id, a re-wrap starts after it.
+	firstAssetId = "00000000-0000-0000-0000-000000000000"
+)
+
+// rewrapJob is the payload of both the re-wrap and the encrypt jobs.
+type rewrapJob struct {
+	// After is the id of the last asset handled by the previous batch.
+	After string `json:"after,omitempty"`
+}
+
+// KeyUsage is the number of assets whose data keys are wrapped with a master key,
+// KeyId is empty for assets stored unencrypted.
+type KeyUsage struct {
+	KeyId       string `json:"key_id"`
+	Assets      int64  `json:"assets"`
+	StoredBytes int64  `json:"stored_bytes"`
+}
+
+// KeyReport counts the assets per master key.
+func KeyReport(ctx context.Context, db *sql.DB) ([]KeyUsage, error) {
+	var query = `
+		select COALESCE(key_id, ''), COUNT(*), COALESCE(SUM(stored_bytes), 0)
+		from assets group by key_id order by key_id nulls first`
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usage []KeyUsage
+	for rows.Next() {
+		var u KeyUsage
+		if err = rows.Scan(&u.KeyId, &u.Assets, &u.StoredBytes); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+// EnqueueRewrap schedules re-wrapping the data keys of all assets which aren't wrapped with the
+// active master key. Content is not re-encrypted, only the wrapped data keys change.
+func EnqueueRewrap(ctx context.Context, db queue.Querier) (string, error) {
+	return queue.Enqueue(ctx, db, queue.Entry{Kind: jobRewrapKeys, Payload: rewrapJob{}})
+}
+
+// rewrapKeys re-wraps a batch of data keys with the active master key and enqueues the batch after
+// it until none are left. Master keys can be retired once no asset uses them any more. A key which
+// can't be unwrapped is logged and skipped, it stays with its master key.
+func rewrapKeys(ctx context.Context, j queue.Job, ar *AssetResources) error {
+	if ar.KMS == nil {
+		return errKeyUnavailable
+	}
+	var p rewrapJob
+	if err := j.Decode(&p); err != nil {
+		return err
+	}
+	if p.After == "" {
+		p.After = firstAssetId
+	}
+	active := ar.KMS.KeyId()
+
+	var query = `
+		select id, uid, key_id, data_key from assets
+		where key_id IS NOT NULL and key_id <> $1 and id > $3
+		order by id limit $2`
+	rows, err := ar.DTO.QueryContext(ctx, query, active, rewrapBatchSize, p.After)
+	if err != nil {
+		return err
+	}
+	var batch []Asset
+	for rows.Next() {
+		var a Asset
+		if err = rows.Scan(&a.Id, &a.UserId, &a.KeyId, &a.DataKey); err != nil {
+			rows.Close()
+			return err
+		}
+		batch = append(batch, a)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, a := range batch {
+		key, err := assetKey(ctx, ar, a)
+		if err != nil {
+			log.Println("Error unwrapping data key, skipping asset", a.Id, err.Error())
+			continue
+		}
+		keyId, wrapped, err := ar.KMS.WrapKey(ctx, a.UserId, key)
+		if err != nil {
+			return err
+		}
+		// The old key id guards against overwriting a key re-wrapped concurrently.
+		query = `UPDATE assets set key_id = $1, data_key = $2 where id = $3 and key_id = $4`
+		if _, err = ar.DTO.ExecContext(ctx, query, keyId, wrapped, a.Id, *a.KeyId); err != nil {
+			return err
+		}
+	}
+
+	if len(batch) == rewrapBatchSize {
+		_, err = queue.Enqueue(ctx, ar.DTO, queue.Entry{Kind: jobRewrapKeys, Payload: rewrapJob{After: batch[len(batch)-1].Id}})
+		return err
+	}
+	log.Println("Re-wrapped asset keys with", active)
+	return nil
+}
+
+// EnqueueEncrypt schedules encrypting the assets stored before encryption was enabled with the
+// active master key.
+func EnqueueEncrypt(ctx context.Context, db queue.Querier) (string, error) {
+	return queue.Enqueue(ctx, db, queue.Entry{Kind: jobEncryptAssets, Payload: rewrapJob{}})
+}
+
+// unencryptedAssets returns the next batch of assets stored without a data key after the asset after.
+func unencryptedAssets(ctx context.Context, db *sql.DB, after string) ([]Asset, error) {
+	var query = `
+		select id, uid, s3_path from assets
+		where key_id IS NULL and id > $1
+		order by id limit $2`
+	rows, err := db.QueryContext(ctx, query, after, encryptBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []Asset
+	for rows.Next() {
+		var a Asset
+		if err = rows.Scan(&a.Id, &a.UserId, &a.Path); err != nil {
+			return nil, err
+		}
+		batch = append(batch, a)
+	}
+	return batch, rows.Err()
+}
+
+// encryptAssets encrypts a batch of assets stored unencrypted and enqueues the batch after it until
+// none are left. An asset which can't be encrypted is logged and skipped, it stays readable as it is.
+func encryptAssets(ctx context.Context, j queue.Job, ar *AssetResources) error {
+	if ar.KMS == nil {
+		return errKeyUnavailable
+	}
+	var p rewrapJob
+	if err := j.Decode(&p); err != nil {
+		return err
+	}
+	if p.After == "" {
+		p.After = firstAssetId
+	}
+
+	batch, err := unencryptedAssets(ctx, ar.DTO, p.After)
+	if err != nil {
+		return err
+	}
+	for _, a := range batch {
+		if err = encryptAsset(ctx, ar, a); err != nil {
+			log.Println("Error encrypting asset, skipping it", a.Id, err.Error())
+		}
+	}
+
+	if len(batch) == encryptBatchSize {
+		_, err = queue.Enqueue(ctx, ar.DTO, queue.Entry{Kind: jobEncryptAssets, Payload: rewrapJob{After: batch[len(batch)-1].Id}})
+		return err
+	}
+	log.Println("Encrypted assets with", ar.KMS.KeyId())
+	return nil
+}
+
+// encryptAsset stores an encrypted copy of the object under a new s3 key, switches the asset over
+// and removes the plain object along with its cached variants, they are regenerated encrypted.
+func encryptAsset(ctx context.Context, ar *AssetResources, a Asset) error {
+	dataKey, keyId, wrapped, err := newDataKey(ctx, ar, a.UserId)
+	if err != nil {
+		return err
+	}
+	s3Key, err := objectKey(a.UserId)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(a.Path, quarantinePrefix) {
+		s3Key = quarantinePrefix + s3Key
+	}
+
+	body, err := awss3.GetFromS3(a.Path, ar.Session)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	sealed := encryptFile(body, dataKey)
+	defer sealed.Close()
+	stored := &countingReader{r: sealed}
+	if _, err = awss3.SaveToS3(s3Key, stored, ar.Session); err != nil {
+		return err
+	}
+
+	// The asset may have been quarantined or purged in the meantime, the copy is dropped then.
+	var query = `UPDATE assets set key_id = $1, data_key = $2, s3_path = $3, stored_bytes = $4 where id = $5 and key_id IS NULL and s3_path = $6`
+	res, err := ar.DTO.ExecContext(ctx, query, *keyId, wrapped, s3Key, stored.n, a.Id, a.Path)
+	if err != nil {
+		return err
+	}
+	old := a.Path
+	if n, _ := res.RowsAffected(); n == 0 {
+		old = s3Key
+	}
+	if err = awss3.DeleteFromS3(old, ar.Session); err != nil {
+		return err
+	}
+	return awss3.DeletePrefixFromS3("variants/"+a.Id+"/", ar.Session)
+}
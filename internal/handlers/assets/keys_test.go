@@ -0,0 +1,158 @@
+package assets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"github.com/hitesh-goel/ekanek/internal/pkg/envelope"
+	"github.com/hitesh-goel/ekanek/internal/queue"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestKMS returns a local KMS with a key per version, the last one is active.
+func newTestKMS(t *testing.T, versions ...string) *envelope.LocalKMS {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	var lines []string
+	for _, v := range versions {
+		// Keys are derived from the version so every KMS agrees on them.
+		master := []byte(fmt.Sprintf("%-32s", v))
+		lines = append(lines, v+" "+base64.StdEncoding.EncodeToString(master))
+	}
+	path := filepath.Join(dir, "master.key")
+	if err = ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kms, err := envelope.NewLocalKMS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kms
+}
+
+func job(t *testing.T, payload interface{}) queue.Job {
+	t.Helper()
+	b, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue.Job{Payload: b}
+}
+
+func TestRewrapKeysPagesAndSkipsBrokenKeys(t *testing.T) {
+	db := dbtest.New(t)
+	ctx := context.Background()
+	old := newTestKMS(t, "v1")
+	ar := &AssetResources{DTO: db, KMS: newTestKMS(t, "v1", "v2")}
+	uid := dbtest.User(t, db, "rewrap@example.com")
+
+	for i := 0; i <= rewrapBatchSize; i++ {
+		id, _, err := reserveAsset(ctx, ar, CreateAsset{UserId: uid, Name: fmt.Sprintf("%d.png", i), Path: fmt.Sprintf("%s/%d", uid, i), OriginalBytes: 1}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := envelope.NewDataKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyId, wrapped, err := old.WrapKey(ctx, uid, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.Exec(`UPDATE assets set key_id = $1, data_key = $2 where id = $3`, keyId, wrapped, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first asset of the first batch can't be unwrapped.
+	var broken string
+	if err := db.QueryRow(`select min(id::text) from assets where uid = $1`, uid).Scan(&broken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE assets set data_key = $1 where id = $2`, []byte("garbage"), broken); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rewrapKeys(ctx, job(t, rewrapJob{}), ar); err != nil {
+		t.Fatal(err)
+	}
+	var next queue.Job
+	if err := db.QueryRow(`select payload from jobs where kind = $1`, jobRewrapKeys).Scan(&next.Payload); err != nil {
+		t.Fatalf("the next batch wasn't queued: %v", err)
+	}
+	if err := rewrapKeys(ctx, next, ar); err != nil {
+		t.Fatal(err)
+	}
+	var queued int
+	if err := db.QueryRow(`select COUNT(*) from jobs where kind = $1`, jobRewrapKeys).Scan(&queued); err != nil || queued != 1 {
+		t.Fatalf("%d batches queued, err = %v, want 1", queued, err)
+	}
+
+	usage, err := KeyReport(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(usage), fmt.Sprintf("[{local:v1 1 0} {local:v2 %d 0}]", rewrapBatchSize); got != want {
+		t.Fatalf("key usage %s, want %s", got, want)
+	}
+	var keyId string
+	if err = db.QueryRow(`select key_id from assets where id = $1`, broken).Scan(&keyId); err != nil || keyId != "local:v1" {
+		t.Fatalf("the broken key is wrapped with %q, err = %v, want local:v1", keyId, err)
+	}
+}
+
+func TestUnencryptedAssets(t *testing.T) {
+	db := dbtest.New(t)
+	ctx := context.Background()
+	ar := &AssetResources{DTO: db}
+	uid := dbtest.User(t, db, "encrypt@example.com")
+
+	if err := encryptAssets(ctx, job(t, rewrapJob{}), ar); err != errKeyUnavailable {
+		t.Fatalf("err = %v without a key, want %v", err, errKeyUnavailable)
+	}
+
+	plain := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		id, _, err := reserveAsset(ctx, ar, CreateAsset{UserId: uid, Name: fmt.Sprintf("%d.png", i), Path: fmt.Sprintf("%s/%d", uid, i), OriginalBytes: 1}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain[id] = true
+	}
+	encrypted, _, err := reserveAsset(ctx, ar, CreateAsset{UserId: uid, Name: "encrypted.png", Path: uid + "/encrypted", OriginalBytes: 1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(`UPDATE assets set key_id = 'local:v1', data_key = 'key' where id = $1`, encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	batch, err := unencryptedAssets(ctx, db, firstAssetId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != len(plain) {
+		t.Fatalf("%d assets to encrypt, want %d", len(batch), len(plain))
+	}
+	for _, a := range batch {
+		if !plain[a.Id] || a.UserId != uid || a.Path == "" {
+			t.Fatalf("selected %+v", a)
+		}
+	}
+	rest, err := unencryptedAssets(ctx, db, batch[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != len(plain)-1 || rest[0].Id != batch[1].Id {
+		t.Fatalf("%d assets after %s, want the batch after it", len(rest), batch[0].Id)
+	}
+}
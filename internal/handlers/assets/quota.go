@@ -0,0 +1,116 @@
+package assets
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+)
+
+var (
+	errFileTooLarge   = errors.New("file is larger than your storage quota")
+	errQuotaExceeded  = errors.New("storage quota exceeded")
+	errAssetDuplicate = errors.New("an asset with this name already exists")
+)
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// reserveAsset inserts the asset record while holding a lock on the user row, so concurrent
+// uploads cannot exceed the quota between the check and the insert. The record reserves the most
+// the upload may store, asset.OriginalBytes when the size is known up front and maxBytes capped to
+// the available quota otherwise, other uploads count the reservation as used until finishUpload
+// records the actual size. It returns the asset id and the bytes reserved, which is the most the
+// upload may stream.
+func reserveAsset(ctx context.Context, ar *AssetResources, asset CreateAsset, maxBytes int64) (string, int64, error) {
+	tx, err := ar.DTO.BeginTx(ctx, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	defer tx.Rollback()
+
+	var quota int64
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE(quota_bytes, $2) FROM users WHERE uid = $1 FOR UPDATE`,
+		asset.UserId, ar.DefaultQuota).Scan(&quota)
+	if err != nil {
+		return "", 0, err
+	}
+
+	reserved := maxBytes
+	if asset.OriginalBytes > 0 {
+		reserved = asset.OriginalBytes
+	}
+	if quota > 0 {
+		if asset.OriginalBytes > quota {
+			return "", 0, errFileTooLarge
+		}
+		var used int64
+		err = tx.QueryRowContext(ctx, `SELECT COALESCE(SUM(original_bytes), 0) FROM assets WHERE uid = $1 AND is_active = true`,
+			asset.UserId).Scan(&used)
+		if err != nil {
+			return "", 0, err
+		}
+		available := quota - used
+		if available <= 0 || asset.OriginalBytes > available {
+			return "", 0, errQuotaExceeded
+		}
+		if reserved > available {
+			reserved = available
+		}
+	}
+
+	var query = `
+		WITH uuid AS (
+			SELECT * FROM uuid_generate_v1mc()
+		)
+		INSERT INTO assets (
+			id,
+            uid,
+            name,
+            s3_path,
+            title,
+            description,
+            metadata,
+            content_type,
+            original_bytes,
+            folder,
+            status,
+            key_id,
+            data_key
+        ) VALUES (
+			(SELECT * FROM uuid),
+            $1,
+            $2,
+            $3,
+            $4,
+            $5,
+            $6,
+            $7,
+            $8,
+            $9,
+            $10,
+            $11,
+            $12
+        ) ON CONFLICT (uid, name) DO NOTHING
+        RETURNING id`
+	fileId := ""
+	err = tx.QueryRowContext(ctx, query, asset.UserId, asset.Name, asset.Path, asset.Title, asset.Description,
+		asset.Metadata, asset.ContentType, reserved, asset.Folder, statusUploading, asset.KeyId, asset.DataKey).Scan(&fileId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", 0, errAssetDuplicate
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	return fileId, reserved, tx.Commit()
+}
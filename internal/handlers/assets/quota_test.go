@@ -0,0 +1,93 @@
+package assets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"sync"
+	"testing"
+)
+
+func TestReserveAssetConcurrentUploads(t *testing.T) {
+	db := dbtest.New(t)
+	ar := &AssetResources{DTO: db, DefaultQuota: 100}
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		maxBytes int64
+		// want is the number of uploads which get a reservation.
+		want int
+	}{
+		{name: "unknown size", maxBytes: 1000, want: 1},
+		{name: "content length", maxBytes: 30, want: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uid := dbtest.User(t, db, tt.name+"@example.com")
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			var reservedTotal int64
+			reservations := 0
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					asset := CreateAsset{UserId: uid, Name: fmt.Sprintf("photo-%d.png", i), Path: fmt.Sprintf("%s/%d", uid, i)}
+					_, reserved, err := reserveAsset(ctx, ar, asset, tt.maxBytes)
+					if err != nil && !errors.Is(err, errQuotaExceeded) {
+						t.Error(err)
+						return
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					if err == nil {
+						reservations++
+						reservedTotal += reserved
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			if reservations != tt.want || reservedTotal > ar.DefaultQuota {
+				t.Fatalf("%d uploads reserved %d bytes, want %d uploads within the quota of %d",
+					reservations, reservedTotal, tt.want, ar.DefaultQuota)
+			}
+			var used int64
+			err := db.QueryRow(`select SUM(original_bytes) from assets where uid = $1`, uid).Scan(&used)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if used != reservedTotal {
+				t.Fatalf("assets hold %d bytes, want the %d reserved", used, reservedTotal)
+			}
+		})
+	}
+}
+
+func TestReserveAssetKnownSize(t *testing.T) {
+	db := dbtest.New(t)
+	ar := &AssetResources{DTO: db, DefaultQuota: 100}
+	ctx := context.Background()
+	uid := dbtest.User(t, db, "sized@example.com")
+
+	asset := CreateAsset{UserId: uid, Name: "a.png", Path: uid + "/a", OriginalBytes: 101}
+	if _, _, err := reserveAsset(ctx, ar, asset, 1000); !errors.Is(err, errFileTooLarge) {
+		t.Fatalf("err = %v, want %v", err, errFileTooLarge)
+	}
+	asset.OriginalBytes = 60
+	if _, reserved, err := reserveAsset(ctx, ar, asset, 1000); err != nil || reserved != 60 {
+		t.Fatalf("reserved %d, err = %v, want 60", reserved, err)
+	}
+	asset.Name, asset.Path = "b.png", uid+"/b"
+	if _, _, err := reserveAsset(ctx, ar, asset, 1000); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("err = %v, want %v", err, errQuotaExceeded)
+	}
+	asset.Name = "a.png"
+	asset.OriginalBytes = 10
+	if _, _, err := reserveAsset(ctx, ar, asset, 1000); !errors.Is(err, errAssetDuplicate) {
+		t.Fatalf("err = %v, want %v", err, errAssetDuplicate)
+	}
+}
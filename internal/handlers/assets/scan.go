@@ -0,0 +1,144 @@
+package assets
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	awss3 "github.com/hitesh-goel/ekanek/internal/pkg/aws"
+	"github.com/hitesh-goel/ekanek/internal/pkg/scan"
+	"github.com/hitesh-goel/ekanek/internal/queue"
+	"log"
+)
+
+const (
+	jobScanAsset = "asset.scan"
+
+	scanPending  = "pending"
+	scanClean    = "clean"
+	scanInfected = "infected"
+
+	quarantinePrefix = "quarantine/"
+)
+
+var (
+	errQuarantined = errors.New("asset is quarantined")
+	errScanPending = errors.New("asset is waiting for the malware scan")
+)
+
+// servable reports whether an asset with the given scan status may be served.
+// Infected assets are never served, pending ones only to their owner.
+func servable(status string, owner bool) error {
+	switch status {
+	case scanClean:
+		return nil
+	case scanPending:
+		if owner {
+			return nil
+		}
+		return errScanPending
+	default:
+		return errQuarantined
+	}
+}
+
+// scanAsset runs the configured scanner over the original content. Infected
+// objects are moved under the quarantine prefix and the asset is made private.
+func scanAsset(ctx context.Context, j queue.Job, ar *AssetResources) error {
+	var p assetJob
+	if err := j.Decode(&p); err != nil {
+		return err
+	}
+
+	var a Asset
+	var query = `select s3_path, scan_status, uid, key_id, data_key from assets where id = $1`
+	err := ar.DTO.QueryRowContext(ctx, query, p.AssetId).Scan(&a.Path, &a.ScanStatus, &a.UserId, &a.KeyId, &a.DataKey)
+	if errors.Is(err, sql.ErrNoRows) || a.ScanStatus == scanInfected {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Without a scanner configured there is nothing to download the content for.
+	var res scan.Result
+	if _, ok := ar.Scanner.(scan.Nop); !ok {
+		src, err := openOriginal(ctx, ar, a)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		if res, err = ar.Scanner.Scan(ctx, src); err != nil {
+			return err
+		}
+	}
+
+	if !res.Infected {
+		return recordClean(ctx, ar, p.AssetId)
+	}
+
+	log.Println("Asset infected, moving to quarantine: ", p.AssetId, res.Signature)
+	dst := quarantinePrefix + a.Path
+	if err = awss3.MoveInS3(a.Path, dst, ar.Session); err != nil {
+		return err
+	}
+	if err = awss3.DeletePrefixFromS3("variants/"+p.AssetId+"/", ar.Session); err != nil {
+		return err
+	}
+
+	query = `UPDATE assets set scan_status = $1, scan_signature = $2, s3_path = $3, public = false, status = $4 where id = $5`
+	return recordScan(ctx, ar, a.UserId, p.AssetId, scanInfected, statusFailed, query, scanInfected, res.Signature, dst, statusFailed, p.AssetId)
+}
+
+// recordClean records a clean scan, the asset is ready when its checksum is recorded already.
+func recordClean(ctx context.Context, ar *AssetResources, assetId string) error {
+	tx, err := ar.DTO.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	p, err := lockProcessed(ctx, tx, assetId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var query = `UPDATE assets set scan_status = $1, scan_signature = NULL where id = $2`
+	if _, err = tx.ExecContext(ctx, query, scanClean, assetId); err != nil {
+		return err
+	}
+	p.Scanned = true
+
+	status := p.Status
+	if p.ready() {
+		status = statusReady
+	}
+	if err = writeAssetEvent(ctx, tx, p.UserId, eventAssetScanned, assetEvent{AssetId: assetId, ScanStatus: scanClean, Status: status}); err != nil {
+		return err
+	}
+	if p.ready() {
+		if err = markReady(ctx, tx, p.UserId, assetId); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// recordScan applies the verdict of an infected scan and writes the scanned event.
+func recordScan(ctx context.Context, ar *AssetResources, uid string, assetId string, scanStatus string, status string, query string, args ...interface{}) error {
+	tx, err := ar.DTO.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+	if err = writeAssetEvent(ctx, tx, uid, eventAssetScanned, assetEvent{AssetId: assetId, ScanStatus: scanStatus, Status: status}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,113 @@
+package assets
+
+import (
+	"context"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"github.com/hitesh-goel/ekanek/internal/pkg/scan"
+	"testing"
+)
+
+func TestServable(t *testing.T) {
+	for _, tt := range []struct {
+		status string
+		owner  bool
+		want   error
+	}{
+		{status: scanClean, want: nil},
+		{status: scanPending, owner: true, want: nil},
+		{status: scanPending, want: errScanPending},
+		{status: scanInfected, owner: true, want: errQuarantined},
+	} {
+		if got := servable(tt.status, tt.owner); got != tt.want {
+			t.Errorf("servable(%s, %v) = %v, want %v", tt.status, tt.owner, got, tt.want)
+		}
+	}
+}
+
+func TestScanAssetWithoutScanner(t *testing.T) {
+	db := dbtest.New(t)
+	// Without a session any s3 access fails, the Nop scanner must not need the content.
+	ar := &AssetResources{DTO: db, Scanner: scan.Nop{}}
+	ctx := context.Background()
+	uid := dbtest.User(t, db, "scan@example.com")
+	id := processingAsset(t, ar, uid, "a.png")
+
+	if err := scanAsset(ctx, job(t, assetJob{AssetId: id}), ar); err != nil {
+		t.Fatal(err)
+	}
+	if scanStatus, status := processingState(t, ar, id); scanStatus != scanClean || status != statusProcessing {
+		t.Fatalf("scan status %s, status %s before the checksum, want %s, %s", scanStatus, status, scanClean, statusProcessing)
+	}
+}
+
+func processingAsset(t *testing.T, ar *AssetResources, uid string, name string) string {
+	t.Helper()
+	id, _, err := reserveAsset(context.Background(), ar, CreateAsset{UserId: uid, Name: name, Path: uid + "/" + name, OriginalBytes: 1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ar.DTO.Exec(`UPDATE assets set status = $1 where id = $2`, statusProcessing, id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func processingState(t *testing.T, ar *AssetResources, id string) (string, string) {
+	t.Helper()
+	var scanStatus, status string
+	if err := ar.DTO.QueryRow(`select scan_status, status from assets where id = $1`, id).Scan(&scanStatus, &status); err != nil {
+		t.Fatal(err)
+	}
+	return scanStatus, status
+}
+
+// An asset is ready once both the scan and the checksum are recorded, whichever finishes last.
+func TestReadyAfterScanAndChecksum(t *testing.T) {
+	db := dbtest.New(t)
+	ar := &AssetResources{DTO: db, Scanner: scan.Nop{}}
+	ctx := context.Background()
+	uid := dbtest.User(t, db, "ready@example.com")
+
+	scanFirst := processingAsset(t, ar, uid, "scan-first.png")
+	if err := recordClean(ctx, ar, scanFirst); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordChecksum(ctx, ar, scanFirst, "sum", 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	hashFirst := processingAsset(t, ar, uid, "hash-first.png")
+	if err := recordChecksum(ctx, ar, hashFirst, "sum", 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, status := processingState(t, ar, hashFirst); status != statusProcessing {
+		t.Fatalf("status %s before the scan, want %s", status, statusProcessing)
+	}
+	if err := recordClean(ctx, ar, hashFirst); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{scanFirst, hashFirst} {
+		if _, status := processingState(t, ar, id); status != statusReady {
+			t.Fatalf("status %s, want %s", status, statusReady)
+		}
+		var events int
+		err := db.QueryRow(`select COUNT(*) from outbox where aggregate_id = $1 and type = $2`, id, eventAssetReady).Scan(&events)
+		if err != nil || events != 1 {
+			t.Fatalf("%d %s events, err = %v, want 1", events, eventAssetReady, err)
+		}
+	}
+
+	// A scan landing after the hash job gave up doesn't revive the asset.
+	failed := processingAsset(t, ar, uid, "failed.png")
+	if err := failAsset(ctx, ar, failed); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordChecksum(ctx, ar, failed, "sum", 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordClean(ctx, ar, failed); err != nil {
+		t.Fatal(err)
+	}
+	if _, status := processingState(t, ar, failed); status != statusFailed {
+		t.Fatalf("status %s, want %s", status, statusFailed)
+	}
+}
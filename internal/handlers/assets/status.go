@@ -0,0 +1,176 @@
+package assets
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	"github.com/hitesh-goel/ekanek/internal/queue"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Asset states, an asset is uploading until it is stored in s3, processing until the
+// malware scan and the checksum are done and then ready, or failed when it is infected or can't be processed.
+const (
+	statusUploading  = "uploading"
+	statusProcessing = "processing"
+	statusReady      = "ready"
+	statusFailed     = "failed"
+)
+
+type uploadResponse struct {
+	AssetId string `json:"asset_id"`
+	Status  string `json:"status"`
+}
+
+type AssetJob struct {
+	JobId     string    `json:"job_id" db:"id"`
+	Kind      string    `json:"kind" db:"kind"`
+	Status    string    `json:"status" db:"status"`
+	Attempts  int       `json:"attempts" db:"attempts"`
+	LastError *string   `json:"last_error,omitempty" db:"last_error"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+type AssetStatus struct {
+	AssetId       string     `json:"asset_id" db:"id"`
+	Status        string     `json:"status" db:"status"`
+	ScanStatus    string     `json:"scan_status" db:"scan_status"`
+	Checksum      *string    `json:"checksum" db:"checksum"`
+	OriginalBytes int64      `json:"original_bytes" db:"original_bytes"`
+	StoredBytes   int64      `json:"stored_bytes" db:"stored_bytes"`
+	UpdatedAt     time.Time  `json:"updated_at" db:"updated_at"`
+	Jobs          []AssetJob `json:"jobs"`
+}
+
+func HandleAssetStatus(ar *AssetResources) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/asset/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		assetStatus(w, r, ar)
+	}
+}
+
+// assetStatus reports the processing state of one of the caller's assets along with its jobs.
+func assetStatus(w http.ResponseWriter, r *http.Request, ar *AssetResources) {
+	ctx := r.Context()
+	assetId := r.URL.Query().Get("asset_id")
+	if assetId == "" {
+		response.RespondWithError(w, r, "pass valid asset_id in query param", http.StatusBadRequest)
+		return
+	}
+
+	uid, err := auth.GetUID(ctx)
+	if err != nil {
+		log.Println("Error accessing UserID: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	status := AssetStatus{Jobs: []AssetJob{}}
+	var query = `
+		select id, status, scan_status, checksum, original_bytes, stored_bytes, updated_at
+		from assets where id = $1 and uid = $2 and is_active = true`
+	err = ar.DTO.QueryRowContext(ctx, query, assetId, uid).Scan(&status.AssetId, &status.Status, &status.ScanStatus,
+		&status.Checksum, &status.OriginalBytes, &status.StoredBytes, &status.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, r, "asset not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Database error", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	query = `
+		select id, kind, status, attempts, last_error, updated_at
+		from jobs where payload ->> 'asset_id' = $1 and uid = $2
+		order by created_at`
+	rows, err := ar.DTO.QueryContext(ctx, query, assetId, uid)
+	if err != nil {
+		log.Println("Error selecting asset jobs", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var j AssetJob
+		if err = rows.Scan(&j.JobId, &j.Kind, &j.Status, &j.Attempts, &j.LastError, &j.UpdatedAt); err != nil {
+			log.Println("Error while scanning job rows: ", err.Error())
+			response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+			return
+		}
+		status.Jobs = append(status.Jobs, j)
+	}
+
+	response.RespondWithSuccess(w, r, "success", status, http.StatusOK)
+}
+
+// failProcessing marks the asset of a processing job failed.
+func failProcessing(ctx context.Context, ar *AssetResources, j queue.Job) error {
+	var p assetJob
+	if err := j.Decode(&p); err != nil {
+		return err
+	}
+	return failAsset(ctx, ar, p.AssetId)
+}
+
+// failAsset marks an asset which is still processing failed, assets which are done already are left alone.
+func failAsset(ctx context.Context, ar *AssetResources, assetId string) error {
+	tx, err := ar.DTO.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var uid string
+	var query = `UPDATE assets set status = $1 where id = $2 and status = $3 RETURNING uid`
+	err = tx.QueryRowContext(ctx, query, statusFailed, assetId, statusProcessing).Scan(&uid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = writeAssetEvent(ctx, tx, uid, eventAssetFailed, assetEvent{AssetId: assetId, Status: statusFailed}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// processed is the progress of an asset's processing jobs, read under the asset's row lock.
+type processed struct {
+	UserId  string
+	Status  string
+	Scanned bool
+	Hashed  bool
+}
+
+// ready reports whether the asset moves to ready, it is still processing and neither job is left.
+func (p processed) ready() bool {
+	return p.Status == statusProcessing && p.Scanned && p.Hashed
+}
+
+// lockProcessed locks an asset for recording the result of a processing job. The scan and hash jobs
+// run concurrently, the lock makes the one finishing last see the result of the other.
+func lockProcessed(ctx context.Context, tx *sql.Tx, assetId string) (processed, error) {
+	var p processed
+	var query = `select uid, status, scan_status = $2, checksum IS NOT NULL from assets where id = $1 FOR UPDATE`
+	err := tx.QueryRowContext(ctx, query, assetId, scanClean).Scan(&p.UserId, &p.Status, &p.Scanned, &p.Hashed)
+	return p, err
+}
+
+// markReady moves a processing asset to ready, failed assets are left alone.
+func markReady(ctx context.Context, tx *sql.Tx, uid string, assetId string) error {
+	var query = `UPDATE assets set status = $1 where id = $2 and status = $3`
+	if _, err := tx.ExecContext(ctx, query, statusReady, assetId, statusProcessing); err != nil {
+		return err
+	}
+	return writeAssetEvent(ctx, tx, uid, eventAssetReady, assetEvent{AssetId: assetId, Status: statusReady})
+}
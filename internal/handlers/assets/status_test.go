@@ -0,0 +1,74 @@
+package assets
+
+import (
+	"context"
+	"errors"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"github.com/hitesh-goel/ekanek/internal/queue"
+	"testing"
+)
+
+func TestProcessingJobFailsAssetAfterLastAttempt(t *testing.T) {
+	db := dbtest.New(t)
+	ar := &AssetResources{DTO: db}
+	ctx := context.Background()
+	uid := dbtest.User(t, db, "processing@example.com")
+
+	assetStatus := func(id string) string {
+		t.Helper()
+		var status string
+		if err := db.QueryRow(`select status from assets where id = $1`, id).Scan(&status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+	newAsset := func(name, status string) string {
+		t.Helper()
+		id, _, err := reserveAsset(ctx, ar, CreateAsset{UserId: uid, Name: name, Path: uid + "/" + name, OriginalBytes: 1}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.Exec(`UPDATE assets set status = $1 where id = $2`, status, id); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	broken := processingJob(ar, func(context.Context, queue.Job, *AssetResources) error {
+		return errors.New("unavailable")
+	})
+	processing := newAsset("processing.png", statusProcessing)
+	j := job(t, assetJob{AssetId: processing})
+	j.Attempts, j.MaxAttempts = 1, 3
+	if err := broken(ctx, j); err == nil {
+		t.Fatal("the job's error was swallowed")
+	}
+	if got := assetStatus(processing); got != statusProcessing {
+		t.Fatalf("status = %s with attempts left, want %s", got, statusProcessing)
+	}
+	j.Attempts = 3
+	_ = broken(ctx, j)
+	if got := assetStatus(processing); got != statusFailed {
+		t.Fatalf("status = %s after the last attempt, want %s", got, statusFailed)
+	}
+	var events int
+	err := db.QueryRow(`select COUNT(*) from outbox where aggregate_id = $1 and type = $2`, processing, eventAssetFailed).Scan(&events)
+	if err != nil || events != 1 {
+		t.Fatalf("%d %s events, err = %v, want 1", events, eventAssetFailed, err)
+	}
+
+	// Uploads which couldn't be finished are removed instead, assets which are done aren't failed.
+	uploading := newAsset("uploading.png", statusUploading)
+	ready := newAsset("ready.png", statusReady)
+	for _, id := range []string{uploading, ready} {
+		if err = failAsset(ctx, ar, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := assetStatus(uploading); got != statusUploading {
+		t.Fatalf("uploading asset status = %s, want %s", got, statusUploading)
+	}
+	if got := assetStatus(ready); got != statusReady {
+		t.Fatalf("ready asset status = %s, want %s", got, statusReady)
+	}
+}
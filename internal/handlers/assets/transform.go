@@ -0,0 +1,202 @@
+package assets
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	awss3 "github.com/hitesh-goel/ekanek/internal/pkg/aws"
+	"github.com/hitesh-goel/ekanek/internal/pkg/imaging"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// maxTransformSource is the largest original which is read into memory to be transformed.
+const maxTransformSource = 64 << 20
+
+type signedURL struct {
+	URL string `json:"url"`
+}
+
+func HandleAssetTransform(ar *AssetResources) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/asset/transform", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		transformAsset(w, r, ar)
+	}
+}
+
+func HandleSignTransform(ar *AssetResources) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/asset/transform/sign", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		signTransform(w, r, ar)
+	}
+}
+
+// signTransform returns a transform url for the given params, signed so that it
+// can be shared publicly without allowing arbitrary variants to be generated.
+func signTransform(w http.ResponseWriter, r *http.Request, ar *AssetResources) {
+	queryValues := r.URL.Query()
+	assetId := queryValues.Get("asset_id")
+	if assetId == "" {
+		response.RespondWithError(w, r, "pass valid asset_id in query param", http.StatusBadRequest)
+		return
+	}
+
+	opts, err := imaging.ParseOptions(queryValues)
+	if err != nil {
+		response.RespondWithError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	uid, err := auth.GetUID(r.Context())
+	if err != nil {
+		log.Println("Error accessing UserID: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	var owner string
+	var query = `select uid from assets where id = $1 and is_active = true`
+	err = ar.DTO.QueryRow(query, assetId).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && owner != uid) {
+		response.RespondWithError(w, r, "asset not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Database error", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	u := fmt.Sprintf("/api/v1/asset/transform?asset_id=%s&%s&sig=%s",
+		url.QueryEscape(assetId), opts.Canonical(), transformSignature(ar.TransformKey, assetId, opts))
+	response.RespondWithSuccess(w, r, "success", &signedURL{URL: u}, http.StatusOK)
+}
+
+func transformAsset(w http.ResponseWriter, r *http.Request, ar *AssetResources) {
+	queryValues := r.URL.Query()
+	assetId := queryValues.Get("asset_id")
+	if assetId == "" {
+		response.RespondWithError(w, r, "pass valid asset_id in query param", http.StatusBadRequest)
+		return
+	}
+
+	opts, err := imaging.ParseOptions(queryValues)
+	if err != nil {
+		response.RespondWithError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var asset Asset
+	var query = `select uid, public, s3_path, scan_status, key_id, data_key from assets where id = $1 and is_active = true`
+	err = ar.DTO.QueryRow(query, assetId).Scan(&asset.UserId, &asset.Public, &asset.Path, &asset.ScanStatus, &asset.KeyId, &asset.DataKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, r, "asset not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Database error", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Anonymous access needs a public asset and a signed url; the owner can request any variant.
+	signed := hmac.Equal([]byte(queryValues.Get("sig")), []byte(transformSignature(ar.TransformKey, assetId, opts)))
+	userId, err := ar.Auth.Verify(r, auth.ScopeAssetsRead)
+	owner := err == nil && userId == asset.UserId
+	if (!asset.Public || !signed) && !owner {
+		log.Println("user not authorised to transform asset")
+		response.RespondWithError(w, r, "you are not authenticated to transform this asset", http.StatusForbidden)
+		return
+	}
+
+	if err = servable(asset.ScanStatus, owner); err != nil {
+		response.RespondWithError(w, r, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Variants are encrypted with the data key of their asset.
+	dataKey, err := assetKey(r.Context(), ar, asset)
+	if err != nil {
+		log.Println("Error unwrapping asset key: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	key := variantKey(assetId, opts)
+	cached, err := awss3.GetFromS3(key, ar.Session)
+	if err == nil {
+		defer cached.Close()
+		var gr io.Reader
+		plain, err := decryptFile(cached, dataKey)
+		if err == nil {
+			gr, err = gzip.NewReader(plain)
+		}
+		if err == nil {
+			w.Header().Set("Content-Type", opts.ContentType())
+			_, _ = io.Copy(w, gr)
+			return
+		}
+		log.Println("Corrupt cached variant, regenerating: ", err.Error())
+	} else if !errors.Is(err, awss3.ErrNotFound) {
+		log.Println("Error reading cached variant: ", err.Error())
+	}
+
+	original, err := openOriginal(r.Context(), ar, asset)
+	if err != nil {
+		log.Println("S3 download Error: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong retrieving the file from S3", http.StatusBadRequest)
+		return
+	}
+	src, err := imaging.ReadSource(original, maxTransformSource)
+	original.Close()
+
+	var out bytes.Buffer
+	if err == nil {
+		err = imaging.Transform(bytes.NewReader(src), &out, opts)
+	}
+	if err != nil {
+		log.Println("Error transforming image: ", err.Error())
+		response.RespondWithError(w, r, "unable to transform asset", http.StatusUnprocessableEntity)
+		return
+	}
+
+	var variant io.Reader = compressFile(bytes.NewReader(out.Bytes()))
+	if dataKey != nil {
+		sealed := encryptFile(variant, dataKey)
+		defer sealed.Close()
+		variant = sealed
+	}
+	_, err = awss3.SaveToS3(key, variant, ar.Session)
+	if err != nil {
+		log.Println("Error caching variant to s3", err.Error())
+	}
+
+	w.Header().Set("Content-Type", opts.ContentType())
+	_, _ = w.Write(out.Bytes())
+}
+
+func transformSignature(key string, assetId string, opts imaging.Options) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	_, _ = mac.Write([]byte(assetId + "?" + opts.Canonical()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func variantKey(assetId string, opts imaging.Options) string {
+	sum := sha256.Sum256([]byte(opts.Canonical()))
+	return fmt.Sprintf("variants/%s/%x.gz", assetId, sum[:8])
+}
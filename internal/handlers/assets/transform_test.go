@@ -0,0 +1,34 @@
+package assets
+
+import (
+	"github.com/hitesh-goel/ekanek/internal/pkg/imaging"
+	"net/url"
+	"testing"
+)
+
+func TestTransformSignature(t *testing.T) {
+	parse := func(q string) imaging.Options {
+		v, _ := url.ParseQuery(q)
+		o, err := imaging.ParseOptions(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+	opts := parse("w=320&h=240&fit=cover")
+	sig := transformSignature("key", "asset", opts)
+
+	// The signature covers the normalized options, equivalent params sign the same.
+	if got := transformSignature("key", "asset", parse("fit=COVER&h=240&w=320&q=80")); got != sig {
+		t.Fatal("equivalent options signed differently")
+	}
+	for name, got := range map[string]string{
+		"key":     transformSignature("other", "asset", opts),
+		"asset":   transformSignature("key", "other", opts),
+		"options": transformSignature("key", "asset", parse("w=640&h=240&fit=cover")),
+	} {
+		if got == sig {
+			t.Errorf("changing the %s kept the signature", name)
+		}
+	}
+}
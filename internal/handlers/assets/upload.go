@@ -0,0 +1,387 @@
+package assets
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	awss3 "github.com/hitesh-goel/ekanek/internal/pkg/aws"
+	"github.com/hitesh-goel/ekanek/internal/pkg/exif"
+	"github.com/hitesh-goel/ekanek/internal/queue"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPlan = "default"
+
+	// metadataPeekSize covers the Exif APP1 segment (max 64KB) and the frame header that follows it.
+	metadataPeekSize = 128 << 10
+
+	// maxFormOverhead is the room left in the request body for the text fields and multipart boundaries.
+	maxFormOverhead = 1 << 20
+	maxFieldSize    = 64 << 10
+
+	// staleUploadAfter is how long an upload may take before it is considered abandoned.
+	staleUploadAfter = 24 * time.Hour
+	sweepInterval    = time.Hour
+	sweepBatchSize   = 100
+)
+
+var (
+	errNotImage       = errors.New("Not a valid Video Format File")
+	errEmptyFile      = errors.New("file is empty")
+	errUploadTooLarge = errors.New("file exceeds the upload limit of your plan")
+	errUploadFailed   = errors.New("failed to upload")
+	errLimitsInvalid  = errors.New("invalid upload limits")
+	errNotMultipart   = errors.New("pass a multipart/form-data body")
+	errNoFile         = errors.New("pass a file in the file form field")
+	errNoFileName     = errors.New("pass a file name for the file form field")
+	errMultipleFiles  = errors.New("only one file can be uploaded per request")
+)
+
+// upload is a single file to be stored as an asset.
+type upload struct {
+	UserId        string
+	Name          string
+	Title         string
+	Description   string
+	Folder        string
+	StripMetadata bool
+	Body          io.Reader
+	// SizeHint is the expected size when known up front, it lets quota violations fail before streaming.
+	SizeHint int64
+	// MaxSize is an upper bound of the size when known, e.g. the Content-Length of the request, it
+	// keeps the quota reserved for the upload from blocking other uploads of the user.
+	MaxSize int64
+	// Limit is the maximum size of the file.
+	Limit int64
+}
+
+// limitedReader fails with err once more than limit bytes have been read.
+type limitedReader struct {
+	r        io.Reader
+	limit    int64
+	read     int64
+	err      error
+	exceeded bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, l.err
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		l.exceeded = true
+		return n, l.err
+	}
+	return n, err
+}
+
+// ParseUploadLimits parses per plan upload limits in bytes, e.g. "default=104857600,pro=1073741824".
+// A limit for the default plan is required, it applies to users whose plan has no explicit limit.
+func ParseUploadLimits(s string) (map[string]int64, error) {
+	limits := make(map[string]int64)
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%v: %q", errLimitsInvalid, kv)
+		}
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("%v: %q", errLimitsInvalid, kv)
+		}
+		limits[parts[0]] = n
+	}
+	if limits[defaultPlan] == 0 {
+		return nil, fmt.Errorf("%v: missing %s plan", errLimitsInvalid, defaultPlan)
+	}
+	return limits, nil
+}
+
+// uploadLimit returns the maximum file size allowed by the user's plan.
+func uploadLimit(ctx context.Context, ar *AssetResources, uid string) (int64, error) {
+	var plan string
+	err := ar.DTO.QueryRowContext(ctx, `select plan from users where uid = $1`, uid).Scan(&plan)
+	if err != nil {
+		return 0, err
+	}
+	if limit, ok := ar.UploadLimits[plan]; ok {
+		return limit, nil
+	}
+	return ar.UploadLimits[defaultPlan], nil
+}
+
+// uploadStatus maps errors returned by storeAsset to http status codes.
+func uploadStatus(err error) int {
+	switch {
+	case errors.Is(err, errNotImage), errors.Is(err, errArchiveFormat):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, errEmptyFile), errors.Is(err, errNotMultipart), errors.Is(err, errNoFile),
+		errors.Is(err, errNoFileName), errors.Is(err, errMultipleFiles):
+		return http.StatusBadRequest
+	case errors.Is(err, errFileTooLarge), errors.Is(err, errUploadTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, errAssetDuplicate):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// streamForm reads a multipart body part by part straight from the connection, so the file is never
+// buffered in memory or on disk. onFile is called for the single "file" part with the text fields read
+// so far, fields sent after the file are only in the returned map.
+func streamForm(r *http.Request, limit int64, onFile func(part *multipart.Part, fields map[string]string) error) (map[string]string, error) {
+	if r.ContentLength > limit+maxFormOverhead {
+		return nil, errUploadTooLarge
+	}
+	body := &limitedReader{r: r.Body, limit: limit + maxFormOverhead, err: errUploadTooLarge}
+	r.Body = ioutil.NopCloser(body)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, errNotMultipart
+	}
+
+	fields := make(map[string]string)
+	seenFile := false
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		switch {
+		case err != nil:
+		case part.FormName() != "file":
+			var b []byte
+			b, err = ioutil.ReadAll(io.LimitReader(part, maxFieldSize))
+			fields[part.FormName()] = string(b)
+		case seenFile:
+			err = errMultipleFiles
+		case part.FileName() == "":
+			err = errNoFileName
+		default:
+			seenFile = true
+			err = onFile(part, fields)
+		}
+		if err != nil {
+			if body.exceeded {
+				err = errUploadTooLarge
+			}
+			return nil, err
+		}
+	}
+
+	if !seenFile {
+		return nil, errNoFile
+	}
+	return fields, nil
+}
+
+// storeAsset streams a single file to s3: the content type is sniffed and metadata parsed from
+// the head of the stream, the rest is compressed and encrypted on the fly, nothing is buffered to disk.
+func storeAsset(ctx context.Context, ar *AssetResources, u upload) (string, error) {
+	// Peek at the head of the file to detect the content type and parse metadata,
+	// the buffered reader is streamed afterwards so the peeked bytes are not lost.
+	br := bufio.NewReaderSize(u.Body, metadataPeekSize)
+	head, err := br.Peek(metadataPeekSize)
+	if len(head) == 0 {
+		if err == io.EOF {
+			return "", errEmptyFile
+		}
+		return "", err
+	}
+	contentType := http.DetectContentType(head)
+	if !strings.HasPrefix(contentType, "image") {
+		return "", errNotImage
+	}
+
+	var src io.Reader = br
+	meta := exif.Parse(head)
+	if u.StripMetadata {
+		src = exif.Strip(br)
+		meta = meta.Redacted()
+	}
+	metadata, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+
+	s3Key, err := objectKey(u.UserId)
+	if err != nil {
+		return "", err
+	}
+	dataKey, keyId, wrapped, err := newDataKey(ctx, ar, u.UserId)
+	if err != nil {
+		return "", err
+	}
+	asset := CreateAsset{
+		Title:         u.Title,
+		Description:   u.Description,
+		Folder:        u.Folder,
+		Name:          u.Name,
+		UserId:        u.UserId,
+		Path:          s3Key,
+		Metadata:      metadata,
+		ContentType:   contentType,
+		OriginalBytes: u.SizeHint,
+		KeyId:         keyId,
+		DataKey:       wrapped,
+	}
+
+	// The record is inserted before the upload to reserve quota, it is removed again if the upload fails.
+	maxBytes := u.Limit
+	if u.MaxSize > 0 && u.MaxSize < maxBytes {
+		maxBytes = u.MaxSize
+	}
+	fileId, reserved, err := reserveAsset(ctx, ar, asset, maxBytes)
+	if err != nil {
+		return "", err
+	}
+
+	limited := &limitedReader{r: src, limit: reserved, err: errUploadTooLarge}
+	if reserved < maxBytes && u.SizeHint == 0 {
+		limited.err = errQuotaExceeded
+	}
+	original := &countingReader{r: limited}
+	compressed := compressFile(original)
+	stored := &countingReader{r: compressed}
+	if dataKey != nil {
+		sealed := encryptFile(compressed, dataKey)
+		defer sealed.Close()
+		stored.r = sealed
+	}
+	_, err = awss3.SaveToS3(s3Key, stored, ar.Session)
+	if err != nil {
+		_ = compressed.CloseWithError(err)
+		if limited.exceeded {
+			err = limited.err
+		} else {
+			err = fmt.Errorf("%v: %w", errUploadFailed, err)
+		}
+		// Release the quota reserved for this upload.
+		if _, derr := ar.DTO.ExecContext(ctx, `DELETE FROM assets where id = $1`, fileId); derr != nil {
+			log.Println("Error removing failed upload record", derr.Error())
+		}
+		return "", err
+	}
+
+	// Without its jobs the asset would never be processed, it is removed instead. When that fails
+	// too it is left uploading, for SweepUploads to remove later.
+	if err = finishUpload(ctx, ar, u, fileId, contentType, original.n, stored.n); err != nil {
+		if derr := discardUpload(ctx, ar, fileId, s3Key); derr != nil {
+			log.Println("Error removing unfinished upload", fileId, derr.Error())
+		}
+		return "", fmt.Errorf("%v: %w", errUploadFailed, err)
+	}
+	return fileId, nil
+}
+
+// discardUpload removes the object and the record of an upload which didn't finish, releasing the
+// quota reserved for it and its name.
+func discardUpload(ctx context.Context, ar *AssetResources, assetId string, s3Key string) error {
+	if err := awss3.DeleteFromS3(s3Key, ar.Session); err != nil {
+		return err
+	}
+	_, err := ar.DTO.ExecContext(ctx, `DELETE FROM assets where id = $1 and status = $2`, assetId, statusUploading)
+	return err
+}
+
+// SweepUploads removes the uploads left behind uploading, e.g. by a crash while storing them, until
+// ctx is cancelled.
+func SweepUploads(ctx context.Context, ar *AssetResources) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		if err := sweepUploads(ctx, ar, staleUploadAfter); err != nil && ctx.Err() == nil {
+			log.Println("Error sweeping stale uploads: ", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweepUploads discards the uploads which started more than age ago and are still uploading.
+func sweepUploads(ctx context.Context, ar *AssetResources, age time.Duration) error {
+	var query = `
+		select id, s3_path from assets
+		where status = $1 and created_at < NOW() - make_interval(secs => $2)
+		order by created_at limit $3`
+	for {
+		rows, err := ar.DTO.QueryContext(ctx, query, statusUploading, age.Seconds(), sweepBatchSize)
+		if err != nil {
+			return err
+		}
+		var ids, paths []string
+		for rows.Next() {
+			var id, path string
+			if err = rows.Scan(&id, &path); err != nil {
+				rows.Close()
+				return err
+			}
+			ids, paths = append(ids, id), append(paths, path)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for i, id := range ids {
+			if err = discardUpload(ctx, ar, id, paths[i]); err != nil {
+				return err
+			}
+		}
+		if len(ids) < sweepBatchSize {
+			return nil
+		}
+	}
+}
+
+// finishUpload moves the asset to processing, recording the sizes, the uploaded event and the
+// post-processing jobs in one transaction.
+func finishUpload(ctx context.Context, ar *AssetResources, u upload, fileId string, contentType string, original, stored int64) error {
+	tx, err := ar.DTO.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var query = `UPDATE assets set original_bytes = $1, stored_bytes = $2, status = $3 where id = $4`
+	if _, err = tx.ExecContext(ctx, query, original, stored, statusProcessing, fileId); err != nil {
+		return err
+	}
+
+	err = writeAssetEvent(ctx, tx, u.UserId, eventAssetUploaded, assetEvent{
+		AssetId:       fileId,
+		Name:          u.Name,
+		Folder:        &u.Folder,
+		ContentType:   contentType,
+		OriginalBytes: original,
+		Status:        statusProcessing,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, kind := range []string{jobScanAsset, jobHashAsset} {
+		_, err = queue.Enqueue(ctx, tx, queue.Entry{UserID: u.UserId, Kind: kind, Payload: assetJob{AssetId: fileId}})
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
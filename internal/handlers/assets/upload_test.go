@@ -0,0 +1,89 @@
+package assets
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeS3 answers object deletions and records the deleted keys.
+type fakeS3 struct {
+	mu      sync.Mutex
+	deleted []string
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *session.Session) {
+	t.Helper()
+	f := &fakeS3{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		f.mu.Lock()
+		f.deleted = append(f.deleted, r.URL.Path)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	s, err := session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("key", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(srv.URL),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, s
+}
+
+func TestSweepUploads(t *testing.T) {
+	db := dbtest.New(t)
+	s3, sess := newFakeS3(t)
+	ar := &AssetResources{DTO: db, Session: sess}
+	ctx := context.Background()
+	uid := dbtest.User(t, db, "sweep@example.com")
+
+	reserve := func(name string) string {
+		t.Helper()
+		id, _, err := reserveAsset(ctx, ar, CreateAsset{UserId: uid, Name: name, Path: uid + "/" + name}, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	stale, recent, processing := reserve("stale.png"), reserve("recent.png"), reserve("processing.png")
+	_, err := db.Exec(`UPDATE assets set created_at = NOW() - interval '2 days' where id IN ($1, $2)`, stale, processing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(`UPDATE assets set status = $1 where id = $2`, statusProcessing, processing); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = sweepUploads(ctx, ar, staleUploadAfter); err != nil {
+		t.Fatal(err)
+	}
+	var left int
+	if err = db.QueryRow(`select COUNT(*) from assets where id IN ($1, $2, $3)`, stale, recent, processing).Scan(&left); err != nil {
+		t.Fatal(err)
+	}
+	if left != 2 {
+		t.Fatalf("%d assets left, want the recent upload and the processing asset", left)
+	}
+	if len(s3.deleted) != 1 || s3.deleted[0] != "/ekanek/"+uid+"/stale.png" {
+		t.Fatalf("deleted objects %v, want the stale upload's", s3.deleted)
+	}
+
+	// The name is released for another upload.
+	if _, _, err = reserveAsset(ctx, ar, CreateAsset{UserId: uid, Name: "stale.png", Path: uid + "/again"}, 1000); err != nil {
+		t.Fatal(err)
+	}
+}
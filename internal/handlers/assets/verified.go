@@ -0,0 +1,32 @@
+package assets
+
+import (
+	"errors"
+	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	"log"
+	"net/http"
+)
+
+var (
+	errEmailUnverified = errors.New("verify your email address first")
+)
+
+// requireVerified responds with 403 and returns false when required is set and the user hasn't
+// verified their email address yet.
+func requireVerified(w http.ResponseWriter, r *http.Request, ar *AssetResources, uid string, required bool) bool {
+	if !required {
+		return true
+	}
+	var verified bool
+	err := ar.DTO.QueryRowContext(r.Context(), `select email_verified from users where uid = $1`, uid).Scan(&verified)
+	if err != nil {
+		log.Println("Error reading email verification", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return false
+	}
+	if !verified {
+		response.RespondWithError(w, r, errEmailUnverified.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,32 @@
+package assets
+
+import (
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireVerified(t *testing.T) {
+	db := dbtest.New(t)
+	ar := &AssetResources{DTO: db}
+	uid := dbtest.User(t, db, "unverified@example.com")
+
+	allowed := func(required bool) (bool, int) {
+		w := httptest.NewRecorder()
+		ok := requireVerified(w, httptest.NewRequest(http.MethodPost, "/", nil), ar, uid, required)
+		return ok, w.Code
+	}
+	if ok, _ := allowed(false); !ok {
+		t.Fatal("rejected while verification isn't required")
+	}
+	if ok, code := allowed(true); ok || code != http.StatusForbidden {
+		t.Fatalf("a new user was allowed = %v with status %d, want %d", ok, code, http.StatusForbidden)
+	}
+	if _, err := db.Exec(`UPDATE users set email_verified = true where uid = $1`, uid); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := allowed(true); !ok {
+		t.Fatal("rejected a verified user")
+	}
+}
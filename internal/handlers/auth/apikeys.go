@@ -0,0 +1,267 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	"github.com/lib/pq"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	apiKeyPrefix = "ek_"
+	// apiKeyTokenIdPrefix marks the claims of requests authenticated with an api key.
+	apiKeyTokenIdPrefix = "apikey:"
+	apiKeyDisplayLength = 10
+	maxAPIKeys          = 50
+	maxAPIKeyNameLength = 100
+	// lastUsedInterval limits how often last_used_at is written for a busy key.
+	lastUsedInterval = time.Minute
+)
+
+var (
+	errAPIKeyInvalid   = errors.New("invalid api key")
+	errAPIKeyExpired   = errors.New("api key has expired")
+	errAPIKeyForbidden = errors.New("not allowed with an api key, log in instead")
+)
+
+// APIKey is a long-lived credential for scripts and CI. Key is only returned when the key is created,
+// only its hash is stored.
+type APIKey struct {
+	Id         string     `json:"id" db:"id"`
+	Name       string     `json:"name" db:"name"`
+	Prefix     string     `json:"prefix" db:"prefix"`
+	Scopes     []string   `json:"scopes" db:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at" db:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at" db:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	Key        string     `json:"key,omitempty"`
+}
+
+// viaAPIKey reports whether the request was authenticated with an api key instead of a JWT.
+func (c JwtClaims) viaAPIKey() bool {
+	return strings.HasPrefix(c.Id, apiKeyTokenIdPrefix)
+}
+
+func (k *APIKey) validate() error {
+	k.Name = strings.TrimSpace(k.Name)
+	if k.Name == "" || len(k.Name) > maxAPIKeyNameLength {
+		return fmt.Errorf("%v: name must be 1 to %d characters", errAPIKeyInvalid, maxAPIKeyNameLength)
+	}
+	if k.ExpiresAt != nil && !k.ExpiresAt.After(time.Now()) {
+		return fmt.Errorf("%v: expires_at must be in the future", errAPIKeyInvalid)
+	}
+	if k.Scopes == nil {
+		k.Scopes = []string{}
+	}
+	if err := ValidateScopes(k.Scopes); err != nil {
+		return fmt.Errorf("%v: %w", errAPIKeyInvalid, err)
+	}
+	return nil
+}
+
+// verifyAPIKey looks the key up on every request, so a revoked key is rejected right away.
+func (a *Authenticator) verifyAPIKey(ctx context.Context, key string) (JwtClaims, error) {
+	var claims JwtClaims
+	var expiresAt, lastUsedAt sql.NullTime
+	var query = `
+		select k.id, k.uid, k.scopes, k.expires_at, k.last_used_at
+		from api_keys k join users u on u.uid = k.uid
+		where k.key_hash = $1 and k.revoked_at IS NULL and u.deleted_at IS NULL`
+	err := a.db.QueryRowContext(ctx, query, hashToken(key)).Scan(
+		&claims.Id, &claims.UserID, pq.Array(&claims.Scopes), &expiresAt, &lastUsedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return claims, errAPIKeyInvalid
+	}
+	if err != nil {
+		return claims, fmt.Errorf("%w: %v", errRevocationCheck, err)
+	}
+	if expiresAt.Valid {
+		if expiresAt.Time.Before(time.Now()) {
+			return claims, errAPIKeyExpired
+		}
+		claims.ExpiresAt = expiresAt.Time.Unix()
+	}
+
+	if !lastUsedAt.Valid || time.Since(lastUsedAt.Time) > lastUsedInterval {
+		if _, err = a.db.ExecContext(ctx, `UPDATE api_keys set last_used_at = NOW() where id = $1`, claims.Id); err != nil {
+			log.Println("Error updating api key last use", err.Error())
+		}
+	}
+	claims.Id = apiKeyTokenIdPrefix + claims.Id
+	return claims, nil
+}
+
+// HandleCreateAPIKey creates an api key, the key can't be retrieved again afterwards.
+func HandleCreateAPIKey(a *Authenticator) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/user/apikey/create", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		createAPIKey(w, r, a)
+	}
+}
+
+func HandleListAPIKeys(a *Authenticator) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/user/apikey/list", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		listAPIKeys(w, r, a)
+	}
+}
+
+func HandleRevokeAPIKey(a *Authenticator) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/user/apikey/revoke", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		revokeAPIKey(w, r, a)
+	}
+}
+
+// jwtClaims returns the claims of a request authenticated with a JWT, api keys can't manage credentials.
+func jwtClaims(w http.ResponseWriter, r *http.Request) (JwtClaims, bool) {
+	claims, err := getClaims(r.Context())
+	if err != nil {
+		log.Println("Error accessing claims: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return claims, false
+	}
+	if claims.viaAPIKey() {
+		response.RespondWithError(w, r, errAPIKeyForbidden.Error(), http.StatusForbidden)
+		return claims, false
+	}
+	return claims, true
+}
+
+func createAPIKey(w http.ResponseWriter, r *http.Request, a *Authenticator) {
+	ctx := r.Context()
+	var key APIKey
+	err := json.NewDecoder(r.Body).Decode(&key)
+	if err != nil {
+		log.Println("Error decoding json data", err.Error())
+		response.RespondWithError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = key.validate(); err != nil {
+		response.RespondWithError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	claims, ok := jwtClaims(w, r)
+	if !ok {
+		return
+	}
+	// A key can't grant more than the token it is created with.
+	if len(key.Scopes) == 0 {
+		key.Scopes = append(key.Scopes, claims.Scopes...)
+	}
+	if !claims.hasScopes(key.Scopes...) {
+		response.RespondWithError(w, r, fmt.Sprintf("%v: %v", errScopeMissing, key.Scopes), http.StatusForbidden)
+		return
+	}
+
+	var count int
+	var query = `select COUNT(*) from api_keys where uid = $1 and revoked_at IS NULL and (expires_at IS NULL or expires_at > NOW())`
+	err = a.db.QueryRowContext(ctx, query, claims.UserID).Scan(&count)
+	if err != nil {
+		log.Println("Error counting api keys", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	if count >= maxAPIKeys {
+		response.RespondWithError(w, r, fmt.Sprintf("at most %d api keys can be active", maxAPIKeys), http.StatusConflict)
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		log.Println("Error generating api key", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	key.Key = apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	key.Prefix = key.Key[:apiKeyDisplayLength]
+
+	query = `
+		INSERT INTO api_keys (uid, name, prefix, key_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at`
+	err = a.db.QueryRowContext(ctx, query, claims.UserID, key.Name, key.Prefix, hashToken(key.Key),
+		pq.Array(key.Scopes), key.ExpiresAt).Scan(&key.Id, &key.CreatedAt)
+	if err != nil {
+		log.Println("Error creating api key", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	response.RespondWithSuccess(w, r, "success", &key, http.StatusOK)
+}
+
+func listAPIKeys(w http.ResponseWriter, r *http.Request, a *Authenticator) {
+	claims, ok := jwtClaims(w, r)
+	if !ok {
+		return
+	}
+
+	var query = `
+		select id, name, prefix, scopes, expires_at, last_used_at, created_at
+		from api_keys where uid = $1 and revoked_at IS NULL order by created_at`
+	rows, err := a.db.QueryContext(r.Context(), query, claims.UserID)
+	if err != nil {
+		log.Println("Error selecting api keys", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var k APIKey
+		if err = rows.Scan(&k.Id, &k.Name, &k.Prefix, pq.Array(&k.Scopes), &k.ExpiresAt, &k.LastUsedAt, &k.CreatedAt); err != nil {
+			log.Println("Error while scanning api key rows: ", err.Error())
+			response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+			return
+		}
+		keys = append(keys, k)
+	}
+	response.RespondWithSuccess(w, r, "success", keys, http.StatusOK)
+}
+
+func revokeAPIKey(w http.ResponseWriter, r *http.Request, a *Authenticator) {
+	var key APIKey
+	err := json.NewDecoder(r.Body).Decode(&key)
+	if err != nil {
+		log.Println("Error decoding json data", err.Error())
+		response.RespondWithError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	claims, ok := jwtClaims(w, r)
+	if !ok {
+		return
+	}
+
+	var query = `UPDATE api_keys set revoked_at = NOW() where id = $1 and uid = $2 and revoked_at IS NULL RETURNING id`
+	err = a.db.QueryRowContext(r.Context(), query, key.Id, claims.UserID).Scan(&key.Id)
+	if errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, r, "api key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Error revoking api key", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	response.RespondWithSuccess(w, r, "success", "", http.StatusOK)
+}
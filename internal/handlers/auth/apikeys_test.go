@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"context"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"github.com/lib/pq"
+	"net/http"
+	"testing"
+)
+
+func TestRevokeAllRevokesAPIKeys(t *testing.T) {
+	db := dbtest.New(t)
+	a := newTestAuthenticator(t, db)
+	ctx := context.Background()
+	uid := dbtest.User(t, db, "keys@example.com")
+
+	key := apiKeyPrefix + "0123456789abcdef0123456789abcdef"
+	var query = `INSERT INTO api_keys (uid, name, prefix, key_hash, scopes) VALUES ($1, 'ci', $2, $3, $4)`
+	if _, err := db.Exec(query, uid, key[:len(apiKeyPrefix)+8], hashToken(key), pq.Array([]string{ScopeAssetsRead})); err != nil {
+		t.Fatal(err)
+	}
+	if code := authorized(a, key, ScopeAssetsRead); code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", code, http.StatusNoContent)
+	}
+	if code := authorized(a, key, ScopeAssetsWrite); code != http.StatusForbidden {
+		t.Fatalf("status = %d without assets:write, want %d", code, http.StatusForbidden)
+	}
+
+	if err := a.RevokeAll(ctx, uid); err != nil {
+		t.Fatal(err)
+	}
+	if code := authorized(a, key, ScopeAssetsRead); code != http.StatusUnauthorized {
+		t.Fatalf("status = %d after revoking all tokens, want %d", code, http.StatusUnauthorized)
+	}
+}
@@ -2,55 +2,120 @@ package auth
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"fmt"
 	"github.com/hitesh-goel/ekanek/internal/handlers/response"
 	"log"
 	"net/http"
-	"os"
 	"regexp"
 	"strings"
+	"time"
 )
 
 const (
 	ctxUIDkey     = "uid"
+	ctxClaimsKey  = "claims"
 	authHeaderKey = "Authorization"
 )
 
 var (
 	authHeaderValueRegex = regexp.MustCompile("[[:space:]]([[:alnum:]]|[[:punct:]])+")
+
+	errConfigInvalid = errors.New("invalid auth config")
 )
 
+// Config represents the configuration necessary for this pkg.
+type Config struct {
+	Keys *KeySet
+	// AccessTTL is the lifetime of access tokens, RefreshTTL of the refresh tokens they are renewed with.
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+	// CacheTTL is how long revocation checks are cached, a token revoked on another replica
+	// is accepted here for at most this long.
+	CacheTTL time.Duration
+}
+
+func (c Config) isValid() bool {
+	return c.Keys != nil && c.AccessTTL > 0 && c.RefreshTTL > 0 && c.CacheTTL >= 0
+}
+
+// Authenticator verifies the tokens of requests and keeps track of revoked tokens.
+type Authenticator struct {
+	c     Config
+	db    *sql.DB
+	cache *revocationCache
+}
+
+// New initializes an authenticator.
+func New(c Config, db *sql.DB) (*Authenticator, error) {
+	if !c.isValid() {
+		return nil, errConfigInvalid
+	}
+	return &Authenticator{c: c, db: db, cache: newRevocationCache(c.CacheTTL)}, nil
+}
+
 // Auth ...
-func Auth(p string, h func(http.ResponseWriter, *http.Request)) (string, func(http.ResponseWriter, *http.Request)) {
+func (a *Authenticator) Auth(p string, h func(http.ResponseWriter, *http.Request)) (string, func(http.ResponseWriter, *http.Request)) {
 	return p, func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		userId, err := Verify(r)
+		claims, err := a.verify(r)
+		if errors.Is(err, errRevocationCheck) {
+			log.Println("Auth Error", err.Error())
+			response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
 		if err != nil {
 			log.Println("Auth Error", err.Error())
 			response.RespondWithError(w, r, err.Error(), http.StatusUnauthorized)
 			return
 		}
-		r = r.WithContext(WithUID(ctx, userId))
+		ctx = context.WithValue(WithUID(ctx, claims.UserID), ctxClaimsKey, claims)
+		r = r.WithContext(ctx)
 		h(w, r)
 	}
 }
 
-func Verify(r *http.Request) (string, error) {
-	jwt, err := extractJWT(r)
+// Verify returns the user id of a request carrying a valid token granting the scopes, for handlers where
+// authentication is optional.
+func (a *Authenticator) Verify(r *http.Request, scopes ...string) (string, error) {
+	claims, err := a.verify(r)
 	if err != nil {
 		return "", err
 	}
+	if !claims.hasScopes(scopes...) {
+		return "", fmt.Errorf("%v: %v", errScopeMissing, scopes)
+	}
+	return claims.UserID, nil
+}
 
-	claims, err := VerifyJwt(jwt, os.Getenv("PRIVATE_KEY"))
+func (a *Authenticator) verify(r *http.Request) (JwtClaims, error) {
+	jwt, err := extractJWT(r)
 	if err != nil {
-		return "", err
+		return JwtClaims{}, err
+	}
+	if strings.HasPrefix(jwt, apiKeyPrefix) {
+		return a.verifyAPIKey(r.Context(), jwt)
+	}
+
+	claims, err := VerifyJwt(jwt, a.c.Keys)
+	if err != nil {
+		return claims, err
 	}
 
 	if claims.UserID == "" {
-		return "", errors.New("no valid user id found")
+		return claims, errors.New("no valid user id found")
 	}
 
-	return claims.UserID, nil
+	// Tokens issued before sessions carry no sid and were valid for years, they can't be revoked
+	// individually and aren't accepted anymore.
+	if claims.SessionID == "" || claims.Id == "" {
+		return claims, errTokenLegacy
+	}
+	if err = a.checkRevoked(r.Context(), claims); err != nil {
+		return claims, err
+	}
+	return claims, nil
 }
 
 func extractJWT(req *http.Request) (string, error) {
@@ -73,3 +138,12 @@ func GetUID(ctx context.Context) (string, error) {
 func WithUID(ctx context.Context, UID string) context.Context {
 	return context.WithValue(ctx, ctxUIDkey, UID)
 }
+
+// getClaims returns the claims of the token the request was authenticated with.
+func getClaims(ctx context.Context) (JwtClaims, error) {
+	claims, ok := ctx.Value(ctxClaimsKey).(JwtClaims)
+	if !ok {
+		return claims, errors.New("claims not found in context")
+	}
+	return claims, nil
+}
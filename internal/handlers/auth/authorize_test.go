@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAuthenticator(t *testing.T, db *sql.DB) *Authenticator {
+	t.Helper()
+	keys, err := NewKeySet("test-secret", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(Config{Keys: keys, AccessTTL: time.Minute, RefreshTTL: time.Hour}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// authorized returns the status the Auth middleware of a answers a request carrying token with.
+func authorized(a *Authenticator, token string, scopes ...string) int {
+	path, h := a.Require(scopes...)("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Header.Set(authHeaderKey, "Bearer "+token)
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w.Code
+}
+
+func TestVerifyRejectsTokensWithoutSession(t *testing.T) {
+	a := newTestAuthenticator(t, nil)
+
+	// Tokens before sessions had neither a sid nor a jti, later ones a jti only.
+	legacy, err := a.c.Keys.sign(JwtClaims{
+		StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()},
+		UserClaims:     UserClaims{UserID: "5b0e2ac4-4ad2-4c5f-b36a-7b1c0b5f6d1e"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noSession, err := GenerateJWT("5b0e2ac4-4ad2-4c5f-b36a-7b1c0b5f6d1e", "", nil, a.c.Keys, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, token := range map[string]string{"legacy": legacy, "without session": noSession} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(authHeaderKey, "Bearer "+token)
+		if _, err := a.verify(r); !errors.Is(err, errTokenLegacy) {
+			t.Errorf("%s: err = %v, want %v", name, err, errTokenLegacy)
+		}
+		if code := authorized(a, token); code != http.StatusUnauthorized {
+			t.Errorf("%s: status = %d, want %d", name, code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestVerifyAcceptsSessionTokensUntilRevoked(t *testing.T) {
+	db := dbtest.New(t)
+	a := newTestAuthenticator(t, db)
+	ctx := context.Background()
+	uid := dbtest.User(t, db, "session@example.com")
+
+	tokens, err := a.IssueTokens(ctx, uid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := authorized(a, tokens.Jwt); code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", code, http.StatusNoContent)
+	}
+
+	if err = a.RevokeAll(ctx, uid); err != nil {
+		t.Fatal(err)
+	}
+	if code := authorized(a, tokens.Jwt); code != http.StatusUnauthorized {
+		t.Fatalf("status = %d after revoking all tokens, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+// A failing revocation check is a server error, the token isn't rejected as revoked.
+func TestAuthFailsWhenRevocationCheckFails(t *testing.T) {
+	db, err := sql.Open("postgres", "postgres://localhost/ekanek?sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	a := newTestAuthenticator(t, db)
+
+	token, err := GenerateJWT("5b0e2ac4-4ad2-4c5f-b36a-7b1c0b5f6d1e", "8d7c0a5e-3c1f-4b7e-9a2d-6f1e0c4b3a2d", nil, a.c.Keys, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := apiKeyPrefix + "0123456789abcdef0123456789abcdef"
+	for name, token := range map[string]string{"jwt": token, "api key": key} {
+		path, h := a.Auth("/", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set(authHeaderKey, "Bearer "+token)
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "database") {
+			t.Errorf("%s: status = %d, body %q, want %d without the error", name, w.Code, w.Body.String(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// A session started right after logging out of all devices, within the same second, stays valid.
+func TestVerifyAcceptsSessionsStartedAfterRevokeAll(t *testing.T) {
+	db := dbtest.New(t)
+	a := newTestAuthenticator(t, db)
+	ctx := context.Background()
+	uid := dbtest.User(t, db, "again@example.com")
+
+	old, err := a.IssueTokens(ctx, uid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.RevokeAll(ctx, uid); err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := a.IssueTokens(ctx, uid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := authorized(a, old.Jwt); code != http.StatusUnauthorized {
+		t.Fatalf("status = %d with the revoked session, want %d", code, http.StatusUnauthorized)
+	}
+	if code := authorized(a, fresh.Jwt); code != http.StatusNoContent {
+		t.Fatalf("status = %d with the new session, want %d", code, http.StatusNoContent)
+	}
+}
@@ -1,9 +1,8 @@
 package auth
 
 import (
-	"bytes"
-	"encoding/base64"
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
@@ -19,21 +18,31 @@ type JwtClaims struct {
 
 type UserClaims struct {
 	UserID string `json:"uid,omitempty"`
+	// SessionID is the refresh token family the token was issued for.
+	SessionID string `json:"sid,omitempty"`
+	// Scopes are what the token may be used for, ScopeAll grants everything and none nothing.
+	Scopes []string `json:"scopes,omitempty"`
 }
 
-// GenerateJWT function
-func GenerateJWT(id string, privateKey string) (string, error) {
+// GenerateJWT returns an access token for the user valid for ttl, restricted to the scopes.
+func GenerateJWT(id string, sessionId string, scopes []string, keys *KeySet, ttl time.Duration) (string, error) {
+	jti, err := newTokenId()
+	if err != nil {
+		return "", err
+	}
 	clock := time.Now()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, JwtClaims{
+	tokenString, err := keys.sign(JwtClaims{
 		StandardClaims: jwt.StandardClaims{
+			Id:        jti,
 			IssuedAt:  clock.Unix(),
-			ExpiresAt: clock.Add(time.Hour * time.Duration(21600)).Unix(), // expiration after 3 Months
+			ExpiresAt: clock.Add(ttl).Unix(),
 		},
 		UserClaims: UserClaims{
-			UserID: id,
+			UserID:    id,
+			SessionID: sessionId,
+			Scopes:    scopes,
 		},
 	})
-	tokenString, err := token.SignedString([]byte(privateKey))
 	if err != nil {
 		log.Println("Error in JWT token generation", err)
 		return "", err
@@ -41,67 +50,38 @@ func GenerateJWT(id string, privateKey string) (string, error) {
 	return tokenString, nil
 }
 
-func VerifyJwt(jwtToken string, privateKey string) (JwtClaims, error) {
-	var jwtHeader = struct {
-		Type string `json:"typ"`
-		Alg  string `json:"alg"`
-	}{"", ""}
-
+// VerifyJwt checks the signature and expiry of a token with the key named by its kid.
+func VerifyJwt(jwtToken string, keys *KeySet) (JwtClaims, error) {
 	var claims JwtClaims
 
-	parts := strings.Split(jwtToken, ".")
-	numParts := len(parts)
+	numParts := len(strings.Split(jwtToken, "."))
 	if numParts != 3 {
 		return claims, errors.New(fmt.Sprintf("JWT token should have 3 base64-encoded parts, but got %d", numParts))
 	}
 
-	data, err := base64.RawStdEncoding.DecodeString(parts[0]) // parts[0] is base64 of jwt header
-	if err != nil {
-		return claims, errors.New(fmt.Sprint("Base64 decoding of JWT header failed: ", err.Error()))
-	}
-
-	if err := json.NewDecoder(bytes.NewBuffer(data)).Decode(&jwtHeader); err != nil {
-		return claims, errors.New(fmt.Sprint("JSON decoding of JWT header failed: ", err.Error()))
-	}
-
-	if jwtHeader.Type != "JWT" {
-		return claims, errors.New("JWT type is incorrect")
-	}
-
-	if jwtHeader.Alg == "RS256" {
-		return claims, errors.New(fmt.Sprint("JWT uses unsupported signature algorithm: ", jwtHeader.Alg))
+	_, err := jwt.ParseWithClaims(jwtToken, &claims, keys.keyFunc)
+	var verr *jwt.ValidationError
+	if errors.As(err, &verr) {
+		switch {
+		case verr.Errors&jwt.ValidationErrorExpired != 0:
+			return claims, errors.New(fmt.Sprint("JWT Expired at: ", time.Unix(claims.ExpiresAt, 0)))
+		case verr.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+			return claims, errors.New("BAD JWT Signature")
+		}
 	}
-
-	data, err = base64.RawStdEncoding.DecodeString(parts[1]) // parts[1] is base64 of jwt claims
 	if err != nil {
-		return claims, errors.New(fmt.Sprint("Base64 decoding of JWT claims failed: ", err.Error()))
+		return claims, errors.New(fmt.Sprint("Invalid JWT: ", err.Error()))
 	}
 
-	if err := json.NewDecoder(bytes.NewBuffer(data)).Decode(&claims); err != nil {
-		return claims, errors.New(fmt.Sprint("JSON decoding of JWT claims failed: ", err.Error()))
-	}
-
-	if claims.ExpiresAt < time.Now().Unix() {
-		return claims, errors.New(fmt.Sprint("JWT Expired at: ", time.Unix(claims.ExpiresAt, 0)))
-	}
-
-	_, err = jwt.Parse(jwtToken, func(token *jwt.Token) (interface{}, error) {
-		// Don't forget to validate the alg is what you expect:
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
-
-		return []byte(privateKey), nil
-	})
+	// Whether the token has been revoked is checked by the Authenticator.
+	return claims, nil
+}
 
-	if err != nil {
-		return claims, errors.New("BAD JWT Signature")
+// newTokenId returns a random jti, the id a single token is revoked by.
+func newTokenId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
-
-	// TODO: Verify User has an active session.
-	// 1. Store the User specific logout timestamp in redis
-	// 2. Check timestamp of issued jwt should be greater than the last logout time
-	// 3. If not that that jwt is not a valid jwt
-
-	return claims, nil
+	return hex.EncodeToString(b), nil
 }
@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+)
+
+const (
+	minRSABits = 2048
+)
+
+var (
+	errKeyInvalid       = errors.New("invalid jwt key")
+	errKeyUnknown       = errors.New("unknown jwt key id")
+	errMethodUnexpected = errors.New("unexpected jwt signing method")
+)
+
+// JWK is a public key in the JSON Web Key format of RFC 7517.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+type jwks struct {
+	Keys []JWK `json:"keys"`
+}
+
+type jwtKey struct {
+	jwk     JWK
+	method  jwt.SigningMethod
+	private interface{}
+	public  interface{}
+}
+
+// KeySet holds the key tokens are signed with and the keys they are verified with. Tokens
+// carry the kid of their key, so keys can be rotated by verifying with the old key until the
+// tokens it signed have expired.
+type KeySet struct {
+	signing *jwtKey
+	keys    map[string]*jwtKey
+	// hmac is the shared secret of HS256 tokens, used when no signing key is configured.
+	hmac []byte
+}
+
+// NewKeySet loads the signing key and the additional verification keys from PEM files, RSA keys
+// are used with RS256 and Ed25519 keys with EdDSA. Without a signing key tokens are signed with
+// HS256 and hmacSecret, HS256 tokens aren't accepted once a signing key is configured.
+func NewKeySet(hmacSecret string, signingFile string, verifyFiles []string) (*KeySet, error) {
+	k := &KeySet{keys: make(map[string]*jwtKey)}
+	if signingFile == "" {
+		if hmacSecret == "" {
+			return nil, fmt.Errorf("%v: no signing key", errKeyInvalid)
+		}
+		k.hmac = []byte(hmacSecret)
+	} else {
+		key, err := loadKey(signingFile)
+		if err != nil {
+			return nil, err
+		}
+		if key.private == nil {
+			return nil, fmt.Errorf("%v: %s is not a private key", errKeyInvalid, signingFile)
+		}
+		k.signing = key
+		k.keys[key.jwk.Kid] = key
+	}
+
+	for _, f := range verifyFiles {
+		key, err := loadKey(f)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := k.keys[key.jwk.Kid]; !ok {
+			k.keys[key.jwk.Kid] = key
+		}
+	}
+	return k, nil
+}
+
+// sign returns the signed token.
+func (k *KeySet) sign(claims jwt.Claims) (string, error) {
+	if k.signing == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(k.hmac)
+	}
+	token := jwt.NewWithClaims(k.signing.method, claims)
+	token.Header["kid"] = k.signing.jwk.Kid
+	return token.SignedString(k.signing.private)
+}
+
+// keyFunc selects the verification key by the kid of the token. The method of the token has to
+// match its key, so a public key can never be used as an HMAC secret.
+func (k *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	if token.Method == jwt.SigningMethodHS256 && k.hmac != nil {
+		return k.hmac, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%v: %q", errKeyUnknown, kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("%v: %v", errMethodUnexpected, token.Header["alg"])
+	}
+	return key.public, nil
+}
+
+// JWKS returns the public verification keys.
+func (k *KeySet) JWKS() []JWK {
+	keys := make([]JWK, 0, len(k.keys))
+	if k.signing != nil {
+		keys = append(keys, k.signing.jwk)
+	}
+	for _, key := range k.keys {
+		if key != k.signing {
+			keys = append(keys, key.jwk)
+		}
+	}
+	return keys
+}
+
+// HandleJWKS publishes the verification keys, so other services can verify tokens themselves.
+func HandleJWKS(a *Authenticator) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		b, err := json.Marshal(jwks{Keys: a.c.Keys.JWKS()})
+		if err != nil {
+			response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		_, _ = w.Write(b)
+	}
+}
+
+// loadKey reads a PEM encoded RSA or Ed25519 key, a public key can only verify tokens.
+func loadKey(path string) (*jwtKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%v: no PEM data in %s", errKeyInvalid, path)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%v: unsupported PEM type %q in %s", errKeyInvalid, block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s: %s", errKeyInvalid, path, err.Error())
+	}
+
+	key := &jwtKey{}
+	switch p := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.private, key.public = p, &p.PublicKey
+	case *rsa.PublicKey:
+		key.public = p
+	case ed25519.PrivateKey:
+		key.private, key.public = p, p.Public().(ed25519.PublicKey)
+	case ed25519.PublicKey:
+		key.public = p
+	default:
+		return nil, fmt.Errorf("%v: %s is neither an RSA nor an Ed25519 key", errKeyInvalid, path)
+	}
+
+	switch pub := key.public.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("%v: RSA keys need at least %d bits, %s", errKeyInvalid, minRSABits, path)
+		}
+		key.method = jwt.SigningMethodRS256
+		key.jwk = JWK{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}
+	case ed25519.PublicKey:
+		key.method = SigningMethodEdDSA
+		key.jwk = JWK{Kty: "OKP", Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(pub)}
+	}
+	key.jwk.Use = "sig"
+	key.jwk.Alg = key.method.Alg()
+	key.jwk.Kid = thumbprint(key.jwk)
+	return key, nil
+}
+
+// thumbprint returns the RFC 7638 thumbprint of the key, which is used as its kid.
+func thumbprint(k JWK) string {
+	var members string
+	if k.Kty == "RSA" {
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	} else {
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, k.Crv, k.Kty, k.X)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	"github.com/lib/pq"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	tokenType          = "Bearer"
+	refreshTokenPrefix = "ekr_"
+)
+
+var (
+	errRefreshInvalid = errors.New("invalid or expired refresh token")
+	errRefreshReused  = errors.New("refresh token was already used, the session has been revoked")
+)
+
+// Tokens are issued on signup and login and rotated on refresh. Jwt is the short-lived access
+// token, the refresh token can be exchanged for a new pair once.
+type Tokens struct {
+	Jwt          string `json:"jwt"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// querier is satisfied by *sql.DB and *sql.Tx.
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// IssueTokens starts a new session for the user, its tokens are restricted to the scopes. A session
+// without scopes is issued ScopeAll.
+func (a *Authenticator) IssueTokens(ctx context.Context, uid string, scopes []string) (Tokens, error) {
+	if len(scopes) == 0 {
+		scopes = []string{ScopeAll}
+	}
+	if _, err := a.db.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE uid = $1 AND expires_at < NOW()`, uid); err != nil {
+		log.Println("Error removing expired refresh tokens", err.Error())
+	}
+	return a.issue(ctx, a.db, uid, sql.NullString{}, scopes)
+}
+
+// issue stores a new refresh token in the family, a new family is started when family is null.
+func (a *Authenticator) issue(ctx context.Context, db querier, uid string, family sql.NullString, scopes []string) (Tokens, error) {
+	if scopes == nil {
+		scopes = []string{}
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return Tokens{}, err
+	}
+	refresh := refreshTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	var query = `
+		WITH uuid AS (
+			SELECT * FROM uuid_generate_v1mc()
+		)
+		INSERT INTO refresh_tokens (
+			id,
+            uid,
+            family_id,
+            token_hash,
+            expires_at,
+            scopes
+        ) VALUES (
+			(SELECT * FROM uuid),
+            $1,
+            COALESCE($2::uuid, (SELECT * FROM uuid)),
+            $3,
+            $4,
+            $5
+        ) RETURNING family_id`
+	var sessionId string
+	err := db.QueryRowContext(ctx, query, uid, family, hashToken(refresh), time.Now().Add(a.c.RefreshTTL), pq.Array(scopes)).Scan(&sessionId)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	access, err := GenerateJWT(uid, sessionId, scopes, a.c.Keys, a.c.AccessTTL)
+	if err != nil {
+		return Tokens{}, err
+	}
+	return Tokens{
+		Jwt:          access,
+		TokenType:    tokenType,
+		ExpiresIn:    int64(a.c.AccessTTL.Seconds()),
+		RefreshToken: refresh,
+	}, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// HandleRefresh exchanges a refresh token for a new access and refresh token.
+func HandleRefresh(a *Authenticator) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/user/refresh", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		refresh(w, r, a)
+	}
+}
+
+func refresh(w http.ResponseWriter, r *http.Request, a *Authenticator) {
+	var req refreshRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.RefreshToken == "" {
+		response.RespondWithError(w, r, "pass a valid refresh_token", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := a.rotate(r.Context(), req.RefreshToken)
+	if errors.Is(err, errRefreshInvalid) || errors.Is(err, errRefreshReused) {
+		log.Println("Refresh Error", err.Error())
+		response.RespondWithError(w, r, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Println("Error refreshing tokens", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	response.RespondWithSuccess(w, r, "success", tokens, http.StatusOK)
+}
+
+// rotate marks the refresh token used and issues its successor in the same family. Presenting a
+// used token means it was copied, so the whole family is revoked along with its access tokens.
+func (a *Authenticator) rotate(ctx context.Context, token string) (Tokens, error) {
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Tokens{}, err
+	}
+	defer tx.Rollback()
+
+	var id, uid, family string
+	var scopes []string
+	var expiresAt time.Time
+	var usedAt, revokedAt sql.NullTime
+	var query = `
+		select r.id, r.uid, r.family_id, r.scopes, r.expires_at, r.used_at, r.revoked_at
+		from refresh_tokens r join users u on u.uid = r.uid
+		where r.token_hash = $1 and u.deleted_at IS NULL FOR UPDATE OF r`
+	err = tx.QueryRowContext(ctx, query, hashToken(token)).Scan(&id, &uid, &family, pq.Array(&scopes), &expiresAt, &usedAt, &revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Tokens{}, errRefreshInvalid
+	}
+	if err != nil {
+		return Tokens{}, err
+	}
+	if revokedAt.Valid || expiresAt.Before(time.Now()) {
+		return Tokens{}, errRefreshInvalid
+	}
+	if usedAt.Valid {
+		log.Println("Refresh token reuse detected, revoking session", family)
+		query = `UPDATE refresh_tokens set revoked_at = NOW() where family_id = $1 and revoked_at IS NULL`
+		if _, err = tx.ExecContext(ctx, query, family); err != nil {
+			return Tokens{}, err
+		}
+		if err = tx.Commit(); err != nil {
+			return Tokens{}, err
+		}
+		return Tokens{}, errRefreshReused
+	}
+
+	if _, err = tx.ExecContext(ctx, `UPDATE refresh_tokens set used_at = NOW() where id = $1`, id); err != nil {
+		return Tokens{}, err
+	}
+	tokens, err := a.issue(ctx, tx, uid, sql.NullString{String: family, Valid: true}, scopes)
+	if err != nil {
+		return Tokens{}, err
+	}
+	return tokens, tx.Commit()
+}
@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	maxCacheEntries = 10000
+)
+
+var (
+	errTokenRevoked    = errors.New("token has been revoked")
+	errTokenLegacy     = errors.New("token was issued without a session, log in again")
+	errRevocationCheck = errors.New("unable to check token revocation")
+)
+
+type cacheEntry struct {
+	uid     string
+	revoked bool
+	at      time.Time
+}
+
+// revocationCache remembers recent revocation checks by token id, so an authenticated request
+// doesn't cost a query every time.
+type revocationCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func newRevocationCache(ttl time.Duration) *revocationCache {
+	return &revocationCache{ttl: ttl, entries: make(map[string]cacheEntry)}
+}
+
+func (c *revocationCache) get(tokenId string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[tokenId]
+	if !ok || time.Since(e.at) > c.ttl {
+		return e, false
+	}
+	return e, true
+}
+
+func (c *revocationCache) set(tokenId string, e cacheEntry) {
+	if c.ttl == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCacheEntries {
+		for id, old := range c.entries {
+			if time.Since(old.at) > c.ttl {
+				delete(c.entries, id)
+			}
+		}
+		if len(c.entries) >= maxCacheEntries {
+			c.entries = make(map[string]cacheEntry)
+		}
+	}
+	c.entries[tokenId] = e
+}
+
+// forgetUser drops the cached checks of all tokens of the user.
+func (c *revocationCache) forgetUser(uid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, e := range c.entries {
+		if e.uid == uid {
+			delete(c.entries, id)
+		}
+	}
+}
+
+// checkRevoked fails when the token or its session was logged out, was issued before the user
+// logged out of all devices, or the user is deleted or scheduled for deletion.
+func (a *Authenticator) checkRevoked(ctx context.Context, claims JwtClaims) error {
+	if e, ok := a.cache.get(claims.Id); ok {
+		if e.revoked {
+			return errTokenRevoked
+		}
+		return nil
+	}
+
+	var validAfter sql.NullTime
+	var denied, ended, deleted bool
+	var query = `
+		select u.tokens_valid_after,
+		       EXISTS(select 1 from revoked_tokens t where t.jti = $2),
+		       EXISTS(select 1 from refresh_tokens f where f.family_id = $3::uuid and f.revoked_at IS NOT NULL),
+		       u.deleted_at IS NOT NULL
+		from users u where u.uid = $1`
+	err := a.db.QueryRowContext(ctx, query, claims.UserID, claims.Id, claims.SessionID).Scan(&validAfter, &denied, &ended, &deleted)
+	revoked := errors.Is(err, sql.ErrNoRows)
+	if err != nil && !revoked {
+		return fmt.Errorf("%w: %v", errRevocationCheck, err)
+	}
+	// iat has a resolution of seconds, a token issued in the second of the logout is told apart by its
+	// session: sessions from before are revoked along with the logout, ones started after it, e.g. by a
+	// password change, are kept.
+	if denied || ended || deleted || (validAfter.Valid && claims.IssuedAt < validAfter.Time.Unix()) {
+		revoked = true
+	}
+
+	a.cache.set(claims.Id, cacheEntry{uid: claims.UserID, revoked: revoked, at: time.Now()})
+	if revoked {
+		return errTokenRevoked
+	}
+	return nil
+}
+
+// HandleLogout revokes the token the request is authenticated with and its session.
+func HandleLogout(a *Authenticator) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/user/logout", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		logout(w, r, a)
+	}
+}
+
+// HandleLogoutAll revokes every token of the user issued so far, logging out all devices.
+func HandleLogoutAll(a *Authenticator) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/user/logout/all", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		logoutAll(w, r, a)
+	}
+}
+
+func logout(w http.ResponseWriter, r *http.Request, a *Authenticator) {
+	ctx := r.Context()
+	claims, ok := jwtClaims(w, r)
+	if !ok {
+		return
+	}
+
+	// The denylist entry is only needed until the token expires anyway.
+	var query = `
+		INSERT INTO revoked_tokens (jti, uid, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (jti) DO NOTHING`
+	_, err := a.db.ExecContext(ctx, query, claims.Id, claims.UserID, time.Unix(claims.ExpiresAt, 0))
+	if err != nil {
+		log.Println("Error revoking token", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	if claims.SessionID != "" {
+		query = `UPDATE refresh_tokens set revoked_at = NOW() where family_id = $1 and revoked_at IS NULL`
+		if _, err = a.db.ExecContext(ctx, query, claims.SessionID); err != nil {
+			log.Println("Error revoking session", err.Error())
+			response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+			return
+		}
+	}
+	a.cache.set(claims.Id, cacheEntry{uid: claims.UserID, revoked: true, at: time.Now()})
+
+	if _, err = a.db.ExecContext(ctx, `DELETE FROM revoked_tokens WHERE expires_at < NOW()`); err != nil {
+		log.Println("Error removing expired revoked tokens", err.Error())
+	}
+
+	response.RespondWithSuccess(w, r, "logged out", nil, http.StatusOK)
+}
+
+func logoutAll(w http.ResponseWriter, r *http.Request, a *Authenticator) {
+	claims, ok := jwtClaims(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.RevokeAll(r.Context(), claims.UserID); err != nil {
+		log.Println("Error revoking tokens", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	response.RespondWithSuccess(w, r, "logged out of all devices", nil, http.StatusOK)
+}
+
+// RevokeAll revokes every access token, refresh token and API key of the user issued so far.
+func (a *Authenticator) RevokeAll(ctx context.Context, uid string) error {
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = RevokeAllTx(ctx, tx, uid); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	a.ForgetUser(uid)
+	return nil
+}
+
+// RevokeAllTx revokes the tokens like RevokeAll in the transaction of another change, e.g. a deletion. Once
+// it is committed ForgetUser applies it to the cached checks right away.
+func RevokeAllTx(ctx context.Context, tx *sql.Tx, uid string) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE users set tokens_valid_after = NOW() where uid = $1`, uid); err != nil {
+		return err
+	}
+	var query = `UPDATE refresh_tokens set revoked_at = NOW() where uid = $1 and revoked_at IS NULL`
+	if _, err := tx.ExecContext(ctx, query, uid); err != nil {
+		return err
+	}
+	query = `UPDATE api_keys set revoked_at = NOW() where uid = $1 and revoked_at IS NULL`
+	_, err := tx.ExecContext(ctx, query, uid)
+	return err
+}
+
+// ForgetUser drops the cached revocation checks of the user's tokens.
+func (a *Authenticator) ForgetUser(uid string) {
+	a.cache.forgetUser(uid)
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	"net/http"
+)
+
+const (
+	// ScopeAll grants every scope, it is what sessions without requested scopes are issued with.
+	ScopeAll           = "*"
+	ScopeAccountRead   = "account:read"
+	ScopeAccountWrite  = "account:write"
+	ScopeAssetsRead    = "assets:read"
+	ScopeAssetsWrite   = "assets:write"
+	ScopeWebhooksRead  = "webhooks:read"
+	ScopeWebhooksWrite = "webhooks:write"
+)
+
+var (
+	errScopeUnknown = errors.New("unknown scope")
+	errScopeMissing = errors.New("token is missing a required scope")
+
+	knownScopes = map[string]bool{
+		ScopeAll:           true,
+		ScopeAccountRead:   true,
+		ScopeAccountWrite:  true,
+		ScopeAssetsRead:    true,
+		ScopeAssetsWrite:   true,
+		ScopeWebhooksRead:  true,
+		ScopeWebhooksWrite: true,
+	}
+)
+
+// ValidateScopes fails for scopes tokens can't be restricted to.
+func ValidateScopes(scopes []string) error {
+	for _, s := range scopes {
+		if !knownScopes[s] {
+			return fmt.Errorf("%v: %q", errScopeUnknown, s)
+		}
+	}
+	return nil
+}
+
+// hasScopes reports whether the claims grant all of the scopes, tokens without scopes grant none.
+func (c JwtClaims) hasScopes(scopes ...string) bool {
+	granted := make(map[string]bool, len(c.Scopes))
+	for _, s := range c.Scopes {
+		granted[s] = true
+	}
+	for _, s := range scopes {
+		if !granted[s] && !granted[ScopeAll] {
+			return false
+		}
+	}
+	return true
+}
+
+// Require authenticates the request like Auth and additionally requires the token to grant the scopes.
+func (a *Authenticator) Require(scopes ...string) func(string, func(http.ResponseWriter, *http.Request)) (string, func(http.ResponseWriter, *http.Request)) {
+	return func(p string, h func(http.ResponseWriter, *http.Request)) (string, func(http.ResponseWriter, *http.Request)) {
+		return a.Auth(p, func(w http.ResponseWriter, r *http.Request) {
+			claims, err := getClaims(r.Context())
+			if err != nil || !claims.hasScopes(scopes...) {
+				response.RespondWithError(w, r, fmt.Sprintf("%v: %v", errScopeMissing, scopes), http.StatusForbidden)
+				return
+			}
+			h(w, r)
+		})
+	}
+}
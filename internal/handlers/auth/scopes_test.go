@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"context"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"net/http"
+	"testing"
+)
+
+func TestHasScopes(t *testing.T) {
+	tests := []struct {
+		name     string
+		granted  []string
+		required []string
+		want     bool
+	}{
+		{name: "none granted", granted: nil, required: []string{ScopeAssetsRead}, want: false},
+		{name: "none granted or required", granted: nil, required: nil, want: true},
+		{name: "granted", granted: []string{ScopeAssetsRead, ScopeAssetsWrite}, required: []string{ScopeAssetsRead}, want: true},
+		{name: "one missing", granted: []string{ScopeAssetsRead}, required: []string{ScopeAssetsRead, ScopeAssetsWrite}, want: false},
+		{name: "all", granted: []string{ScopeAll}, required: []string{ScopeAccountWrite, ScopeWebhooksRead}, want: true},
+		{name: "all required", granted: []string{ScopeAssetsRead}, required: []string{ScopeAll}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := JwtClaims{UserClaims: UserClaims{Scopes: tt.granted}}
+			if got := c.hasScopes(tt.required...); got != tt.want {
+				t.Fatalf("hasScopes(%v) with %v = %v, want %v", tt.required, tt.granted, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateScopes(t *testing.T) {
+	if err := ValidateScopes([]string{ScopeAll, ScopeAssetsRead}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateScopes([]string{"assets:*"}); err == nil {
+		t.Fatal("an unknown scope was accepted")
+	}
+}
+
+func TestRequireScopes(t *testing.T) {
+	db := dbtest.New(t)
+	a := newTestAuthenticator(t, db)
+	ctx := context.Background()
+	uid := dbtest.User(t, db, "scopes@example.com")
+
+	all, err := a.IssueTokens(ctx, uid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := authorized(a, all.Jwt, ScopeAccountWrite); code != http.StatusNoContent {
+		t.Fatalf("a session without requested scopes got %d, want %d", code, http.StatusNoContent)
+	}
+
+	read, err := a.IssueTokens(ctx, uid, []string{ScopeAssetsRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := authorized(a, read.Jwt, ScopeAssetsRead); code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", code, http.StatusNoContent)
+	}
+	if code := authorized(a, read.Jwt, ScopeAccountWrite); code != http.StatusForbidden {
+		t.Fatalf("status = %d without account:write, want %d", code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,68 @@
+package jobs
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	"log"
+	"net/http"
+	"time"
+)
+
+type Job struct {
+	Id          string    `json:"job_id" db:"id"`
+	Kind        string    `json:"kind" db:"kind"`
+	Status      string    `json:"status" db:"status"`
+	Attempts    int       `json:"attempts" db:"attempts"`
+	MaxAttempts int       `json:"max_attempts" db:"max_attempts"`
+	LastError   string    `json:"last_error,omitempty" db:"last_error"`
+	RunAt       time.Time `json:"run_at" db:"run_at"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+}
+
+func HandleJobStatus(db *sql.DB) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/job/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		jobStatus(w, r, db)
+	}
+}
+
+func jobStatus(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	jobId := r.URL.Query().Get("job_id")
+	if jobId == "" {
+		response.RespondWithError(w, r, "pass valid job_id in query param", http.StatusBadRequest)
+		return
+	}
+
+	uid, err := auth.GetUID(r.Context())
+	if err != nil {
+		log.Println("Error accessing UserID: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	var job Job
+	var lastError sql.NullString
+	var query = `
+		select id, kind, status, attempts, max_attempts, last_error, run_at, created_at, updated_at
+		from jobs where id = $1 and uid = $2`
+	err = db.QueryRow(query, jobId, uid).Scan(&job.Id, &job.Kind, &job.Status, &job.Attempts, &job.MaxAttempts,
+		&lastError, &job.RunAt, &job.CreatedAt, &job.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, r, "job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Error selecting job record", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	job.LastError = lastError.String
+
+	response.RespondWithSuccess(w, r, "success", job, http.StatusOK)
+}
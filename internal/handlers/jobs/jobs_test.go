@@ -0,0 +1,72 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"github.com/hitesh-goel/ekanek/internal/queue"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func status(t *testing.T, h func(http.ResponseWriter, *http.Request), method, uid, jobId string) (int, Job) {
+	t.Helper()
+	r := httptest.NewRequest(method, "/api/v1/job/status?job_id="+jobId, nil)
+	if uid != "" {
+		r = r.WithContext(auth.WithUID(r.Context(), uid))
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	var res struct {
+		Data Job `json:"data"`
+	}
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, res.Data
+}
+
+func TestJobStatusRequest(t *testing.T) {
+	_, h := HandleJobStatus(nil)
+	if code, _ := status(t, h, http.MethodPost, "uid", "id"); code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST status = %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+	if code, _ := status(t, h, http.MethodGet, "uid", ""); code != http.StatusBadRequest {
+		t.Fatalf("status without a job_id = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code, _ := status(t, h, http.MethodGet, "", "id"); code != http.StatusInternalServerError {
+		t.Fatalf("status without a user = %d, want %d", code, http.StatusInternalServerError)
+	}
+}
+
+func TestJobStatus(t *testing.T) {
+	db := dbtest.New(t)
+	_, h := HandleJobStatus(db)
+	owner := dbtest.User(t, db, "owner@example.com")
+	other := dbtest.User(t, db, "other@example.com")
+
+	id, err := queue.Enqueue(context.Background(), db, queue.Entry{UserID: owner, Kind: "test.kind", Payload: struct{}{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(`UPDATE jobs set attempts = 1, last_error = 'boom' where id = $1`, id); err != nil {
+		t.Fatal(err)
+	}
+
+	code, job := status(t, h, http.MethodGet, owner, id)
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if job.Id != id || job.Kind != "test.kind" || job.Status != queue.StatusQueued || job.Attempts != 1 || job.LastError != "boom" {
+		t.Fatalf("job %+v", job)
+	}
+
+	// Jobs of other users aren't found.
+	if code, _ = status(t, h, http.MethodGet, other, id); code != http.StatusNotFound {
+		t.Fatalf("other user's status = %d, want %d", code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,264 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/hitesh-goel/ekanek/internal/handlers/assets"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	"github.com/hitesh-goel/ekanek/internal/outbox"
+	"github.com/hitesh-goel/ekanek/internal/queue"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	eventUserDeletionScheduled = "user.deletion_scheduled"
+	eventUserRestored          = "user.restored"
+	eventUserDeleted           = "user.deleted"
+
+	jobPurgeUser = "user.purge"
+)
+
+type userJob struct {
+	UserId string `json:"uid"`
+	// DeletedAt identifies the deletion the job was scheduled for.
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+type deleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+type deletionResponse struct {
+	PurgeAt time.Time `json:"purge_at"`
+}
+
+// RegisterJobs registers the account handlers on the queue.
+func RegisterJobs(q *queue.Queue, ur *UserResources) {
+	q.Register(jobPurgeUser, func(ctx context.Context, j queue.Job) error {
+		return purgeUser(ctx, j, ur)
+	})
+	q.Register(jobPasswordResetEmail, func(ctx context.Context, j queue.Job) error {
+		return sendResetEmail(ctx, j, ur)
+	})
+	q.Register(jobVerificationEmail, func(ctx context.Context, j queue.Job) error {
+		return sendVerificationEmail(ctx, j, ur)
+	})
+}
+
+// HandleDeleteAccount schedules the caller's account for deletion. Until DeleteAfter has passed the
+// account can be restored, afterwards its assets and the user are removed for good.
+func HandleDeleteAccount(ur *UserResources) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/user/delete", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		deleteAccount(w, r, ur)
+	}
+}
+
+// HandleRestoreAccount undoes a deletion within the grace period, it takes the credentials since the
+// tokens of the account have been revoked.
+func HandleRestoreAccount(ur *UserResources) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/user/restore", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		restoreAccount(w, r, ur)
+	}
+}
+
+func deleteAccount(w http.ResponseWriter, r *http.Request, ur *UserResources) {
+	ctx := r.Context()
+	var req deleteAccountRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Password == "" {
+		response.RespondWithError(w, r, "pass your password to delete the account", http.StatusBadRequest)
+		return
+	}
+
+	uid, err := auth.GetUID(ctx)
+	if err != nil {
+		log.Println("Error accessing UserID: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if err = checkPassword(r, ur, uid, req.Password); err != nil {
+		log.Println("Error while comparing passwords", err.Error())
+		response.RespondWithError(w, r, "Wrong Password!", http.StatusForbidden)
+		return
+	}
+
+	tx, err := ur.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Error starting transaction", err.Error())
+		response.RespondWithError(w, r, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Postgres keeps microseconds, the job compares the time it was scheduled for with the stored one.
+	deletedAt := time.Now().Truncate(time.Microsecond)
+	res := deletionResponse{PurgeAt: deletedAt.Add(ur.DeleteAfter)}
+	var query = `UPDATE users set deleted_at = $2 where uid = $1 and deleted_at IS NULL RETURNING uid`
+	err = tx.QueryRowContext(ctx, query, uid, deletedAt).Scan(&uid)
+	if errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, r, "account is already scheduled for deletion", http.StatusConflict)
+		return
+	}
+	if err == nil {
+		// Public links stop working right away, they aren't brought back by a restore.
+		_, err = tx.ExecContext(ctx, `UPDATE assets set public = false where uid = $1 and public = true`, uid)
+	}
+	if err == nil {
+		err = auth.RevokeAllTx(ctx, tx, uid)
+	}
+	if err == nil {
+		_, err = queue.Enqueue(ctx, tx, queue.Entry{
+			UserID:  uid,
+			Kind:    jobPurgeUser,
+			Payload: userJob{UserId: uid, DeletedAt: deletedAt},
+			RunAt:   res.PurgeAt,
+		})
+	}
+	if err == nil {
+		err = outbox.Write(ctx, tx, outbox.Event{
+			AggregateType: aggregateUser,
+			AggregateId:   uid,
+			UserID:        uid,
+			Type:          eventUserDeletionScheduled,
+			Data:          userEvent{UserId: uid},
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println("Error deleting account", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	ur.Auth.ForgetUser(uid)
+	response.RespondWithSuccess(w, r, "account scheduled for deletion", res, http.StatusOK)
+}
+
+func restoreAccount(w http.ResponseWriter, r *http.Request, ur *UserResources) {
+	ctx := r.Context()
+	var user CreateUser
+	err := json.NewDecoder(r.Body).Decode(&user)
+	if err != nil || !user.isValidUser() {
+		response.RespondWithError(w, r, "pass valid user entry", http.StatusBadRequest)
+		return
+	}
+
+	var uid, hash string
+	var deletedAt sql.NullTime
+	err = ur.DB.QueryRowContext(ctx, `select uid, password, deleted_at from users where email = $1`, user.Email).
+		Scan(&uid, &hash, &deletedAt)
+	if err == nil {
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(user.Password))
+	}
+	if err != nil {
+		log.Println("Error while comparing passwords", err.Error())
+		response.RespondWithError(w, r, "Wrong Password!", http.StatusForbidden)
+		return
+	}
+	if !deletedAt.Valid {
+		response.RespondWithError(w, r, "account is not scheduled for deletion", http.StatusConflict)
+		return
+	}
+
+	tx, err := ur.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Error starting transaction", err.Error())
+		response.RespondWithError(w, r, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// The purge job finds the account restored and leaves it alone.
+	var query = `UPDATE users set deleted_at = NULL where uid = $1 and deleted_at > $2 RETURNING uid`
+	err = tx.QueryRowContext(ctx, query, uid, time.Now().Add(-ur.DeleteAfter)).Scan(&uid)
+	if errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, r, "the account can no longer be restored", http.StatusGone)
+		return
+	}
+	if err == nil {
+		err = outbox.Write(ctx, tx, outbox.Event{
+			AggregateType: aggregateUser,
+			AggregateId:   uid,
+			UserID:        uid,
+			Type:          eventUserRestored,
+			Data:          userEvent{UserId: uid},
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println("Error restoring account", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := ur.Auth.IssueTokens(ctx, uid, nil)
+	if err != nil {
+		log.Println("Error generating jwtToken", err.Error())
+		response.RespondWithError(w, r, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	response.RespondWithSuccess(w, r, "account restored", tokens, http.StatusOK)
+}
+
+// purgeUser removes the assets of a deleted account from s3, then the user along with everything
+// referencing it. Accounts which were restored are left alone, a later deletion has its own job.
+func purgeUser(ctx context.Context, j queue.Job, ur *UserResources) error {
+	var p userJob
+	if err := j.Decode(&p); err != nil {
+		return err
+	}
+
+	var deletedAt sql.NullTime
+	err := ur.DB.QueryRowContext(ctx, `select deleted_at from users where uid = $1`, p.UserId).Scan(&deletedAt)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (!deletedAt.Valid || !deletedAt.Time.Equal(p.DeletedAt))) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = assets.PurgeUserAssets(ctx, ur.Assets, p.UserId); err != nil {
+		return err
+	}
+
+	tx, err := ur.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM users where uid = $1 and deleted_at IS NOT NULL`, p.UserId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		err = outbox.Write(ctx, tx, outbox.Event{
+			AggregateType: aggregateUser,
+			AggregateId:   p.UserId,
+			UserID:        p.UserId,
+			Type:          eventUserDeleted,
+			Data:          userEvent{UserId: p.UserId},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,103 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"github.com/hitesh-goel/ekanek/internal/queue"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDeleteAndRestoreAccount(t *testing.T) {
+	db := dbtest.New(t)
+	ur := newTestResources(t, db)
+	uid := dbtest.User(t, db, "delete@example.com")
+	tokens := login(t, ur, "delete@example.com")
+
+	_, profile := ur.Auth.Require(auth.ScopeAccountRead)(HandleProfile(ur))
+	_, del := ur.Auth.Require(auth.ScopeAccountWrite)(HandleDeleteAccount(ur))
+	_, refresh := auth.HandleRefresh(ur.Auth)
+	_, restore := HandleRestoreAccount(ur)
+
+	// The token is checked, and the check cached, before the deletion.
+	if code := get(profile, tokens.Jwt); code != http.StatusOK {
+		t.Fatalf("profile status = %d, want %d", code, http.StatusOK)
+	}
+	if code := call(t, del, tokens.Jwt, deleteAccountRequest{Password: "wrong"}, nil); code != http.StatusForbidden {
+		t.Fatalf("delete with a wrong password status = %d, want %d", code, http.StatusForbidden)
+	}
+	var res deletionResponse
+	if code := call(t, del, tokens.Jwt, deleteAccountRequest{Password: "password"}, &res); code != http.StatusOK {
+		t.Fatalf("delete status = %d, want %d", code, http.StatusOK)
+	}
+	if until := time.Until(res.PurgeAt); until <= 0 || until > ur.DeleteAfter {
+		t.Fatalf("purge_at %v isn't within the grace period", res.PurgeAt)
+	}
+
+	if code := get(profile, tokens.Jwt); code != http.StatusUnauthorized {
+		t.Fatalf("profile status = %d after the deletion, want %d", code, http.StatusUnauthorized)
+	}
+	if code := call(t, refresh, "", map[string]string{"refresh_token": tokens.RefreshToken}, nil); code != http.StatusUnauthorized {
+		t.Fatalf("refresh status = %d after the deletion, want %d", code, http.StatusUnauthorized)
+	}
+	var jobs int
+	if err := db.QueryRow(`select COUNT(*) from jobs where uid = $1 and kind = $2`, uid, jobPurgeUser).Scan(&jobs); err != nil || jobs != 1 {
+		t.Fatalf("%d purge jobs, err = %v, want 1", jobs, err)
+	}
+
+	if code := call(t, restore, "", CreateUser{Email: "delete@example.com", Password: "wrong"}, nil); code != http.StatusForbidden {
+		t.Fatalf("restore with a wrong password status = %d, want %d", code, http.StatusForbidden)
+	}
+	var restored auth.Tokens
+	if code := call(t, restore, "", CreateUser{Email: "delete@example.com", Password: "password"}, &restored); code != http.StatusOK {
+		t.Fatalf("restore status = %d, want %d", code, http.StatusOK)
+	}
+	if code := get(profile, restored.Jwt); code != http.StatusOK {
+		t.Fatalf("profile status = %d after the restore, want %d", code, http.StatusOK)
+	}
+	if code := call(t, restore, "", CreateUser{Email: "delete@example.com", Password: "password"}, nil); code != http.StatusConflict {
+		t.Fatalf("second restore status = %d, want %d", code, http.StatusConflict)
+	}
+}
+
+func TestPurgeUser(t *testing.T) {
+	db := dbtest.New(t)
+	ur := newTestResources(t, db)
+	ctx := context.Background()
+
+	deletedAt := time.Now().Add(-2 * ur.DeleteAfter).Truncate(time.Microsecond)
+	purged := dbtest.User(t, db, "purged@example.com")
+	restored := dbtest.User(t, db, "restored@example.com")
+	if _, err := db.Exec(`UPDATE users set deleted_at = $2 where uid = $1`, purged, deletedAt); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, uid := range []string{purged, restored} {
+		if err := purgeUser(ctx, job(t, userJob{UserId: uid, DeletedAt: deletedAt}), ur); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var n int
+	if err := db.QueryRow(`select COUNT(*) from users where uid = $1`, purged).Scan(&n); err != nil || n != 0 {
+		t.Fatalf("%d deleted users left, err = %v, want 0", n, err)
+	}
+	if err := db.QueryRow(`select COUNT(*) from users where uid = $1`, restored).Scan(&n); err != nil || n != 1 {
+		t.Fatalf("%d restored users left, err = %v, want 1", n, err)
+	}
+	if err := db.QueryRow(`select COUNT(*) from outbox where aggregate_id = $1 and type = $2`, purged, eventUserDeleted).Scan(&n); err != nil || n != 1 {
+		t.Fatalf("%d %s events, err = %v, want 1", n, eventUserDeleted, err)
+	}
+}
+
+func job(t *testing.T, payload interface{}) queue.Job {
+	t.Helper()
+	b, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue.Job{Payload: b}
+}
@@ -0,0 +1,171 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	"github.com/hitesh-goel/ekanek/internal/outbox"
+	"github.com/hitesh-goel/ekanek/internal/pkg/mail"
+	"github.com/hitesh-goel/ekanek/internal/queue"
+	"log"
+	"net/http"
+)
+
+const (
+	eventPasswordReset = "user.password_reset"
+
+	jobPasswordResetEmail = "user.password_reset_email"
+
+	forgotPasswordMessage = "if the email is registered, a password reset token has been sent to it"
+)
+
+type forgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type resetEmailJob struct {
+	Email string `json:"email"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// HandleForgotPassword emails a password reset token. The response is the same whether or not the
+// email is registered, so it can't be used to find accounts.
+func HandleForgotPassword(ur *UserResources) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/user/password/forgot", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		forgotPassword(w, r, ur)
+	}
+}
+
+// HandleResetPassword sets a new password with a reset token and logs the user out everywhere.
+func HandleResetPassword(ur *UserResources) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/user/password/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		resetPassword(w, r, ur)
+	}
+}
+
+func forgotPassword(w http.ResponseWriter, r *http.Request, ur *UserResources) {
+	var req forgotPasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Email == "" {
+		response.RespondWithError(w, r, "pass a valid email", http.StatusBadRequest)
+		return
+	}
+
+	// The account is looked up by the job, the request takes as long whether or not it exists.
+	_, err = queue.Enqueue(r.Context(), ur.DB, queue.Entry{
+		Kind:    jobPasswordResetEmail,
+		Payload: resetEmailJob{Email: req.Email},
+	})
+	if err != nil {
+		log.Println("Error queueing password reset email", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	response.RespondWithSuccess(w, r, forgotPasswordMessage, nil, http.StatusOK)
+}
+
+// sendResetEmail emails a password reset token if the email belongs to an account.
+func sendResetEmail(ctx context.Context, j queue.Job, ur *UserResources) error {
+	var p resetEmailJob
+	if err := j.Decode(&p); err != nil {
+		return err
+	}
+
+	var uid string
+	err := ur.DB.QueryRowContext(ctx, `select uid from users where email = $1 and deleted_at IS NULL`, p.Email).Scan(&uid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := newUserToken(ctx, ur.DB, uid, purposePasswordReset, "", ur.ResetTTL)
+	if errors.Is(err, errTokenLimit) {
+		log.Println("Password reset limit reached for user", uid)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return ur.Mailer.Send(ctx, mail.Message{
+		To:      p.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone requested a password reset for your account.\n\n"+
+			"Your reset token is: %s\n\nIt expires in %s. If it wasn't you, you can ignore this email.", token, ur.ResetTTL),
+	})
+}
+
+func resetPassword(w http.ResponseWriter, r *http.Request, ur *UserResources) {
+	ctx := r.Context()
+	var req resetPasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Token == "" || req.Password == "" {
+		response.RespondWithError(w, r, "pass a valid token and password", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := getHash([]byte(req.Password))
+	if err != nil {
+		log.Println("Error while hashing the Password", err.Error())
+		response.RespondWithError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := ur.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Error starting transaction", err.Error())
+		response.RespondWithError(w, r, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	uid, _, err := useUserToken(ctx, tx, purposePasswordReset, req.Token)
+	if errors.Is(err, errTokenInvalid) {
+		response.RespondWithError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `UPDATE users set password = $1 where uid = $2`, hash, uid)
+	}
+	if err == nil {
+		// Whoever knew the old password may still hold a session, it ends with the reset.
+		err = auth.RevokeAllTx(ctx, tx, uid)
+	}
+	if err == nil {
+		err = outbox.Write(ctx, tx, outbox.Event{
+			AggregateType: aggregateUser,
+			AggregateId:   uid,
+			UserID:        uid,
+			Type:          eventPasswordReset,
+			Data:          userEvent{UserId: uid},
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println("Error resetting password", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	ur.Auth.ForgetUser(uid)
+	response.RespondWithSuccess(w, r, "password has been reset, log in with the new password", nil, http.StatusOK)
+}
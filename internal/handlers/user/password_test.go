@@ -0,0 +1,108 @@
+package user
+
+import (
+	"context"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"github.com/hitesh-goel/ekanek/internal/pkg/mail"
+	"github.com/hitesh-goel/ekanek/internal/queue"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mailbox is a mailer remembering what it was asked to send.
+type mailbox struct {
+	mu   sync.Mutex
+	sent []mail.Message
+}
+
+func (o *mailbox) Send(_ context.Context, m mail.Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sent = append(o.sent, m)
+	return nil
+}
+
+func TestForgotPasswordQueuesTheEmail(t *testing.T) {
+	db := dbtest.New(t)
+	ur := newTestResources(t, db)
+	sent := &mailbox{}
+	ur.Mailer = sent
+	dbtest.User(t, db, "forgot@example.com")
+
+	_, forgot := HandleForgotPassword(ur)
+	for _, email := range []string{"forgot@example.com", "unknown@example.com"} {
+		if code := call(t, forgot, "", forgotPasswordRequest{Email: email}, nil); code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d", email, code, http.StatusOK)
+		}
+	}
+	if len(sent.sent) != 0 {
+		t.Fatal("the email was sent while handling the request")
+	}
+
+	rows, err := db.Query(`select payload from jobs where kind = $1`, jobPasswordResetEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jobs []queue.Job
+	for rows.Next() {
+		var j queue.Job
+		if err = rows.Scan(&j.Payload); err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, j)
+	}
+	rows.Close()
+	if len(jobs) != 2 {
+		t.Fatalf("%d jobs queued, want 2", len(jobs))
+	}
+	for _, j := range jobs {
+		if err = sendResetEmail(context.Background(), j, ur); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sent.sent) != 1 || sent.sent[0].To != "forgot@example.com" {
+		t.Fatalf("sent %+v, want a single email to the registered address", sent.sent)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	db := dbtest.New(t)
+	ur := newTestResources(t, db)
+	sent := &mailbox{}
+	ur.Mailer = sent
+	dbtest.User(t, db, "reset@example.com")
+	before := login(t, ur, "reset@example.com")
+
+	if err := sendResetEmail(context.Background(), job(t, resetEmailJob{Email: "reset@example.com"}), ur); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent.sent) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(sent.sent))
+	}
+	body := sent.sent[0].Body
+	i := strings.Index(body, "token is: ")
+	token := strings.Fields(body[i+len("token is: "):])[0]
+
+	_, reset := HandleResetPassword(ur)
+	if code := call(t, reset, "", resetPasswordRequest{Token: "wrong", Password: "new"}, nil); code != http.StatusBadRequest {
+		t.Fatalf("wrong token status = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := call(t, reset, "", resetPasswordRequest{Token: token, Password: "new"}, nil); code != http.StatusOK {
+		t.Fatalf("reset status = %d, want %d", code, http.StatusOK)
+	}
+	if code := call(t, reset, "", resetPasswordRequest{Token: token, Password: "other"}, nil); code != http.StatusBadRequest {
+		t.Fatalf("second reset status = %d, want %d", code, http.StatusBadRequest)
+	}
+
+	_, profile := HandleProfile(ur)
+	_, profile = ur.Auth.Auth("/", profile)
+	if code := get(profile, before.Jwt); code != http.StatusUnauthorized {
+		t.Fatalf("profile status = %d with a token from before the reset, want %d", code, http.StatusUnauthorized)
+	}
+	_, h := HandleLogin(ur)
+	if code := call(t, h, "", CreateUser{Email: "reset@example.com", Password: "new"}, nil); code != http.StatusOK {
+		t.Fatalf("login with the new password status = %d, want %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,410 @@
+package user
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	"github.com/hitesh-goel/ekanek/internal/outbox"
+	"github.com/hitesh-goel/ekanek/internal/pkg/mail"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	eventProfileUpdated  = "user.profile_updated"
+	eventPasswordChanged = "user.password_changed"
+	eventEmailChanged    = "user.email_changed"
+
+	maxNameLength = 100
+)
+
+var (
+	errProfileInvalid = errors.New("invalid profile")
+	errEmailTaken     = errors.New("email is already registered")
+)
+
+// Profile is the caller's account as returned by /api/v1/user/me.
+type Profile struct {
+	Id            string    `json:"id" db:"uid"`
+	FirstName     string    `json:"firstname" db:"first_name"`
+	LastName      string    `json:"lastname" db:"last_name"`
+	Email         string    `json:"email" db:"email"`
+	EmailVerified bool      `json:"email_verified" db:"email_verified"`
+	Plan          string    `json:"plan" db:"plan"`
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+}
+
+type updateProfileRequest struct {
+	FirstName *string `json:"firstname"`
+	LastName  *string `json:"lastname"`
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type changeEmailRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// HandleProfile returns the caller's profile on GET and updates their name on PATCH.
+func HandleProfile(ur *UserResources) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/user/me", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			getProfile(w, r, ur)
+		case http.MethodPatch:
+			updateProfile(w, r, ur)
+		default:
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// HandleChangePassword sets a new password after checking the current one, the other sessions of the
+// user are logged out and the caller gets new tokens.
+func HandleChangePassword(ur *UserResources) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/user/password/change", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		changePassword(w, r, ur)
+	}
+}
+
+// HandleChangeEmail emails a confirmation token to the new address, the email is only changed once
+// it is confirmed.
+func HandleChangeEmail(ur *UserResources) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/user/email/change", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		changeEmail(w, r, ur)
+	}
+}
+
+// HandleConfirmEmailChange switches the user to the address the token was sent to.
+func HandleConfirmEmailChange(ur *UserResources) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/user/email/change/confirm", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		confirmEmailChange(w, r, ur)
+	}
+}
+
+func (p *updateProfileRequest) validate() error {
+	if p.FirstName == nil && p.LastName == nil {
+		return fmt.Errorf("%v: pass firstname and/or lastname", errProfileInvalid)
+	}
+	if p.FirstName != nil {
+		*p.FirstName = strings.TrimSpace(*p.FirstName)
+		if *p.FirstName == "" || len(*p.FirstName) > maxNameLength {
+			return fmt.Errorf("%v: firstname must be 1 to %d characters", errProfileInvalid, maxNameLength)
+		}
+	}
+	if p.LastName != nil {
+		*p.LastName = strings.TrimSpace(*p.LastName)
+		if len(*p.LastName) > maxNameLength {
+			return fmt.Errorf("%v: lastname must be at most %d characters", errProfileInvalid, maxNameLength)
+		}
+	}
+	return nil
+}
+
+// checkPassword compares password with the user's password hash.
+func checkPassword(r *http.Request, ur *UserResources, uid string, password string) error {
+	var hash string
+	err := ur.DB.QueryRowContext(r.Context(), `select password from users where uid = $1`, uid).Scan(&hash)
+	if err != nil {
+		return err
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+}
+
+func getProfile(w http.ResponseWriter, r *http.Request, ur *UserResources) {
+	uid, err := auth.GetUID(r.Context())
+	if err != nil {
+		log.Println("Error accessing UserID: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	var p Profile
+	var query = `
+		select uid, first_name, COALESCE(last_name, ''), email, email_verified, plan, created_at
+		from users where uid = $1`
+	err = ur.DB.QueryRowContext(r.Context(), query, uid).Scan(&p.Id, &p.FirstName, &p.LastName, &p.Email,
+		&p.EmailVerified, &p.Plan, &p.CreatedAt)
+	if err != nil {
+		log.Println("Error selecting user", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	response.RespondWithSuccess(w, r, "success", &p, http.StatusOK)
+}
+
+func updateProfile(w http.ResponseWriter, r *http.Request, ur *UserResources) {
+	ctx := r.Context()
+	var req updateProfileRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		log.Println("Error decoding json data", err.Error())
+		response.RespondWithError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = req.validate(); err != nil {
+		response.RespondWithError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	uid, err := auth.GetUID(ctx)
+	if err != nil {
+		log.Println("Error accessing UserID: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := ur.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Error starting transaction", err.Error())
+		response.RespondWithError(w, r, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var query = `
+		UPDATE users set first_name = COALESCE($2, first_name), last_name = COALESCE($3, last_name)
+		where uid = $1`
+	_, err = tx.ExecContext(ctx, query, uid, req.FirstName, req.LastName)
+	if err == nil {
+		err = outbox.Write(ctx, tx, outbox.Event{
+			AggregateType: aggregateUser,
+			AggregateId:   uid,
+			UserID:        uid,
+			Type:          eventProfileUpdated,
+			Data:          userEvent{UserId: uid},
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println("Error updating profile", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	getProfile(w, r, ur)
+}
+
+func changePassword(w http.ResponseWriter, r *http.Request, ur *UserResources) {
+	ctx := r.Context()
+	var req changePasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.CurrentPassword == "" || req.NewPassword == "" {
+		response.RespondWithError(w, r, "pass current_password and new_password", http.StatusBadRequest)
+		return
+	}
+
+	uid, err := auth.GetUID(ctx)
+	if err != nil {
+		log.Println("Error accessing UserID: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if err = checkPassword(r, ur, uid, req.CurrentPassword); err != nil {
+		log.Println("Error while comparing passwords", err.Error())
+		response.RespondWithError(w, r, "Wrong Password!", http.StatusForbidden)
+		return
+	}
+
+	hash, err := getHash([]byte(req.NewPassword))
+	if err != nil {
+		log.Println("Error while hashing the Password", err.Error())
+		response.RespondWithError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := ur.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Error starting transaction", err.Error())
+		response.RespondWithError(w, r, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE users set password = $1 where uid = $2`, hash, uid)
+	if err == nil {
+		// Every session is revoked with the change, the caller continues with a new one.
+		err = auth.RevokeAllTx(ctx, tx, uid)
+	}
+	if err == nil {
+		err = outbox.Write(ctx, tx, outbox.Event{
+			AggregateType: aggregateUser,
+			AggregateId:   uid,
+			UserID:        uid,
+			Type:          eventPasswordChanged,
+			Data:          userEvent{UserId: uid},
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println("Error changing password", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	ur.Auth.ForgetUser(uid)
+	tokens, err := ur.Auth.IssueTokens(ctx, uid, nil)
+	if err != nil {
+		log.Println("Error generating jwtToken", err.Error())
+		response.RespondWithError(w, r, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	response.RespondWithSuccess(w, r, "password changed, other sessions have been logged out", tokens, http.StatusOK)
+}
+
+func changeEmail(w http.ResponseWriter, r *http.Request, ur *UserResources) {
+	ctx := r.Context()
+	var req changeEmailRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Password == "" {
+		response.RespondWithError(w, r, "pass email and password", http.StatusBadRequest)
+		return
+	}
+	if !validEmail(req.Email) {
+		response.RespondWithError(w, r, errEmailInvalid.Error(), http.StatusBadRequest)
+		return
+	}
+
+	uid, err := auth.GetUID(ctx)
+	if err != nil {
+		log.Println("Error accessing UserID: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if err = checkPassword(r, ur, uid, req.Password); err != nil {
+		log.Println("Error while comparing passwords", err.Error())
+		response.RespondWithError(w, r, "Wrong Password!", http.StatusForbidden)
+		return
+	}
+
+	var taken bool
+	err = ur.DB.QueryRowContext(ctx, `select EXISTS(select 1 from users where email = $1)`, req.Email).Scan(&taken)
+	if err != nil {
+		log.Println("Error selecting user", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		response.RespondWithError(w, r, errEmailTaken.Error(), http.StatusConflict)
+		return
+	}
+
+	token, err := newUserToken(ctx, ur.DB, uid, purposeEmailChange, req.Email, ur.VerifyTTL)
+	if errors.Is(err, errTokenLimit) {
+		response.RespondWithError(w, r, "too many email changes, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		log.Println("Error creating email change token", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	err = ur.Mailer.Send(ctx, mail.Message{
+		To:      req.Email,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Please confirm that this is your new email address.\n\n"+
+			"Your confirmation token is: %s\n\nIt expires in %s.", token, ur.VerifyTTL),
+	})
+	if err != nil {
+		log.Println("Error sending email change email", err.Error())
+		response.RespondWithError(w, r, "unable to send the confirmation email", http.StatusInternalServerError)
+		return
+	}
+	response.RespondWithSuccess(w, r, "confirmation email sent to the new address", nil, http.StatusOK)
+}
+
+func confirmEmailChange(w http.ResponseWriter, r *http.Request, ur *UserResources) {
+	ctx := r.Context()
+	var req verifyEmailRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Token == "" {
+		response.RespondWithError(w, r, "pass a valid token", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := ur.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Error starting transaction", err.Error())
+		response.RespondWithError(w, r, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	uid, email, err := useUserToken(ctx, tx, purposeEmailChange, req.Token)
+	if errors.Is(err, errTokenInvalid) {
+		response.RespondWithError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var taken bool
+	if err == nil {
+		err = tx.QueryRowContext(ctx, `select EXISTS(select 1 from users where email = $1)`, email).Scan(&taken)
+	}
+	if err == nil && taken {
+		response.RespondWithError(w, r, errEmailTaken.Error(), http.StatusConflict)
+		return
+	}
+
+	var previous string
+	if err == nil {
+		err = tx.QueryRowContext(ctx, `select email from users where uid = $1 FOR UPDATE`, uid).Scan(&previous)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `UPDATE users set email = $2, email_verified = true where uid = $1`, uid, email)
+	}
+	if err == nil {
+		err = outbox.Write(ctx, tx, outbox.Event{
+			AggregateType: aggregateUser,
+			AggregateId:   uid,
+			UserID:        uid,
+			Type:          eventEmailChanged,
+			Data:          userEvent{UserId: uid},
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, r, errTokenInvalid.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Println("Error changing email", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Let the previous address know, in case the change wasn't made by its owner.
+	err = ur.Mailer.Send(ctx, mail.Message{
+		To:      previous,
+		Subject: "Your email address was changed",
+		Body:    fmt.Sprintf("The email address of your account was changed to %s.", email),
+	})
+	if err != nil {
+		log.Println("Error sending email change notice", err.Error())
+	}
+	response.RespondWithSuccess(w, r, "email changed", nil, http.StatusOK)
+}
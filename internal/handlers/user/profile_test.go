@@ -0,0 +1,39 @@
+package user
+
+import (
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"net/http"
+	"testing"
+)
+
+func TestChangePasswordRevokesOtherSessions(t *testing.T) {
+	db := dbtest.New(t)
+	ur := newTestResources(t, db)
+	dbtest.User(t, db, "change@example.com")
+	caller := login(t, ur, "change@example.com")
+	other := login(t, ur, "change@example.com")
+
+	_, change := ur.Auth.Auth(HandleChangePassword(ur))
+	_, profile := HandleProfile(ur)
+	_, profile = ur.Auth.Auth("/", profile)
+
+	req := changePasswordRequest{CurrentPassword: "wrong", NewPassword: "new"}
+	if code := call(t, change, caller.Jwt, req, nil); code != http.StatusForbidden {
+		t.Fatalf("wrong password status = %d, want %d", code, http.StatusForbidden)
+	}
+	req.CurrentPassword = "password"
+	var tokens auth.Tokens
+	if code := call(t, change, caller.Jwt, req, &tokens); code != http.StatusOK {
+		t.Fatalf("change status = %d, want %d", code, http.StatusOK)
+	}
+
+	for name, token := range map[string]string{"caller": caller.Jwt, "other": other.Jwt} {
+		if code := get(profile, token); code != http.StatusUnauthorized {
+			t.Errorf("%s session: profile status = %d after the change, want %d", name, code, http.StatusUnauthorized)
+		}
+	}
+	if code := get(profile, tokens.Jwt); code != http.StatusOK {
+		t.Fatalf("new session: profile status = %d, want %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,80 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+const (
+	purposePasswordReset     = "password_reset"
+	purposeEmailVerification = "email_verification"
+	purposeEmailChange       = "email_change"
+
+	// maxTokensPerHour limits how many emails can be triggered for a user and purpose.
+	maxTokensPerHour = 3
+)
+
+var (
+	errTokenInvalid = errors.New("invalid or expired token")
+	errTokenLimit   = errors.New("too many tokens requested")
+)
+
+// newUserToken stores a single-use token for the purpose, only its hash is kept. email is the address
+// the token was sent to, when it matters for the purpose.
+func newUserToken(ctx context.Context, db *sql.DB, uid string, purpose string, email string, ttl time.Duration) (string, error) {
+	var count int
+	var query = `select COUNT(*) from user_tokens where uid = $1 and purpose = $2 and created_at > NOW() - interval '1 hour'`
+	if err := db.QueryRowContext(ctx, query, uid, purpose).Scan(&count); err != nil {
+		return "", err
+	}
+	if count >= maxTokensPerHour {
+		return "", errTokenLimit
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	if _, err := db.ExecContext(ctx, `DELETE FROM user_tokens WHERE uid = $1 AND expires_at < NOW() - interval '1 hour'`, uid); err != nil {
+		return "", err
+	}
+	query = `INSERT INTO user_tokens (uid, purpose, token_hash, expires_at, email) VALUES ($1, $2, $3, $4, NULLIF($5, ''))`
+	_, err := db.ExecContext(ctx, query, uid, purpose, hashToken(token), time.Now().Add(ttl), email)
+	return token, err
+}
+
+// useUserToken marks the token used and returns its user and email, the other pending tokens of the
+// user for the purpose are invalidated along with it.
+func useUserToken(ctx context.Context, tx *sql.Tx, purpose string, token string) (string, string, error) {
+	var uid, email string
+	var query = `
+		UPDATE user_tokens set used_at = NOW()
+		where token_hash = $1 and purpose = $2 and used_at IS NULL and expires_at > NOW()
+		RETURNING uid, COALESCE(email, '')`
+	err := tx.QueryRowContext(ctx, query, hashToken(token), purpose).Scan(&uid, &email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", errTokenInvalid
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	query = `UPDATE user_tokens set used_at = NOW() where uid = $1 and purpose = $2 and used_at IS NULL`
+	if _, err = tx.ExecContext(ctx, query, uid, purpose); err != nil {
+		return "", "", err
+	}
+	return uid, email, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,79 @@
+package user
+
+import (
+	"database/sql"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	"log"
+	"net/http"
+)
+
+type ContentTypeUsage struct {
+	ContentType   string `json:"content_type" db:"content_type"`
+	AssetCount    int64  `json:"asset_count"`
+	OriginalBytes int64  `json:"original_bytes" db:"original_bytes"`
+	StoredBytes   int64  `json:"stored_bytes" db:"stored_bytes"`
+}
+
+type Usage struct {
+	QuotaBytes    int64              `json:"quota_bytes"`
+	AssetCount    int64              `json:"asset_count"`
+	OriginalBytes int64              `json:"original_bytes"`
+	StoredBytes   int64              `json:"stored_bytes"`
+	ContentTypes  []ContentTypeUsage `json:"by_content_type"`
+}
+
+// HandleUsage reports the storage used by the caller, a quota of 0 means unlimited.
+func HandleUsage(defaultQuota int64, db *sql.DB) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/user/usage", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		userUsage(w, r, db, defaultQuota)
+	}
+}
+
+func userUsage(w http.ResponseWriter, r *http.Request, db *sql.DB, defaultQuota int64) {
+	uid, err := auth.GetUID(r.Context())
+	if err != nil {
+		log.Println("Error accessing UserID: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	usage := Usage{ContentTypes: []ContentTypeUsage{}}
+	err = db.QueryRow(`select COALESCE(quota_bytes, $2) from users where uid = $1`, uid, defaultQuota).Scan(&usage.QuotaBytes)
+	if err != nil {
+		log.Println("Error selecting user quota", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	var query = `
+		select COALESCE(content_type, 'unknown'), COUNT(*), SUM(original_bytes), SUM(stored_bytes)
+		from assets where uid = $1 and is_active = true
+		group by 1 order by 1`
+	rows, err := db.Query(query, uid)
+	if err != nil {
+		log.Println("Error selecting usage", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ct ContentTypeUsage
+		err = rows.Scan(&ct.ContentType, &ct.AssetCount, &ct.OriginalBytes, &ct.StoredBytes)
+		if err != nil {
+			log.Println("Error while scanning usage rows: ", err.Error())
+			response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+			return
+		}
+		usage.AssetCount += ct.AssetCount
+		usage.OriginalBytes += ct.OriginalBytes
+		usage.StoredBytes += ct.StoredBytes
+		usage.ContentTypes = append(usage.ContentTypes, ct)
+	}
+
+	response.RespondWithSuccess(w, r, "success", usage, http.StatusOK)
+}
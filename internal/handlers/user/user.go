@@ -3,15 +3,40 @@ package user
 import (
 	"database/sql"
 	"encoding/json"
+	"github.com/hitesh-goel/ekanek/internal/handlers/assets"
 	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
 	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	"github.com/hitesh-goel/ekanek/internal/outbox"
+	"github.com/hitesh-goel/ekanek/internal/pkg/mail"
+	"github.com/hitesh-goel/ekanek/internal/queue"
 	"golang.org/x/crypto/bcrypt"
 	"log"
 	"net/http"
+	"time"
 )
 
-type jwtResponse struct {
-	Jwt string `json:"jwt"`
+const (
+	aggregateUser    = "user"
+	eventUserCreated = "user.created"
+)
+
+// UserResources are the dependencies of the account handlers.
+type UserResources struct {
+	DB     *sql.DB
+	Auth   *auth.Authenticator
+	Mailer mail.Mailer
+	// ResetTTL is how long password reset tokens are valid, VerifyTTL email verification tokens.
+	ResetTTL  time.Duration
+	VerifyTTL time.Duration
+	// DeleteAfter is the grace period in which a deleted account can be restored.
+	DeleteAfter time.Duration
+	// Assets are purged along with a deleted account.
+	Assets *assets.AssetResources
+}
+
+// userEvent is the data of the user events written to the outbox.
+type userEvent struct {
+	UserId string `json:"uid"`
 }
 
 // User Type
@@ -20,6 +45,8 @@ type CreateUser struct {
 	LastName  string `json:"lastname"`
 	Email     string `json:"email"`
 	Password  string `json:"password"`
+	// Scopes optionally restrict the tokens issued at login, e.g. to assets:read for a dashboard.
+	Scopes []string `json:"scopes,omitempty"`
 }
 
 type GetUser struct {
@@ -42,7 +69,7 @@ func (user *CreateUser) isValidUser() bool {
 	return user.Email != "" && user.Password != ""
 }
 
-func userSignup(w http.ResponseWriter, r *http.Request, db *sql.DB, key string) {
+func userSignup(w http.ResponseWriter, r *http.Request, ur *UserResources) {
 	var user CreateUser
 	err := json.NewDecoder(r.Body).Decode(&user)
 
@@ -50,6 +77,10 @@ func userSignup(w http.ResponseWriter, r *http.Request, db *sql.DB, key string)
 		response.RespondWithError(w, r, "pass valid user entry", http.StatusBadRequest)
 		return
 	}
+	if !validEmail(user.Email) {
+		response.RespondWithError(w, r, errEmailInvalid.Error(), http.StatusBadRequest)
+		return
+	}
 
 	user.Password, err = getHash([]byte(user.Password))
 	if err != nil {
@@ -74,8 +105,36 @@ func userSignup(w http.ResponseWriter, r *http.Request, db *sql.DB, key string)
             $3,
             $4
         ) RETURNING uid`
+	tx, err := ur.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Println("Error starting transaction", err.Error())
+		response.RespondWithError(w, r, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
 	uid := ""
-	err = db.QueryRow(query, user.FirstName, user.LastName, user.Email, user.Password).Scan(&uid)
+	err = tx.QueryRowContext(r.Context(), query, user.FirstName, user.LastName, user.Email, user.Password).Scan(&uid)
+	if err == nil {
+		err = outbox.Write(r.Context(), tx, outbox.Event{
+			AggregateType: aggregateUser,
+			AggregateId:   uid,
+			UserID:        uid,
+			Type:          eventUserCreated,
+			Data:          userEvent{UserId: uid},
+		})
+	}
+	if err == nil {
+		// The email is sent by a job, signup doesn't wait for the mail server.
+		_, err = queue.Enqueue(r.Context(), tx, queue.Entry{
+			UserID:  uid,
+			Kind:    jobVerificationEmail,
+			Payload: verificationEmailJob{UserId: uid, Email: user.Email},
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 
 	if err != nil {
 		log.Println("Error while saving user to database: ", err.Error())
@@ -83,19 +142,16 @@ func userSignup(w http.ResponseWriter, r *http.Request, db *sql.DB, key string)
 		return
 	}
 
-	jwtToken, err := auth.GenerateJWT(uid, key)
+	tokens, err := ur.Auth.IssueTokens(r.Context(), uid, nil)
 	if err != nil {
 		log.Println("Error generating jwtToken", err.Error())
 		response.RespondWithError(w, r, "something went wrong", http.StatusInternalServerError)
 		return
 	}
-	resp := &jwtResponse{
-		Jwt: jwtToken,
-	}
-	response.RespondWithSuccess(w, r, "success", resp, http.StatusOK)
+	response.RespondWithSuccess(w, r, "success", tokens, http.StatusOK)
 }
 
-func userLogin(w http.ResponseWriter, r *http.Request, db *sql.DB, key string) {
+func userLogin(w http.ResponseWriter, r *http.Request, ur *UserResources) {
 	var user CreateUser
 	var dbUser GetUser
 	err := json.NewDecoder(r.Body).Decode(&user)
@@ -105,10 +161,15 @@ func userLogin(w http.ResponseWriter, r *http.Request, db *sql.DB, key string) {
 		response.RespondWithError(w, r, "pass valid user entry", http.StatusBadRequest)
 		return
 	}
+	if err = auth.ValidateScopes(user.Scopes); err != nil {
+		response.RespondWithError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	var query = `select uid, password from users where email = $1`
-	row := db.QueryRow(query, user.Email)
-	_ = row.Scan(&dbUser.Id, &dbUser.Password)
+	var deletedAt sql.NullTime
+	var query = `select uid, password, deleted_at from users where email = $1`
+	row := ur.DB.QueryRow(query, user.Email)
+	_ = row.Scan(&dbUser.Id, &dbUser.Password, &deletedAt)
 
 	userPass := []byte(user.Password)
 	dbPass := []byte(dbUser.Password)
@@ -120,37 +181,38 @@ func userLogin(w http.ResponseWriter, r *http.Request, db *sql.DB, key string) {
 		response.RespondWithError(w, r, "Wrong Password!", http.StatusForbidden)
 		return
 	}
+	if deletedAt.Valid {
+		response.RespondWithError(w, r, "account is scheduled for deletion, restore it to log in", http.StatusForbidden)
+		return
+	}
 
-	jwtToken, err := auth.GenerateJWT(dbUser.Id, key)
+	tokens, err := ur.Auth.IssueTokens(r.Context(), dbUser.Id, user.Scopes)
 	if err != nil {
 		log.Println("Error generating jwtToken", err.Error())
 		response.RespondWithError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	resp := &jwtResponse{
-		Jwt: jwtToken,
-	}
-	response.RespondWithSuccess(w, r, "success", resp, http.StatusOK)
+	response.RespondWithSuccess(w, r, "success", tokens, http.StatusOK)
 }
 
-func HandleSignup(key string, db *sql.DB) (string, func(http.ResponseWriter, *http.Request)) {
+func HandleSignup(ur *UserResources) (string, func(http.ResponseWriter, *http.Request)) {
 	return "/api/v1/user/signup", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			log.Println("Wrong request method")
 			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
 			return
 		}
-		userSignup(w, r, db, key)
+		userSignup(w, r, ur)
 	}
 }
 
-func HandleLogin(key string, db *sql.DB) (string, func(http.ResponseWriter, *http.Request)) {
+func HandleLogin(ur *UserResources) (string, func(http.ResponseWriter, *http.Request)) {
 	return "/api/v1/user/login", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodPost {
+		if r.Method != http.MethodPost {
 			log.Println("Wrong request method")
 			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
 			return
 		}
-		userLogin(w, r, db, key)
+		userLogin(w, r, ur)
 	}
 }
@@ -0,0 +1,101 @@
+package user
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"github.com/hitesh-goel/ekanek/internal/handlers/assets"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestResources(t *testing.T, db *sql.DB) *UserResources {
+	t.Helper()
+	keys, err := auth.NewKeySet("test-secret", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := auth.New(auth.Config{Keys: keys, AccessTTL: time.Minute, RefreshTTL: time.Hour}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &UserResources{
+		DB:          db,
+		Auth:        a,
+		ResetTTL:    time.Hour,
+		VerifyTTL:   time.Hour,
+		DeleteAfter: time.Hour,
+		Assets:      &assets.AssetResources{DTO: db},
+	}
+}
+
+// call posts body as JSON to the handler and decodes the data of the response into data, if given.
+func call(t *testing.T, h func(http.ResponseWriter, *http.Request), token string, body interface{}, data interface{}) int {
+	t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(b))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	if data != nil && w.Code == http.StatusOK {
+		if err = json.Unmarshal(w.Body.Bytes(), &struct {
+			Data interface{} `json:"data"`
+		}{Data: data}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code
+}
+
+// get sends a GET request with the token to the handler and returns the status.
+func get(h func(http.ResponseWriter, *http.Request), token string) int {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w.Code
+}
+
+// login returns the tokens of a session with the password every dbtest user has.
+func login(t *testing.T, ur *UserResources, email string) auth.Tokens {
+	t.Helper()
+	var tokens auth.Tokens
+	_, h := HandleLogin(ur)
+	code := call(t, h, "", CreateUser{Email: email, Password: "password"}, &tokens)
+	if code != http.StatusOK {
+		t.Fatalf("login status = %d, want %d", code, http.StatusOK)
+	}
+	return tokens
+}
+
+func TestLogin(t *testing.T) {
+	db := dbtest.New(t)
+	ur := newTestResources(t, db)
+	dbtest.User(t, db, "login@example.com")
+
+	path, h := HandleLogin(ur)
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	if code := call(t, h, "", CreateUser{Email: "login@example.com", Password: "wrong"}, nil); code != http.StatusForbidden {
+		t.Fatalf("wrong password status = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := call(t, h, "", CreateUser{Email: "login@example.com", Password: "password", Scopes: []string{"admin"}}, nil); code != http.StatusBadRequest {
+		t.Fatalf("unknown scope status = %d, want %d", code, http.StatusBadRequest)
+	}
+	if tokens := login(t, ur, "login@example.com"); tokens.Jwt == "" || tokens.RefreshToken == "" {
+		t.Fatalf("login returned %+v", tokens)
+	}
+}
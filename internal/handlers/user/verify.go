@@ -0,0 +1,185 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	"github.com/hitesh-goel/ekanek/internal/outbox"
+	"github.com/hitesh-goel/ekanek/internal/pkg/mail"
+	"github.com/hitesh-goel/ekanek/internal/queue"
+	"log"
+	"net/http"
+	netmail "net/mail"
+)
+
+const (
+	eventEmailVerified = "user.email_verified"
+
+	jobVerificationEmail = "user.verification_email"
+)
+
+var (
+	errEmailInvalid = errors.New("pass a valid email address")
+)
+
+type verifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type verificationEmailJob struct {
+	UserId string `json:"uid"`
+	Email  string `json:"email"`
+}
+
+// validEmail accepts a bare address like user@example.com.
+func validEmail(email string) bool {
+	addr, err := netmail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+// sendVerification emails a token confirming that the user owns the address.
+func sendVerification(ctx context.Context, ur *UserResources, uid string, email string) error {
+	token, err := newUserToken(ctx, ur.DB, uid, purposeEmailVerification, email, ur.VerifyTTL)
+	if err != nil {
+		return err
+	}
+	return ur.Mailer.Send(ctx, mail.Message{
+		To:      email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Please confirm that this is your email address.\n\n"+
+			"Your verification token is: %s\n\nIt expires in %s.", token, ur.VerifyTTL),
+	})
+}
+
+// sendVerificationEmail emails the verification token of a signup, unless the address was verified
+// or changed in the meantime.
+func sendVerificationEmail(ctx context.Context, j queue.Job, ur *UserResources) error {
+	var p verificationEmailJob
+	if err := j.Decode(&p); err != nil {
+		return err
+	}
+
+	var pending bool
+	var query = `select EXISTS(select 1 from users where uid = $1 and email = $2 and email_verified = false and deleted_at IS NULL)`
+	if err := ur.DB.QueryRowContext(ctx, query, p.UserId, p.Email).Scan(&pending); err != nil || !pending {
+		return err
+	}
+
+	err := sendVerification(ctx, ur, p.UserId, p.Email)
+	if errors.Is(err, errTokenLimit) {
+		log.Println("Verification email limit reached for user", p.UserId)
+		return nil
+	}
+	return err
+}
+
+// HandleVerifyEmail marks the address the token was sent to as verified.
+func HandleVerifyEmail(ur *UserResources) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/user/email/verify", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		verifyEmail(w, r, ur)
+	}
+}
+
+// HandleResendVerification sends a new verification token to the caller's address.
+func HandleResendVerification(ur *UserResources) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/user/email/resend", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		resendVerification(w, r, ur)
+	}
+}
+
+func verifyEmail(w http.ResponseWriter, r *http.Request, ur *UserResources) {
+	ctx := r.Context()
+	var req verifyEmailRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Token == "" {
+		response.RespondWithError(w, r, "pass a valid token", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := ur.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Error starting transaction", err.Error())
+		response.RespondWithError(w, r, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	uid, email, err := useUserToken(ctx, tx, purposeEmailVerification, req.Token)
+	if err == nil {
+		// The token only verifies the address it was sent to.
+		var query = `UPDATE users set email_verified = true where uid = $1 and email = $2 RETURNING uid`
+		err = tx.QueryRowContext(ctx, query, uid, email).Scan(&uid)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = errTokenInvalid
+		}
+	}
+	if errors.Is(err, errTokenInvalid) {
+		response.RespondWithError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		err = outbox.Write(ctx, tx, outbox.Event{
+			AggregateType: aggregateUser,
+			AggregateId:   uid,
+			UserID:        uid,
+			Type:          eventEmailVerified,
+			Data:          userEvent{UserId: uid},
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println("Error verifying email", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	response.RespondWithSuccess(w, r, "email verified", nil, http.StatusOK)
+}
+
+func resendVerification(w http.ResponseWriter, r *http.Request, ur *UserResources) {
+	ctx := r.Context()
+	uid, err := auth.GetUID(ctx)
+	if err != nil {
+		log.Println("Error accessing UserID: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	var email string
+	var verified bool
+	err = ur.DB.QueryRowContext(ctx, `select email, email_verified from users where uid = $1`, uid).Scan(&email, &verified)
+	if err != nil {
+		log.Println("Error selecting user", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	if verified {
+		response.RespondWithError(w, r, "email is already verified", http.StatusConflict)
+		return
+	}
+
+	err = sendVerification(ctx, ur, uid, email)
+	if errors.Is(err, errTokenLimit) {
+		response.RespondWithError(w, r, "too many verification emails, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		log.Println("Error sending verification email", err.Error())
+		response.RespondWithError(w, r, "unable to send the verification email", http.StatusInternalServerError)
+		return
+	}
+	response.RespondWithSuccess(w, r, "verification email sent", nil, http.StatusOK)
+}
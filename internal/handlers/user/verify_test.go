@@ -0,0 +1,46 @@
+package user
+
+import (
+	"context"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"github.com/hitesh-goel/ekanek/internal/queue"
+	"net/http"
+	"testing"
+)
+
+func TestSignupQueuesTheVerificationEmail(t *testing.T) {
+	db := dbtest.New(t)
+	ur := newTestResources(t, db)
+	sent := &mailbox{}
+	ur.Mailer = sent
+
+	_, signup := HandleSignup(ur)
+	if code := call(t, signup, "", CreateUser{Email: "signup@example.com", Password: "password"}, nil); code != http.StatusOK {
+		t.Fatalf("signup status = %d, want %d", code, http.StatusOK)
+	}
+	if len(sent.sent) != 0 {
+		t.Fatal("the email was sent while handling the request")
+	}
+
+	var j queue.Job
+	if err := db.QueryRow(`select payload from jobs where kind = $1`, jobVerificationEmail).Scan(&j.Payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendVerificationEmail(context.Background(), j, ur); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent.sent) != 1 || sent.sent[0].To != "signup@example.com" {
+		t.Fatalf("sent %+v, want a single email to the signup address", sent.sent)
+	}
+
+	// A verified address isn't mailed again.
+	if _, err := db.Exec(`UPDATE users set email_verified = true where email = $1`, "signup@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendVerificationEmail(context.Background(), j, ur); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent.sent) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(sent.sent))
+	}
+}
@@ -0,0 +1,240 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hitesh-goel/ekanek/internal/outbox"
+	"github.com/hitesh-goel/ekanek/internal/queue"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	jobDeliverWebhook = "webhook.deliver"
+
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+
+	// Deliveries are retried with the queue's backoff, 8 attempts span roughly 20 minutes.
+	deliveryMaxAttempts = 8
+	deliveryTimeout     = 10 * time.Second
+	maxResponseRead     = 64 << 10
+
+	HeaderEvent     = "X-Ekanek-Event"
+	HeaderDelivery  = "X-Ekanek-Delivery"
+	HeaderTimestamp = "X-Ekanek-Timestamp"
+	HeaderSignature = "X-Ekanek-Signature"
+)
+
+var (
+	errDeliveryStatus = errors.New("webhook endpoint responded with status")
+	errWebhookDeleted = errors.New("webhook was deleted")
+)
+
+// Querier is satisfied by *sql.DB and *sql.Tx, so deliveries and their jobs can be recorded together.
+type Querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Event is the JSON body posted to webhook endpoints.
+type Event struct {
+	Id        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+type deliveryJob struct {
+	DeliveryId string `json:"delivery_id"`
+}
+
+// RegisterJobs registers the webhook delivery handler on the queue.
+func RegisterJobs(q *queue.Queue, db *sql.DB) {
+	client := newClient(false)
+	q.Register(jobDeliverWebhook, func(ctx context.Context, j queue.Job) error {
+		return deliver(ctx, j, db, client)
+	})
+}
+
+// Sink turns outbox events into webhook deliveries.
+type Sink struct {
+	DB *sql.DB
+}
+
+func (Sink) Name() string {
+	return "webhooks"
+}
+
+// Publish records the deliveries for m. The outbox id is the event id, so receivers can
+// recognise an event which was relayed more than once.
+func (s Sink) Publish(ctx context.Context, m outbox.Message) error {
+	if !knownEvents[m.Type] || m.UserID == "" {
+		return nil
+	}
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	e := Event{Id: strconv.FormatInt(m.Id, 10), Type: m.Type, CreatedAt: m.CreatedAt.UTC(), Data: m.Payload}
+	if err = Emit(ctx, tx, m.UserID, e); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Emit records a delivery for every active webhook of the user subscribed to the event and
+// enqueues them. Nothing is sent inline, endpoints are called by the queue workers. An event is
+// recorded once per webhook, emitting it again, e.g. when the relay retries it, enqueues nothing.
+func Emit(ctx context.Context, db Querier, uid string, e Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	var query = `
+		INSERT INTO webhook_deliveries (webhook_id, event_id, event, payload)
+		SELECT id, $4, $2, $3 FROM webhooks WHERE uid = $1 AND is_active = true AND $2 = ANY(events)
+		ON CONFLICT (webhook_id, event_id) DO NOTHING
+		RETURNING id`
+	rows, err := db.QueryContext(ctx, query, uid, e.Type, payload, e.Id)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		_, err = queue.Enqueue(ctx, db, queue.Entry{
+			UserID:      uid,
+			Kind:        jobDeliverWebhook,
+			Payload:     deliveryJob{DeliveryId: id},
+			MaxAttempts: deliveryMaxAttempts,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sign returns the hex HMAC-SHA256 of "timestamp.payload" keyed with the webhook secret.
+// Receivers recompute it over the raw body and should reject stale timestamps to prevent replays.
+func Sign(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	_, _ = mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver posts a single delivery. Any response other than 2xx is an error, the queue retries it
+// with backoff and the delivery is marked failed once the job runs out of attempts.
+func deliver(ctx context.Context, j queue.Job, db *sql.DB, client *http.Client) error {
+	var p deliveryJob
+	if err := j.Decode(&p); err != nil {
+		return err
+	}
+
+	var event, status, url, secret string
+	var payload []byte
+	var active bool
+	var query = `
+		select d.event, d.payload, d.status, h.url, h.secret, h.is_active
+		from webhook_deliveries d join webhooks h on h.id = d.webhook_id
+		where d.id = $1`
+	err := db.QueryRowContext(ctx, query, p.DeliveryId).Scan(&event, &payload, &status, &url, &secret, &active)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if status != DeliveryPending {
+		return nil
+	}
+	if !active {
+		return finishDelivery(ctx, db, p.DeliveryId, DeliveryFailed, j.Attempts, sql.NullInt64{}, errWebhookDeleted)
+	}
+
+	code, err := send(ctx, client, url, secret, event, p.DeliveryId, payload)
+	if err == nil {
+		return finishDelivery(ctx, db, p.DeliveryId, DeliverySucceeded, j.Attempts, code, nil)
+	}
+
+	status = DeliveryPending
+	if j.Attempts >= j.MaxAttempts {
+		status = DeliveryFailed
+	}
+	if ferr := finishDelivery(ctx, db, p.DeliveryId, status, j.Attempts, code, err); ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// send posts the signed payload to the endpoint and returns the status it responded with.
+func send(ctx context.Context, client *http.Client, url string, secret string, event string, deliveryId string,
+	payload []byte) (sql.NullInt64, error) {
+	var code sql.NullInt64
+	ts := time.Now().Unix()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return code, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ekanek-webhooks/1.0")
+	req.Header.Set(HeaderEvent, event)
+	req.Header.Set(HeaderDelivery, deliveryId)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+	req.Header.Set(HeaderSignature, "sha256="+Sign(secret, ts, payload))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return code, err
+	}
+	// Drain a bit of the body so the connection can be reused.
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxResponseRead))
+	resp.Body.Close()
+	code = sql.NullInt64{Int64: int64(resp.StatusCode), Valid: true}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return code, fmt.Errorf("%v %d", errDeliveryStatus, resp.StatusCode)
+	}
+	return code, nil
+}
+
+func finishDelivery(ctx context.Context, db *sql.DB, id string, status string, attempts int, code sql.NullInt64, deliveryErr error) error {
+	var lastError sql.NullString
+	if deliveryErr != nil {
+		lastError = sql.NullString{String: deliveryErr.Error(), Valid: true}
+	}
+	var query = `
+		UPDATE webhook_deliveries
+		set status = $2, attempts = $3, response_status = $4, last_error = $5,
+		    delivered_at = CASE WHEN $2 = 'succeeded' THEN NOW() END
+		where id = $1`
+	_, err := db.ExecContext(ctx, query, id, status, attempts, code, lastError)
+	return err
+}
@@ -0,0 +1,238 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"github.com/hitesh-goel/ekanek/internal/queue"
+	"github.com/lib/pq"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSendSignsPayload(t *testing.T) {
+	payload := []byte(`{"id":"1","type":"asset.uploaded"}`)
+	var got *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	code, err := send(context.Background(), newClient(true), srv.URL, "whsec_test", EventAssetUploaded, "d1", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !code.Valid || code.Int64 != http.StatusNoContent {
+		t.Fatalf("status = %v, want 204", code)
+	}
+	if string(body) != string(payload) {
+		t.Fatalf("body = %s, want %s", body, payload)
+	}
+	if got.Header.Get(HeaderEvent) != EventAssetUploaded || got.Header.Get(HeaderDelivery) != "d1" {
+		t.Fatalf("unexpected headers %v", got.Header)
+	}
+
+	ts, err := strconv.ParseInt(got.Header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, []byte("whsec_test"))
+	mac.Write([]byte(strconv.FormatInt(ts, 10) + "."))
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if sig := got.Header.Get(HeaderSignature); sig != want {
+		t.Fatalf("signature = %s, want %s", sig, want)
+	}
+}
+
+func TestSendRefusesPrivateAddresses(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer srv.Close()
+
+	code, err := send(context.Background(), newClient(false), srv.URL, "whsec_test", EventAssetUploaded, "d1", []byte(`{}`))
+	if err == nil || !strings.Contains(err.Error(), errAddressBlocked.Error()) {
+		t.Fatalf("err = %v, want %v", err, errAddressBlocked)
+	}
+	if code.Valid || atomic.LoadInt32(&calls) != 0 {
+		t.Fatal("the request reached the receiver")
+	}
+}
+
+func TestSendDoesNotFollowRedirects(t *testing.T) {
+	var calls int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer target.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusTemporaryRedirect)
+	}))
+	defer srv.Close()
+
+	code, err := send(context.Background(), newClient(true), srv.URL, "whsec_test", EventAssetUploaded, "d1", []byte(`{}`))
+	if err == nil || code.Int64 != http.StatusTemporaryRedirect {
+		t.Fatalf("status = %v, err = %v, want a failed 307", code, err)
+	}
+	if atomic.LoadInt32(&calls) != 0 {
+		t.Fatal("the redirect was followed")
+	}
+}
+
+func TestBlockedIP(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1":       true,
+		"10.1.2.3":        true,
+		"172.20.0.5":      true,
+		"192.168.1.1":     true,
+		"169.254.169.254": true,
+		"100.64.0.1":      true,
+		"0.0.0.0":         true,
+		"::1":             true,
+		"fd00::1":         true,
+		"fe80::1":         true,
+		"::ffff:10.0.0.1": true,
+		"93.184.216.34":   false,
+		"2606:4700::1111": false,
+	}
+	for addr, want := range tests {
+		if got := blockedIP(net.ParseIP(addr)); got != want {
+			t.Errorf("blockedIP(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestValidateRejectsLocalURLs(t *testing.T) {
+	for _, u := range []string{"http://localhost/hook", "http://127.0.0.1:8080/hook", "http://169.254.169.254/latest",
+		"http://[::1]/hook", "ftp://example.com/hook"} {
+		h := Webhook{URL: u, Events: []string{EventAssetUploaded}}
+		if err := h.validate(); err == nil {
+			t.Errorf("validate(%s) succeeded", u)
+		}
+	}
+	h := Webhook{URL: "https://example.com/hook", Events: []string{EventAssetUploaded}}
+	if err := h.validate(); err != nil {
+		t.Errorf("validate(%s) = %v", h.URL, err)
+	}
+}
+
+func TestDeliverRetriesUntilAttemptsRunOut(t *testing.T) {
+	db := dbtest.New(t)
+	ctx := context.Background()
+	uid := dbtest.User(t, db, "hooks@example.com")
+
+	var calls, failures int32
+	atomic.StoreInt32(&failures, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	newDelivery := func() queue.Job {
+		var hookId, deliveryId string
+		err := db.QueryRow(`INSERT INTO webhooks (uid, url, secret, events) VALUES ($1, $2, 'whsec_test', $3) RETURNING id`,
+			uid, srv.URL, pq.Array([]string{EventAssetUploaded})).Scan(&hookId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = Emit(ctx, db, uid, Event{Id: "1", Type: EventAssetUploaded, CreatedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		err = db.QueryRow(`select id from webhook_deliveries where webhook_id = $1`, hookId).Scan(&deliveryId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, _ := json.Marshal(deliveryJob{DeliveryId: deliveryId})
+		return queue.Job{Kind: jobDeliverWebhook, Payload: payload, Attempts: 1, MaxAttempts: 2}
+	}
+	assertDelivery := func(j queue.Job, wantStatus string, wantCode int64) {
+		t.Helper()
+		var p deliveryJob
+		_ = j.Decode(&p)
+		var status string
+		var code sql.NullInt64
+		err := db.QueryRow(`select status, response_status from webhook_deliveries where id = $1`, p.DeliveryId).Scan(&status, &code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != wantStatus || code.Int64 != wantCode {
+			t.Fatalf("delivery is %s with %d, want %s with %d", status, code.Int64, wantStatus, wantCode)
+		}
+	}
+	client := newClient(true)
+
+	j := newDelivery()
+	if err := deliver(ctx, j, db, client); err == nil {
+		t.Fatal("a 500 response didn't fail the attempt")
+	}
+	assertDelivery(j, DeliveryPending, http.StatusInternalServerError)
+	j.Attempts++
+	if err := deliver(ctx, j, db, client); err != nil {
+		t.Fatal(err)
+	}
+	assertDelivery(j, DeliverySucceeded, http.StatusOK)
+	// A delivered event isn't posted again when its job runs once more.
+	j.Attempts++
+	if err := deliver(ctx, j, db, client); err != nil || atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("err = %v, calls = %d, want the delivery to be skipped", err, calls)
+	}
+
+	atomic.StoreInt32(&failures, 2)
+	j = newDelivery()
+	_ = deliver(ctx, j, db, client)
+	j.Attempts++
+	if err := deliver(ctx, j, db, client); err == nil {
+		t.Fatal("a 500 response didn't fail the attempt")
+	}
+	assertDelivery(j, DeliveryFailed, http.StatusInternalServerError)
+}
+
+// The relay publishes an event again when marking it published fails, or another sink failed.
+func TestEmitRecordsEventsOnce(t *testing.T) {
+	db := dbtest.New(t)
+	ctx := context.Background()
+	uid := dbtest.User(t, db, "emit@example.com")
+	var hookId string
+	err := db.QueryRow(`INSERT INTO webhooks (uid, url, secret, events) VALUES ($1, 'https://example.com', 'whsec_test', $2) RETURNING id`,
+		uid, pq.Array([]string{EventAssetUploaded})).Scan(&hookId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"1", "1", "2"} {
+		if err = Emit(ctx, db, uid, Event{Id: id, Type: EventAssetUploaded, CreatedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var deliveries, jobs int
+	if err = db.QueryRow(`select COUNT(*) from webhook_deliveries where webhook_id = $1`, hookId).Scan(&deliveries); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.QueryRow(`select COUNT(*) from jobs where uid = $1 and kind = $2`, uid, jobDeliverWebhook).Scan(&jobs); err != nil {
+		t.Fatal(err)
+	}
+	if deliveries != 2 || jobs != 2 {
+		t.Fatalf("%d deliveries and %d jobs, want one of each per event", deliveries, jobs)
+	}
+}
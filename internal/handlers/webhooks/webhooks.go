@@ -0,0 +1,308 @@
+package webhooks
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hitesh-goel/ekanek/internal/handlers/auth"
+	"github.com/hitesh-goel/ekanek/internal/handlers/response"
+	"github.com/lib/pq"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EventAssetUploaded   = "asset.uploaded"
+	EventAssetMadePublic = "asset.made_public"
+	EventAssetDeleted    = "asset.deleted"
+	EventAssetDownloaded = "asset.downloaded"
+
+	maxWebhooks          = 20
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 500
+)
+
+var (
+	errWebhookInvalid = errors.New("invalid webhook")
+
+	knownEvents = map[string]bool{
+		EventAssetUploaded:   true,
+		EventAssetMadePublic: true,
+		EventAssetDeleted:    true,
+		EventAssetDownloaded: true,
+	}
+)
+
+type Webhook struct {
+	Id        string    `json:"id" db:"id"`
+	URL       string    `json:"url" db:"url"`
+	Events    []string  `json:"events" db:"events"`
+	Secret    string    `json:"secret,omitempty" db:"secret"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+type Delivery struct {
+	Id             string          `json:"id" db:"id"`
+	Event          string          `json:"event" db:"event"`
+	Payload        json.RawMessage `json:"payload" db:"payload"`
+	Status         string          `json:"status" db:"status"`
+	Attempts       int             `json:"attempts" db:"attempts"`
+	ResponseStatus *int            `json:"response_status" db:"response_status"`
+	LastError      *string         `json:"last_error,omitempty" db:"last_error"`
+	DeliveredAt    *time.Time      `json:"delivered_at" db:"delivered_at"`
+	CreatedAt      time.Time       `json:"created_at" db:"created_at"`
+}
+
+func HandleCreateWebhook(db *sql.DB) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/webhook/create", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		createWebhook(w, r, db)
+	}
+}
+
+func HandleListWebhooks(db *sql.DB) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/webhook/list", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		listWebhooks(w, r, db)
+	}
+}
+
+func HandleDeleteWebhook(db *sql.DB) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/webhook/delete", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		deleteWebhook(w, r, db)
+	}
+}
+
+func HandleWebhookDeliveries(db *sql.DB) (string, func(http.ResponseWriter, *http.Request)) {
+	return "/api/v1/webhook/deliveries", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			response.RespondWithError(w, r, "wrong http method", http.StatusMethodNotAllowed)
+			return
+		}
+		webhookDeliveries(w, r, db)
+	}
+}
+
+func (h *Webhook) validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%v: url must be an absolute http(s) url", errWebhookInvalid)
+	}
+	// Names are checked again when delivering, they may resolve to a different address by then.
+	ip := net.ParseIP(u.Hostname())
+	if (ip != nil && blockedIP(ip)) || strings.EqualFold(u.Hostname(), "localhost") {
+		return fmt.Errorf("%v: url must not point to a private or local address", errWebhookInvalid)
+	}
+	if len(h.Events) == 0 {
+		return fmt.Errorf("%v: pass at least one event", errWebhookInvalid)
+	}
+	for _, e := range h.Events {
+		if !knownEvents[e] {
+			return fmt.Errorf("%v: unknown event %q", errWebhookInvalid, e)
+		}
+	}
+	return nil
+}
+
+// newSecret returns the key deliveries are signed with, it is only shown to the user once.
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+func createWebhook(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	ctx := r.Context()
+	var hook Webhook
+	err := json.NewDecoder(r.Body).Decode(&hook)
+	if err != nil {
+		log.Println("Error decoding json data", err.Error())
+		response.RespondWithError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = hook.validate(); err != nil {
+		response.RespondWithError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	uid, err := auth.GetUID(ctx)
+	if err != nil {
+		log.Println("Error accessing UserID: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	var count int
+	err = db.QueryRowContext(ctx, `select COUNT(*) from webhooks where uid = $1 and is_active = true`, uid).Scan(&count)
+	if err != nil {
+		log.Println("Error counting webhooks", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	if count >= maxWebhooks {
+		response.RespondWithError(w, r, fmt.Sprintf("at most %d webhooks can be registered", maxWebhooks), http.StatusConflict)
+		return
+	}
+
+	hook.Secret, err = newSecret()
+	if err != nil {
+		log.Println("Error generating webhook secret", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	var query = `INSERT INTO webhooks (uid, url, secret, events) VALUES ($1, $2, $3, $4) RETURNING id, created_at`
+	err = db.QueryRowContext(ctx, query, uid, hook.URL, hook.Secret, pq.Array(hook.Events)).Scan(&hook.Id, &hook.CreatedAt)
+	if err != nil {
+		log.Println("Error creating webhook", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	response.RespondWithSuccess(w, r, "success", &hook, http.StatusOK)
+}
+
+func listWebhooks(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	uid, err := auth.GetUID(r.Context())
+	if err != nil {
+		log.Println("Error accessing UserID: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	var query = `select id, url, events, created_at from webhooks where uid = $1 and is_active = true order by created_at`
+	rows, err := db.QueryContext(r.Context(), query, uid)
+	if err != nil {
+		log.Println("Error selecting webhooks", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		var h Webhook
+		if err = rows.Scan(&h.Id, &h.URL, pq.Array(&h.Events), &h.CreatedAt); err != nil {
+			log.Println("Error while scanning webhook rows: ", err.Error())
+			response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+			return
+		}
+		hooks = append(hooks, h)
+	}
+	response.RespondWithSuccess(w, r, "success", hooks, http.StatusOK)
+}
+
+// deleteWebhook deactivates the webhook, its delivery log is kept and pending deliveries are dropped.
+func deleteWebhook(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var hook Webhook
+	err := json.NewDecoder(r.Body).Decode(&hook)
+	if err != nil {
+		log.Println("Error decoding json data", err.Error())
+		response.RespondWithError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	uid, err := auth.GetUID(r.Context())
+	if err != nil {
+		log.Println("Error accessing UserID: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	var query = `UPDATE webhooks set is_active = false where id = $1 and uid = $2 and is_active = true RETURNING id`
+	err = db.QueryRowContext(r.Context(), query, hook.Id, uid).Scan(&hook.Id)
+	if errors.Is(err, sql.ErrNoRows) {
+		response.RespondWithError(w, r, "webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Error deleting webhook", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	response.RespondWithSuccess(w, r, "success", "", http.StatusOK)
+}
+
+// webhookDeliveries returns the most recent deliveries of one of the caller's webhooks.
+func webhookDeliveries(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	ctx := r.Context()
+	queryValues := r.URL.Query()
+	webhookId := queryValues.Get("webhook_id")
+	if webhookId == "" {
+		response.RespondWithError(w, r, "pass valid webhook_id in query param", http.StatusBadRequest)
+		return
+	}
+	limit := defaultDeliveryLimit
+	if l := queryValues.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxDeliveryLimit {
+			response.RespondWithError(w, r, "limit must be between 1 and "+strconv.Itoa(maxDeliveryLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	uid, err := auth.GetUID(ctx)
+	if err != nil {
+		log.Println("Error accessing UserID: ", err.Error())
+		response.RespondWithError(w, r, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	var owner string
+	err = db.QueryRowContext(ctx, `select uid from webhooks where id = $1`, webhookId).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && owner != uid) {
+		response.RespondWithError(w, r, "webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Database error", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	var query = `
+		select id, event, payload, status, attempts, response_status, last_error, delivered_at, created_at
+		from webhook_deliveries where webhook_id = $1
+		order by created_at desc limit $2`
+	rows, err := db.QueryContext(ctx, query, webhookId, limit)
+	if err != nil {
+		log.Println("Error selecting webhook deliveries", err.Error())
+		response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+		var d Delivery
+		err = rows.Scan(&d.Id, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.ResponseStatus, &d.LastError,
+			&d.DeliveredAt, &d.CreatedAt)
+		if err != nil {
+			log.Println("Error while scanning delivery rows: ", err.Error())
+			response.RespondWithError(w, r, "database error", http.StatusInternalServerError)
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+	response.RespondWithSuccess(w, r, "success", deliveries, http.StatusOK)
+}
@@ -0,0 +1,279 @@
+// Package outbox records domain events in the transaction of the change they describe and
+// relays them to sinks with at-least-once delivery, in order per aggregate.
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"log"
+	"time"
+)
+
+const (
+	// relayLockKey is the advisory lock which makes sure only one relay publishes at a time.
+	relayLockKey = 0x6f7574626f78
+
+	baseBackoff = time.Second
+	maxBackoff  = 5 * time.Minute
+
+	// pruneInterval is how often published events past their retention are deleted.
+	pruneInterval = time.Hour
+)
+
+var (
+	errConfigInvalid = errors.New("invalid outbox relay config")
+)
+
+// Execer is satisfied by both *sql.DB and *sql.Tx, events should be written in the
+// transaction of the change they describe.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Event describes a change to an aggregate, e.g. an asset or a user.
+type Event struct {
+	AggregateType string
+	AggregateId   string
+	UserID        string
+	Type          string
+	Data          interface{}
+}
+
+// Message is a recorded event as handed to sinks. Seq numbers the events of an aggregate from 1 in the
+// order they were committed, consumers can use it to drop duplicates.
+type Message struct {
+	Id            int64           `json:"id"`
+	AggregateType string          `json:"aggregate_type"`
+	AggregateId   string          `json:"aggregate_id"`
+	Seq           int64           `json:"seq"`
+	UserID        string          `json:"uid,omitempty"`
+	Type          string          `json:"type"`
+	Payload       json.RawMessage `json:"payload"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+// Sink publishes messages somewhere. Publish may be called again for a message it already
+// accepted, so sinks have to tolerate duplicates.
+type Sink interface {
+	Name() string
+	Publish(ctx context.Context, m Message) error
+}
+
+// aggregate identifies the events which are published in order.
+type aggregate struct {
+	Type string
+	Id   string
+}
+
+// Write records an event with the next sequence number of its aggregate. The aggregate's row stays locked
+// until the transaction ends, so its events are committed in the order of their sequence numbers.
+func Write(ctx context.Context, db Execer, e Event) error {
+	payload, err := json.Marshal(e.Data)
+	if err != nil {
+		return err
+	}
+	var uid sql.NullString
+	if e.UserID != "" {
+		uid = sql.NullString{String: e.UserID, Valid: true}
+	}
+	var query = `
+		WITH aggregate AS (
+			INSERT INTO outbox_aggregates (aggregate_type, aggregate_id, last_seq) VALUES ($1, $2, 1)
+			ON CONFLICT (aggregate_type, aggregate_id) DO UPDATE SET last_seq = outbox_aggregates.last_seq + 1
+			RETURNING last_seq
+		)
+		INSERT INTO outbox (aggregate_type, aggregate_id, seq, uid, type, payload)
+		SELECT $1, $2, last_seq, $3::uuid, $4::text, $5::jsonb FROM aggregate`
+	_, err = db.ExecContext(ctx, query, e.AggregateType, e.AggregateId, uid, e.Type, payload)
+	return err
+}
+
+// Config represents the configuration necessary for the relay.
+type Config struct {
+	PollInterval time.Duration
+	BatchSize    int
+	// Retention is how long published events are kept, e.g. for activity streams to catch up
+	// from. They are kept forever when it is 0.
+	Retention time.Duration
+}
+
+func (c Config) isValid() bool {
+	return c.PollInterval > 0 && c.BatchSize > 0 && c.Retention >= 0
+}
+
+// Relay publishes recorded events to its sinks.
+type Relay struct {
+	db    *sql.DB
+	c     Config
+	sinks []Sink
+}
+
+// NewRelay initializes a relay.
+func NewRelay(c Config, db *sql.DB, sinks ...Sink) (*Relay, error) {
+	if !c.isValid() {
+		return nil, errConfigInvalid
+	}
+	return &Relay{db: db, c: c, sinks: sinks}, nil
+}
+
+// Run relays events until ctx is cancelled.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.c.PollInterval)
+	defer ticker.Stop()
+	var pruned time.Time
+	for {
+		if r.c.Retention > 0 && time.Since(pruned) >= pruneInterval {
+			if err := r.prune(ctx); err != nil && ctx.Err() == nil {
+				log.Println("Error pruning outbox events: ", err.Error())
+			}
+			pruned = time.Now()
+		}
+		// Keep going while full batches are published, there is more waiting.
+		for {
+			n, err := r.relay(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Println("Error relaying outbox events: ", err.Error())
+			}
+			if err != nil || n < r.c.BatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relay publishes one batch and returns the number of events handled. The events of an aggregate are
+// published in the order of their sequence numbers, from the aggregate's cursor on. A failed event holds
+// back the later events of its aggregate until it is published, other aggregates carry on. The batch is
+// relayed while holding an advisory lock, so running several instances doesn't break the ordering.
+func (r *Relay) relay(ctx context.Context) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err = tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, relayLockKey).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, nil
+	}
+
+	// Aggregates whose next event is backing off are skipped as a whole.
+	var query = `
+		SELECT o.id, o.aggregate_type, o.aggregate_id, o.seq, COALESCE(o.uid::text, ''), o.type, o.payload, o.created_at,
+		       o.attempts, a.published_seq
+		FROM outbox o
+		JOIN outbox_aggregates a ON a.aggregate_type = o.aggregate_type AND a.aggregate_id = o.aggregate_id
+		WHERE o.published_at IS NULL AND o.seq > a.published_seq
+		AND NOT EXISTS (
+			SELECT 1 FROM outbox b
+			WHERE b.aggregate_type = o.aggregate_type AND b.aggregate_id = o.aggregate_id
+			  AND b.seq > a.published_seq AND b.seq <= o.seq AND b.available_at > NOW()
+		)
+		ORDER BY o.id LIMIT $1`
+	rows, err := tx.QueryContext(ctx, query, r.c.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	type pending struct {
+		Message
+		attempts int
+	}
+	var batch []pending
+	// cursor is the sequence number last published per aggregate.
+	cursor := make(map[aggregate]int64)
+	for rows.Next() {
+		var p pending
+		var published int64
+		err = rows.Scan(&p.Id, &p.AggregateType, &p.AggregateId, &p.Seq, &p.UserID, &p.Type, &p.Payload, &p.CreatedAt,
+			&p.attempts, &published)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, p)
+		cursor[aggregate{Type: p.AggregateType, Id: p.AggregateId}] = published
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var published []int64
+	held := make(map[aggregate]bool)
+	advanced := make(map[aggregate]bool)
+	for _, p := range batch {
+		key := aggregate{Type: p.AggregateType, Id: p.AggregateId}
+		// Sequence numbers are committed in order, an event which doesn't follow the cursor waits for
+		// the one before it.
+		if held[key] || p.Seq != cursor[key]+1 {
+			continue
+		}
+		if perr := r.publish(ctx, p.Message); perr != nil {
+			log.Println("Error publishing outbox event", p.Id, p.Type, perr.Error())
+			_, err = tx.ExecContext(ctx, `UPDATE outbox SET attempts = attempts + 1, last_error = $2, available_at = $3 WHERE id = $1`,
+				p.Id, perr.Error(), time.Now().Add(backoff(p.attempts+1)))
+			if err != nil {
+				return 0, err
+			}
+			held[key] = true
+			continue
+		}
+		published = append(published, p.Id)
+		cursor[key] = p.Seq
+		advanced[key] = true
+	}
+
+	if len(published) > 0 {
+		_, err = tx.ExecContext(ctx, `UPDATE outbox SET published_at = NOW() WHERE id = ANY($1)`, pq.Array(published))
+		if err != nil {
+			return 0, err
+		}
+	}
+	for key := range advanced {
+		query = `UPDATE outbox_aggregates SET published_seq = $3 WHERE aggregate_type = $1 AND aggregate_id = $2`
+		if _, err = tx.ExecContext(ctx, query, key.Type, key.Id, cursor[key]); err != nil {
+			return 0, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(batch), nil
+}
+
+// prune deletes the events published longer than the retention ago.
+func (r *Relay) prune(ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM outbox WHERE published_at < $1`, time.Now().Add(-r.c.Retention))
+	return err
+}
+
+// publish hands the message to every sink, it is retried on all of them if one fails.
+func (r *Relay) publish(ctx context.Context, m Message) error {
+	for _, s := range r.sinks {
+		if err := s.Publish(ctx, m); err != nil {
+			return fmt.Errorf("%s: %w", s.Name(), err)
+		}
+	}
+	return nil
+}
+
+// backoff doubles the delay on every attempt.
+func backoff(attempts int) time.Duration {
+	d := baseBackoff << uint(attempts-1)
+	if d <= 0 || d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
@@ -0,0 +1,279 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a sink remembering what it was handed, fail decides whether a message is rejected.
+type recorder struct {
+	mu   sync.Mutex
+	msgs []Message
+	fail func(m Message) bool
+}
+
+func (*recorder) Name() string {
+	return "recorder"
+}
+
+func (s *recorder) Publish(_ context.Context, m Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != nil && s.fail(m) {
+		return errors.New("unavailable")
+	}
+	s.msgs = append(s.msgs, m)
+	return nil
+}
+
+// seqs returns the sequence numbers received per aggregate id.
+func (s *recorder) seqs() map[string][]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	got := make(map[string][]int64)
+	for _, m := range s.msgs {
+		got[m.AggregateId] = append(got[m.AggregateId], m.Seq)
+	}
+	return got
+}
+
+func newTestRelay(t *testing.T, db *sql.DB, s Sink) *Relay {
+	t.Helper()
+	r, err := NewRelay(Config{PollInterval: time.Second, BatchSize: 100, Retention: time.Hour}, db, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func write(t *testing.T, db Execer, aggregateId string) {
+	t.Helper()
+	err := Write(context.Background(), db, Event{AggregateType: "asset", AggregateId: aggregateId, Type: "asset.tagged", Data: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func relay(t *testing.T, r *Relay) {
+	t.Helper()
+	if _, err := r.relay(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteNumbersEventsPerAggregate(t *testing.T) {
+	db := dbtest.New(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tx, err := db.Begin()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer tx.Rollback()
+			err = Write(context.Background(), tx, Event{AggregateType: "asset", AggregateId: "a", Type: "asset.tagged"})
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	write(t, db, "b")
+
+	rows, err := db.Query(`SELECT aggregate_id, seq FROM outbox ORDER BY aggregate_id, seq`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := make(map[string][]int64)
+	for rows.Next() {
+		var id string
+		var seq int64
+		if err = rows.Scan(&id, &seq); err != nil {
+			t.Fatal(err)
+		}
+		got[id] = append(got[id], seq)
+	}
+	if want := "map[a:[1 2 3 4 5 6 7 8 9 10] b:[1]]"; fmt.Sprint(got) != want {
+		t.Fatalf("sequence numbers %v, want %s", got, want)
+	}
+}
+
+func TestRelayPublishesInCommitOrder(t *testing.T) {
+	db := dbtest.New(t)
+	sink := &recorder{}
+	r := newTestRelay(t, db, sink)
+
+	// The first event of a is written but not committed yet, the second one waits for it.
+	first, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Rollback()
+	write(t, first, "a")
+
+	second := make(chan error, 1)
+	go func() {
+		tx, err := db.Begin()
+		if err != nil {
+			second <- err
+			return
+		}
+		defer tx.Rollback()
+		err = Write(context.Background(), tx, Event{AggregateType: "asset", AggregateId: "a", Type: "asset.moved"})
+		if err == nil {
+			err = tx.Commit()
+		}
+		second <- err
+	}()
+	write(t, db, "b")
+
+	time.Sleep(100 * time.Millisecond)
+	relay(t, r)
+	if got := fmt.Sprint(sink.seqs()); got != "map[b:[1]]" {
+		t.Fatalf("published %s before the first event of a was committed, want only b", got)
+	}
+
+	if err = first.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-second; err != nil {
+		t.Fatal(err)
+	}
+	relay(t, r)
+	if got := fmt.Sprint(sink.seqs()); got != "map[a:[1 2] b:[1]]" {
+		t.Fatalf("published %s, want a in order", got)
+	}
+	var typ string
+	if err = db.QueryRow(`SELECT type FROM outbox WHERE aggregate_id = 'a' AND seq = 2`).Scan(&typ); err != nil || typ != "asset.moved" {
+		t.Fatalf("the second event of a is %q, err = %v, want asset.moved", typ, err)
+	}
+}
+
+func TestRelayRetriesFailedEvents(t *testing.T) {
+	db := dbtest.New(t)
+	failures := 2
+	sink := &recorder{fail: func(m Message) bool {
+		if m.AggregateId == "a" && m.Seq == 1 && failures > 0 {
+			failures--
+			return true
+		}
+		return false
+	}}
+	r := newTestRelay(t, db, sink)
+	write(t, db, "a")
+	write(t, db, "a")
+	write(t, db, "b")
+
+	for i := 0; i < 3; i++ {
+		relay(t, r)
+		// Skip the backoff.
+		if _, err := db.Exec(`UPDATE outbox SET available_at = NOW() WHERE published_at IS NULL`); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := sink.seqs(); fmt.Sprint(got) != "map[a:[1 2] b:[1]]" {
+		t.Fatalf("published %v, want every event once and a in order", got)
+	}
+	var attempts int
+	if err := db.QueryRow(`SELECT attempts FROM outbox WHERE aggregate_id = 'a' AND seq = 1`).Scan(&attempts); err != nil || attempts != 2 {
+		t.Fatalf("attempts = %d, err = %v, want 2", attempts, err)
+	}
+	var cursor int64
+	if err := db.QueryRow(`SELECT published_seq FROM outbox_aggregates WHERE aggregate_id = 'a'`).Scan(&cursor); err != nil || cursor != 2 {
+		t.Fatalf("published_seq = %d, err = %v, want 2", cursor, err)
+	}
+}
+
+func TestRelayRepublishesWhenMarkingFails(t *testing.T) {
+	db := dbtest.New(t)
+	sink := &recorder{}
+	r := newTestRelay(t, db, sink)
+	write(t, db, "a")
+
+	// The sinks got the event but the relay's transaction never commits, e.g. because the process died.
+	ctx, cancel := context.WithCancel(context.Background())
+	r.sinks = []Sink{sink, cancelSink(cancel)}
+	if _, err := r.relay(ctx); err == nil {
+		t.Fatal("the relay committed with a cancelled context")
+	}
+
+	r.sinks = []Sink{sink}
+	relay(t, r)
+	if got := fmt.Sprint(sink.seqs()); got != "map[a:[1 1]]" {
+		t.Fatalf("published %s, want the event again", got)
+	}
+}
+
+// cancelSink cancels the relay's context once it published.
+type cancelSink context.CancelFunc
+
+func (cancelSink) Name() string {
+	return "cancel"
+}
+
+func (s cancelSink) Publish(context.Context, Message) error {
+	s()
+	return nil
+}
+
+func TestRelayPrunesPublishedEvents(t *testing.T) {
+	db := dbtest.New(t)
+	r := newTestRelay(t, db, &recorder{})
+	write(t, db, "a")
+	write(t, db, "a")
+	relay(t, r)
+	write(t, db, "a")
+	if _, err := db.Exec(`UPDATE outbox SET published_at = NOW() - INTERVAL '2 hours' WHERE seq = 1`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.prune(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var seqs []int64
+	rows, err := db.Query(`SELECT seq FROM outbox ORDER BY seq`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var seq int64
+		if err = rows.Scan(&seq); err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, seq)
+	}
+	if fmt.Sprint(seqs) != "[2 3]" {
+		t.Fatalf("kept %v, want the recently published and the pending event", seqs)
+	}
+
+	// Numbering carries on after pruning.
+	write(t, db, "a")
+	var last int64
+	if err = db.QueryRow(`SELECT MAX(seq) FROM outbox`).Scan(&last); err != nil || last != 4 {
+		t.Fatalf("last seq = %d, err = %v, want 4", last, err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 9: 256 * time.Second, 10: maxBackoff, 80: maxBackoff} {
+		if got := backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
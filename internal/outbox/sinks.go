@@ -0,0 +1,57 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/hitesh-goel/ekanek/internal/pkg/bus"
+	"io"
+	"log"
+	"sync"
+)
+
+// NDJSON writes every message as a line of JSON, e.g. to stdout for a log shipper.
+type NDJSON struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewNDJSON returns a sink writing to w.
+func NewNDJSON(w io.Writer) *NDJSON {
+	return &NDJSON{enc: json.NewEncoder(w)}
+}
+
+func (*NDJSON) Name() string {
+	return "ndjson"
+}
+
+// Publish writes m as a single line.
+func (s *NDJSON) Publish(_ context.Context, m Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(m)
+}
+
+// Bus publishes messages on an in-process bus, with the event type as the subject.
+type Bus struct {
+	B *bus.Bus
+}
+
+func (Bus) Name() string {
+	return "bus"
+}
+
+// Publish sends m to the subscribers of its event type. Subscribers which fall behind miss it, the
+// bus is best effort and retrying the message would hold back the other sinks and subscribers.
+func (s Bus) Publish(_ context.Context, m Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	err = s.B.Publish(m.Type, data)
+	if errors.Is(err, bus.ErrSlowConsumer) {
+		log.Println("Bus subscriber missed outbox event", m.Id, m.Type)
+		return nil
+	}
+	return err
+}
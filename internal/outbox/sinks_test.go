@@ -0,0 +1,32 @@
+package outbox
+
+import (
+	"context"
+	"github.com/hitesh-goel/ekanek/internal/pkg/bus"
+	"testing"
+)
+
+// A full subscriber buffer doesn't fail the message, it would be retried on every sink.
+func TestBusSinkSkipsSlowSubscribers(t *testing.T) {
+	b := bus.New()
+	slow, err := b.Subscribe("asset.*", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast, err := b.Subscribe("asset.*", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Bus{B: b}
+	for id := int64(1); id <= 2; id++ {
+		if err = s.Publish(context.Background(), Message{Id: id, Type: "asset.tagged"}); err != nil {
+			t.Fatalf("message %d: %v", id, err)
+		}
+	}
+	if len(slow.C) != 1 || len(fast.C) != 2 {
+		t.Fatalf("buffered %d and %d messages, want 1 and 2", len(slow.C), len(fast.C))
+	}
+	if err = s.Publish(context.Background(), Message{Type: "asset..tagged"}); err == nil {
+		t.Fatal("an invalid subject was published")
+	}
+}
@@ -1,14 +1,21 @@
 package aws
 
 import (
+	"errors"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
 )
 
+// ErrNotFound is returned when the requested object does not exist in the bucket.
+var ErrNotFound = errors.New("object not found")
+
 func SaveToS3(key string, file io.Reader, s *session.Session) (string, error) {
 	uploader := s3manager.NewUploader(s)
 	result, err := uploader.Upload(&s3manager.UploadInput{
@@ -31,3 +38,81 @@ func DownloadFromS3(key string, file *os.File, s *session.Session) error {
 	})
 	return err
 }
+
+// GetFromS3 returns a streaming reader for the object body, the caller must close it.
+func GetFromS3(key string, s *session.Session) (io.ReadCloser, error) {
+	out, err := s3.New(s).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String("ekanek"),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return out.Body, nil
+}
+
+func notFound(err error) error {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && (reqErr.Code() == s3.ErrCodeNoSuchKey || reqErr.StatusCode() == http.StatusNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// DeleteFromS3 removes a single object, deleting a missing object is not an error.
+func DeleteFromS3(key string, s *session.Session) error {
+	_, err := s3.New(s).DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String("ekanek"),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// DeletePrefixFromS3 removes every object whose key starts with prefix.
+func DeletePrefixFromS3(prefix string, s *session.Session) error {
+	svc := s3.New(s)
+	var objects []*s3.ObjectIdentifier
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String("ekanek"),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range page.Contents {
+			objects = append(objects, &s3.ObjectIdentifier{Key: o.Key})
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	// DeleteObjects accepts at most 1000 keys per request.
+	for len(objects) > 0 {
+		n := len(objects)
+		if n > 1000 {
+			n = 1000
+		}
+		_, err = svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String("ekanek"),
+			Delete: &s3.Delete{Objects: objects[:n], Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+		objects = objects[n:]
+	}
+	return nil
+}
+
+// MoveInS3 copies an object to a new key within the bucket and removes the original.
+func MoveInS3(src string, dst string, s *session.Session) error {
+	svc := s3.New(s)
+	_, err := svc.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String("ekanek"),
+		CopySource: aws.String(url.PathEscape("ekanek/" + src)),
+		Key:        aws.String(dst),
+	})
+	if err != nil {
+		return notFound(err)
+	}
+	return DeleteFromS3(src, s)
+}
@@ -0,0 +1,129 @@
+// Package bus is an in-process publish/subscribe bus with NATS style subjects. It stands in
+// for a real broker in development, subscribers in the same process receive what is published.
+package bus
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultBuffer = 256
+)
+
+var (
+	ErrSubjectInvalid = errors.New("invalid subject")
+	ErrSlowConsumer   = errors.New("subscriber buffer is full")
+)
+
+// Msg is a message received by a subscriber.
+type Msg struct {
+	Subject string
+	Data    []byte
+}
+
+// Bus routes published messages to matching subscriptions.
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+// Subscription receives the messages whose subject matches its pattern on C.
+type Subscription struct {
+	C       <-chan Msg
+	c       chan Msg
+	pattern []string
+	bus     *Bus
+	once    sync.Once
+}
+
+// New initializes a bus.
+func New() *Bus {
+	return &Bus{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe subscribes to a subject pattern of dot separated tokens, "*" matches a single token
+// and a trailing ">" matches one or more tokens, e.g. "asset.*" or "asset.>". Messages are buffered
+// up to buffer messages (256 if buffer is 0).
+func (b *Bus) Subscribe(pattern string, buffer int) (*Subscription, error) {
+	tokens, err := split(pattern)
+	if err != nil {
+		return nil, err
+	}
+	for i, t := range tokens {
+		if t == ">" && i != len(tokens)-1 {
+			return nil, ErrSubjectInvalid
+		}
+	}
+	if buffer <= 0 {
+		buffer = defaultBuffer
+	}
+
+	c := make(chan Msg, buffer)
+	s := &Subscription{C: c, c: c, pattern: tokens, bus: b}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s, nil
+}
+
+// Unsubscribe stops delivery and closes C.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.bus.mu.Lock()
+		delete(s.bus.subs, s)
+		s.bus.mu.Unlock()
+		close(s.c)
+	})
+}
+
+// Publish delivers data to every matching subscription without blocking. Subscribers which
+// fall behind miss the message and ErrSlowConsumer is returned, so the publisher can retry.
+func (b *Bus) Publish(subject string, data []byte) error {
+	tokens, err := split(subject)
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if t == "*" || t == ">" {
+			return ErrSubjectInvalid
+		}
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subs {
+		if !match(s.pattern, tokens) {
+			continue
+		}
+		select {
+		case s.c <- Msg{Subject: subject, Data: data}:
+		default:
+			err = ErrSlowConsumer
+		}
+	}
+	return err
+}
+
+func split(subject string) ([]string, error) {
+	tokens := strings.Split(subject, ".")
+	for _, t := range tokens {
+		if t == "" {
+			return nil, ErrSubjectInvalid
+		}
+	}
+	return tokens, nil
+}
+
+func match(pattern, subject []string) bool {
+	for i, p := range pattern {
+		if p == ">" {
+			return len(subject) > i
+		}
+		if i >= len(subject) || (p != "*" && p != subject[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(subject)
+}
@@ -0,0 +1,94 @@
+package bus
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSubjectMatching(t *testing.T) {
+	tests := []struct {
+		pattern string
+		subject string
+		want    bool
+	}{
+		{pattern: "asset.uploaded", subject: "asset.uploaded", want: true},
+		{pattern: "asset.uploaded", subject: "asset.deleted", want: false},
+		{pattern: "asset.*", subject: "asset.deleted", want: true},
+		{pattern: "asset.*", subject: "asset", want: false},
+		{pattern: "asset.*", subject: "asset.deleted.v2", want: false},
+		{pattern: "asset.>", subject: "asset.deleted.v2", want: true},
+		{pattern: "asset.>", subject: "asset", want: false},
+		{pattern: ">", subject: "user.created", want: true},
+	}
+	for _, tt := range tests {
+		b := New()
+		s, err := b.Subscribe(tt.pattern, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = b.Publish(tt.subject, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case m := <-s.C:
+			if !tt.want {
+				t.Errorf("%s received %s", tt.pattern, m.Subject)
+			}
+		default:
+			if tt.want {
+				t.Errorf("%s didn't receive %s", tt.pattern, tt.subject)
+			}
+		}
+	}
+}
+
+func TestInvalidSubjects(t *testing.T) {
+	b := New()
+	for _, p := range []string{"", "asset.", "asset..uploaded", "asset.>.uploaded"} {
+		if _, err := b.Subscribe(p, 0); !errors.Is(err, ErrSubjectInvalid) {
+			t.Errorf("Subscribe(%q) err = %v, want %v", p, err, ErrSubjectInvalid)
+		}
+	}
+	for _, s := range []string{"", "asset.*", "asset.>"} {
+		if err := b.Publish(s, nil); !errors.Is(err, ErrSubjectInvalid) {
+			t.Errorf("Publish(%q) err = %v, want %v", s, err, ErrSubjectInvalid)
+		}
+	}
+}
+
+func TestSlowConsumer(t *testing.T) {
+	b := New()
+	slow, err := b.Subscribe("asset.*", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast, err := b.Subscribe("asset.*", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Publish("asset.uploaded", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Publish("asset.uploaded", []byte("2")); !errors.Is(err, ErrSlowConsumer) {
+		t.Fatalf("err = %v, want %v", err, ErrSlowConsumer)
+	}
+	if len(slow.C) != 1 || len(fast.C) != 2 {
+		t.Fatalf("buffered %d and %d messages, want 1 and 2", len(slow.C), len(fast.C))
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	b := New()
+	s, err := b.Subscribe(">", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Unsubscribe()
+	s.Unsubscribe()
+	if _, ok := <-s.C; ok {
+		t.Fatal("C is open after unsubscribing")
+	}
+	if err = b.Publish("asset.uploaded", nil); err != nil {
+		t.Fatal(err)
+	}
+}
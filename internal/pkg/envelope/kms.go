@@ -0,0 +1,145 @@
+// Package envelope implements envelope encryption of stored objects: every object is encrypted
+// with its own random data key and the data key is stored wrapped by a key held by a KMS.
+package envelope
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	// KeySize is the size of data keys and master keys, AES-256.
+	KeySize = 32
+)
+
+var (
+	ErrKeyInvalid = errors.New("invalid key")
+	ErrKeyUnknown = errors.New("unknown key id")
+	ErrUnwrap     = errors.New("unable to unwrap data key")
+)
+
+// KMS wraps and unwraps data keys. Scope binds a wrapped key to its owner, e.g. the user id,
+// the same scope has to be passed to unwrap it again.
+type KMS interface {
+	// KeyId returns the id of the key new data keys are wrapped with.
+	KeyId() string
+	// WrapKey encrypts a data key and returns the id of the key it was wrapped with.
+	WrapKey(ctx context.Context, scope string, dataKey []byte) (keyId string, wrapped []byte, err error)
+	// UnwrapKey decrypts a data key wrapped by WrapKey.
+	UnwrapKey(ctx context.Context, scope string, keyId string, wrapped []byte) ([]byte, error)
+}
+
+// NewDataKey returns a random data key.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// LocalKMS wraps data keys with master keys read from a local key file. Every scope gets its
+// own key encryption key derived from the master key, so a wrapped key only unwraps for its user.
+type LocalKMS struct {
+	active string
+	keys   map[string][]byte
+}
+
+// NewLocalKMS reads the master keys from path, one base64 encoded key per line, optionally
+// prefixed by its version, e.g. "v2 <key>" with the key generated by `head -c 32 /dev/urandom | base64`.
+// The last key wraps new data keys, the ones before it are kept to unwrap existing data keys
+// until they are re-wrapped. Blank lines and lines starting with # are ignored.
+func NewLocalKMS(path string) (*LocalKMS, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k := &LocalKMS{keys: make(map[string][]byte)}
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		version, encoded := "", line
+		if fields := strings.Fields(line); len(fields) == 2 {
+			version, encoded = fields[0], fields[1]
+		}
+		master, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(master) != KeySize {
+			return nil, fmt.Errorf("%v: expected %d base64 encoded bytes on line %d of %s", ErrKeyInvalid, KeySize, i+1, path)
+		}
+		if version == "" {
+			// Keys without a version are identified by their fingerprint.
+			sum := sha256.Sum256(master)
+			version = hex.EncodeToString(sum[:8])
+		}
+		id := "local:" + version
+		if _, ok := k.keys[id]; ok {
+			return nil, fmt.Errorf("%v: duplicate key version %s in %s", ErrKeyInvalid, version, path)
+		}
+		k.keys[id] = master
+		k.active = id
+	}
+	if k.active == "" {
+		return nil, fmt.Errorf("%v: no key in %s", ErrKeyInvalid, path)
+	}
+	return k, nil
+}
+
+func (k *LocalKMS) KeyId() string {
+	return k.active
+}
+
+func (k *LocalKMS) WrapKey(ctx context.Context, scope string, dataKey []byte) (string, []byte, error) {
+	aead, err := k.aead(k.active, scope)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", nil, err
+	}
+	return k.active, aead.Seal(nonce, nonce, dataKey, []byte(k.active+"/"+scope)), nil
+}
+
+func (k *LocalKMS) UnwrapKey(ctx context.Context, scope string, keyId string, wrapped []byte) ([]byte, error) {
+	aead, err := k.aead(keyId, scope)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrUnwrap
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, []byte(keyId+"/"+scope))
+	if err != nil {
+		return nil, ErrUnwrap
+	}
+	return dataKey, nil
+}
+
+// aead returns the cipher keyed with the key encryption key of scope under the master key keyId.
+func (k *LocalKMS) aead(keyId string, scope string) (cipher.AEAD, error) {
+	master, ok := k.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("%v: %s", ErrKeyUnknown, keyId)
+	}
+	mac := hmac.New(sha256.New, master)
+	_, _ = mac.Write([]byte("ekanek key encryption key\x00" + scope))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
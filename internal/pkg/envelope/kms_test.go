@@ -0,0 +1,136 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func keyFile(t *testing.T, lines ...string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "master.key")
+	if err = ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func masterKey(t *testing.T) string {
+	t.Helper()
+	return base64.StdEncoding.EncodeToString(testKey(t))
+}
+
+func newKMS(t *testing.T, lines ...string) *LocalKMS {
+	t.Helper()
+	k, err := NewLocalKMS(keyFile(t, lines...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// hasPrefix reports whether err is target with details appended.
+func hasPrefix(err error, target error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), target.Error())
+}
+
+func TestWrapKey(t *testing.T) {
+	ctx := context.Background()
+	k := newKMS(t, "# master keys", "", "v1 "+masterKey(t))
+	dataKey := testKey(t)
+
+	keyId, wrapped, err := k.WrapKey(ctx, "user-a", dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyId != "local:v1" || keyId != k.KeyId() {
+		t.Fatalf("wrapped with %q, want local:v1", keyId)
+	}
+	got, err := k.UnwrapKey(ctx, "user-a", keyId, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, dataKey) {
+		t.Fatal("unwrapped a different key")
+	}
+
+	// The key encryption key is derived per scope, a key wrapped for one user doesn't unwrap for another.
+	if _, err = k.UnwrapKey(ctx, "user-b", keyId, wrapped); !errors.Is(err, ErrUnwrap) {
+		t.Fatalf("wrong scope err = %v, want %v", err, ErrUnwrap)
+	}
+	// The key id is authenticated too.
+	if _, err = k.UnwrapKey(ctx, "user-a", "local:v2", wrapped); !hasPrefix(err, ErrKeyUnknown) {
+		t.Fatalf("unknown key err = %v, want %v", err, ErrKeyUnknown)
+	}
+	tampered := append([]byte(nil), wrapped...)
+	tampered[len(tampered)-1] ^= 1
+	for name, w := range map[string][]byte{"tampered": tampered, "short": wrapped[:4]} {
+		if _, err = k.UnwrapKey(ctx, "user-a", keyId, w); !errors.Is(err, ErrUnwrap) {
+			t.Errorf("%s: err = %v, want %v", name, err, ErrUnwrap)
+		}
+	}
+}
+
+func TestRotation(t *testing.T) {
+	ctx := context.Background()
+	v1 := "v1 " + masterKey(t)
+	old := newKMS(t, v1)
+	dataKey := testKey(t)
+	keyId, wrapped, err := old.WrapKey(ctx, "user", dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := newKMS(t, v1, "v2 "+masterKey(t))
+	if rotated.KeyId() != "local:v2" {
+		t.Fatalf("active key %q, want the last one", rotated.KeyId())
+	}
+	got, err := rotated.UnwrapKey(ctx, "user", keyId, wrapped)
+	if err != nil || !bytes.Equal(got, dataKey) {
+		t.Fatalf("keys wrapped with the old version don't unwrap after rotation: %v", err)
+	}
+	newId, _, err := rotated.WrapKey(ctx, "user", dataKey)
+	if err != nil || newId != "local:v2" {
+		t.Fatalf("wrapped with %q, err = %v, want local:v2", newId, err)
+	}
+
+	// A master key of the same version but different bytes doesn't unwrap.
+	replaced := newKMS(t, "v1 "+masterKey(t))
+	if _, err = replaced.UnwrapKey(ctx, "user", keyId, wrapped); !errors.Is(err, ErrUnwrap) {
+		t.Fatalf("err = %v, want %v", err, ErrUnwrap)
+	}
+}
+
+func TestNewLocalKMS(t *testing.T) {
+	// Keys without a version are identified by their fingerprint.
+	key := masterKey(t)
+	a, b := newKMS(t, key), newKMS(t, key)
+	if !strings.HasPrefix(a.KeyId(), "local:") || a.KeyId() != b.KeyId() || a.KeyId() == newKMS(t, masterKey(t)).KeyId() {
+		t.Fatalf("fingerprint ids %q and %q", a.KeyId(), b.KeyId())
+	}
+
+	for name, lines := range map[string][]string{
+		"empty":      {"# no keys", ""},
+		"short key":  {"v1 " + base64.StdEncoding.EncodeToString([]byte("short"))},
+		"not base64": {"v1 not-base64!"},
+		"duplicate":  {"v1 " + masterKey(t), "v1 " + masterKey(t)},
+	} {
+		if _, err := NewLocalKMS(keyFile(t, lines...)); !hasPrefix(err, ErrKeyInvalid) {
+			t.Errorf("%s: err = %v, want %v", name, err, ErrKeyInvalid)
+		}
+	}
+	if _, err := NewLocalKMS(filepath.Join(os.TempDir(), "does-not-exist.key")); err == nil {
+		t.Error("a missing key file was accepted")
+	}
+}
@@ -0,0 +1,219 @@
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// Streams are encrypted in chunks of chunkSize bytes, each sealed with AES-GCM. The nonce of a
+// chunk is the random prefix from the header, the chunk counter and a flag set on the last chunk,
+// so chunks can't be reordered, dropped or the stream truncated without failing authentication.
+//
+//	header: magic (4) | nonce prefix (7)
+//	chunk:  ciphertext (<= chunkSize) | tag (16)
+const (
+	chunkSize   = 64 << 10
+	prefixSize  = 7
+	nonceSize   = 12
+	headerSize  = len(magic) + prefixSize
+	lastChunk   = 1
+	maxChunks   = math.MaxUint32
+	sealedChunk = chunkSize + 16
+)
+
+const magic = "EKE1"
+
+var (
+	ErrFormat    = errors.New("not an encrypted stream")
+	ErrAuth      = errors.New("encrypted stream failed authentication")
+	ErrTruncated = errors.New("encrypted stream is truncated")
+	ErrTooLarge  = errors.New("encrypted stream is too large")
+
+	errClosed = errors.New("encrypted stream is closed")
+)
+
+type streamCipher struct {
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint64
+}
+
+func newStreamCipher(key []byte, prefix []byte) (*streamCipher, error) {
+	if len(key) != KeySize {
+		return nil, ErrKeyInvalid
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &streamCipher{aead: aead, prefix: prefix}, nil
+}
+
+// nonce returns the nonce of the next chunk.
+func (s *streamCipher) nonce(last bool) ([]byte, error) {
+	if s.counter > maxChunks {
+		return nil, ErrTooLarge
+	}
+	nonce := make([]byte, nonceSize)
+	copy(nonce, s.prefix)
+	binary.BigEndian.PutUint32(nonce[prefixSize:], uint32(s.counter))
+	if last {
+		nonce[nonceSize-1] = lastChunk
+	}
+	s.counter++
+	return nonce, nil
+}
+
+type writer struct {
+	w   io.Writer
+	s   *streamCipher
+	buf []byte
+	err error
+}
+
+// NewWriter returns a writer encrypting to w with key. Close must be called to write the last
+// chunk, it doesn't close w.
+func NewWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	prefix := make([]byte, prefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+	s, err := newStreamCipher(key, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(append([]byte(magic), prefix...)); err != nil {
+		return nil, err
+	}
+	return &writer{w: w, s: s, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, the last one is sealed by Close.
+		if len(w.buf) == chunkSize {
+			if w.err = w.seal(false); w.err != nil {
+				return written, w.err
+			}
+		}
+		n := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.seal(true); err != nil {
+		w.err = err
+		return err
+	}
+	w.err = errClosed
+	return nil
+}
+
+func (w *writer) seal(last bool) error {
+	nonce, err := w.s.nonce(last)
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(w.s.aead.Seal(nil, nonce, w.buf, nil))
+	w.buf = w.buf[:0]
+	return err
+}
+
+type reader struct {
+	r    *bufio.Reader
+	s    *streamCipher
+	buf  []byte
+	in   []byte
+	done bool
+	err  error
+}
+
+// NewReader returns a reader decrypting the stream r written by NewWriter. Read fails with
+// ErrAuth or ErrTruncated when the stream was tampered with, data of a chunk is only returned
+// once the chunk has been authenticated.
+func NewReader(r io.Reader, key []byte) (io.Reader, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrFormat
+		}
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(magic)], []byte(magic)) {
+		return nil, ErrFormat
+	}
+	s, err := newStreamCipher(key, header[len(magic):])
+	if err != nil {
+		return nil, err
+	}
+	return &reader{r: bufio.NewReaderSize(r, sealedChunk), s: s, in: make([]byte, sealedChunk)}, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.open()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// open reads and authenticates the next chunk. A chunk is the last one when it's short or
+// nothing follows it.
+func (r *reader) open() error {
+	n, err := io.ReadFull(r.r, r.in)
+	last := false
+	switch {
+	case err == io.EOF:
+		return ErrTruncated
+	case err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, perr := r.r.Peek(1); perr == io.EOF {
+			last = true
+		} else if perr != nil {
+			return perr
+		}
+	}
+
+	nonce, err := r.s.nonce(last)
+	if err != nil {
+		return err
+	}
+	r.buf, err = r.s.aead.Open(r.in[:0], nonce, r.in[:n], nil)
+	if err != nil {
+		return ErrAuth
+	}
+	r.done = last
+	return nil
+}
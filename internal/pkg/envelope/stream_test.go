@@ -0,0 +1,208 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func seal(t *testing.T, key []byte, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Odd sized writes cross chunk boundaries.
+	for p := plain; len(p) > 0; {
+		n := 1000
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err = w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func open(key []byte, sealed []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func random(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// chunks splits a sealed stream into its header and sealed chunks.
+func chunks(sealed []byte) ([]byte, [][]byte) {
+	header, rest := sealed[:headerSize], sealed[headerSize:]
+	var cs [][]byte
+	for len(rest) > sealedChunk {
+		cs = append(cs, rest[:sealedChunk])
+		rest = rest[sealedChunk:]
+	}
+	return header, append(cs, rest)
+}
+
+func join(header []byte, cs ...[]byte) []byte {
+	return bytes.Join(append([][]byte{header}, cs...), nil)
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := testKey(t)
+	for _, n := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 17} {
+		plain := random(t, n)
+		sealed := seal(t, key, plain)
+		// Every chunk adds a tag, a stream ending on a chunk boundary has no empty trailing chunk.
+		sealedChunks := (n + chunkSize - 1) / chunkSize
+		if sealedChunks == 0 {
+			sealedChunks = 1
+		}
+		if want := headerSize + sealedChunks*16 + n; len(sealed) != want {
+			t.Errorf("%d bytes sealed to %d, want %d", n, len(sealed), want)
+		}
+		got, err := open(key, sealed)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("%d bytes: decrypted content differs", n)
+		}
+	}
+}
+
+func TestWriterClosed(t *testing.T) {
+	w, err := NewWriter(ioutil.Discard, testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte("late")); !errors.Is(err, errClosed) {
+		t.Fatalf("write after close err = %v, want %v", err, errClosed)
+	}
+}
+
+func TestTampering(t *testing.T) {
+	key := testKey(t)
+	plain := random(t, 3*chunkSize+17)
+	header, cs := chunks(seal(t, key, plain))
+	if len(cs) != 4 {
+		t.Fatalf("%d chunks, want 4", len(cs))
+	}
+	flipped := append([]byte(nil), cs[1]...)
+	flipped[10] ^= 1
+
+	tests := []struct {
+		name   string
+		sealed []byte
+		want   error
+		// plain is the number of bytes which authenticate before the failure.
+		plain int
+	}{
+		// The last chunk is dropped, the one before it wasn't sealed as the last chunk.
+		{name: "truncated at a chunk boundary", sealed: join(header, cs[0], cs[1], cs[2]), want: ErrAuth, plain: 2 * chunkSize},
+		{name: "truncated within a chunk", sealed: join(header, cs[0], cs[1][:100]), want: ErrAuth, plain: chunkSize},
+		{name: "only the header", sealed: header, want: ErrTruncated},
+		{name: "reordered", sealed: join(header, cs[1], cs[0], cs[2], cs[3]), want: ErrAuth},
+		{name: "chunk dropped", sealed: join(header, cs[0], cs[2], cs[3]), want: ErrAuth, plain: chunkSize},
+		{name: "chunk modified", sealed: join(header, cs[0], flipped, cs[2], cs[3]), want: ErrAuth, plain: chunkSize},
+		{name: "data appended", sealed: join(header, cs[0], cs[1], cs[2], cs[3], cs[3]), want: ErrAuth, plain: 3 * chunkSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(tt.sealed), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(r)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if !bytes.Equal(got, plain[:tt.plain]) {
+				t.Fatalf("read %d bytes before failing, want the %d authenticated ones", len(got), tt.plain)
+			}
+		})
+	}
+}
+
+// A stream whose last chunk claims not to be the last one, e.g. the first chunk of a longer
+// stream cut off at the end of it, is rejected even when the cut is at a chunk boundary.
+func TestLastChunkFlag(t *testing.T) {
+	key := testKey(t)
+	header, cs := chunks(seal(t, key, random(t, chunkSize+1)))
+	if _, err := open(key, join(header, cs[0])); !errors.Is(err, ErrAuth) {
+		t.Fatalf("err = %v, want %v", err, ErrAuth)
+	}
+
+	// A full chunk sealed as the last one can't be followed by more data.
+	header, cs = chunks(seal(t, key, random(t, chunkSize)))
+	if len(cs) != 1 {
+		t.Fatalf("%d chunks, want 1", len(cs))
+	}
+	other := seal(t, key, random(t, 10))
+	if _, err := open(key, join(header, cs[0], other[headerSize:])); !errors.Is(err, ErrAuth) {
+		t.Fatalf("err = %v, want %v", err, ErrAuth)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	sealed := seal(t, testKey(t), []byte("secret"))
+	if _, err := open(testKey(t), sealed); !errors.Is(err, ErrAuth) {
+		t.Fatalf("err = %v, want %v", err, ErrAuth)
+	}
+	if _, err := NewReader(bytes.NewReader(sealed), []byte("short")); !errors.Is(err, ErrKeyInvalid) {
+		t.Fatalf("err = %v, want %v", err, ErrKeyInvalid)
+	}
+	if _, err := NewWriter(ioutil.Discard, []byte("short")); !errors.Is(err, ErrKeyInvalid) {
+		t.Fatalf("err = %v, want %v", err, ErrKeyInvalid)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	key := testKey(t)
+	for name, in := range map[string][]byte{
+		"empty":        nil,
+		"short header": []byte("EKE"),
+		"plain gzip":   append([]byte{0x1f, 0x8b}, make([]byte, 64)...),
+	} {
+		if _, err := NewReader(bytes.NewReader(in), key); !errors.Is(err, ErrFormat) {
+			t.Errorf("%s: err = %v, want %v", name, err, ErrFormat)
+		}
+	}
+}
+
+// A header from another stream doesn't authenticate the chunks.
+func TestHeaderSwapped(t *testing.T) {
+	key := testKey(t)
+	a, b := seal(t, key, []byte("first")), seal(t, key, []byte("second"))
+	if _, err := open(key, join(b[:headerSize], a[headerSize:])); !errors.Is(err, ErrAuth) {
+		t.Fatalf("err = %v, want %v", err, ErrAuth)
+	}
+}
@@ -0,0 +1,296 @@
+// Package exif extracts image metadata and strips personal metadata from JPEG and PNG files.
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	_ "image/gif"  // register decoder for DecodeConfig
+	_ "image/jpeg" // register decoder for DecodeConfig
+	_ "image/png"  // register decoder for DecodeConfig
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	tagMake         = 0x010F
+	tagModel        = 0x0110
+	tagOrientation  = 0x0112
+	tagDateTime     = 0x0132
+	tagExifIFD      = 0x8769
+	tagGPSIFD       = 0x8825
+	tagDateOriginal = 0x9003
+	tagPixelX       = 0xA002
+	tagPixelY       = 0xA003
+
+	tagGPSLatRef = 0x0001
+	tagGPSLat    = 0x0002
+	tagGPSLonRef = 0x0003
+	tagGPSLon    = 0x0004
+	tagGPSAltRef = 0x0005
+	tagGPSAlt    = 0x0006
+
+	exifTimeLayout = "2006:01:02 15:04:05"
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+
+	errInvalidTIFF = errors.New("invalid exif tiff data")
+)
+
+// Metadata is the subset of image metadata we keep for an asset.
+type Metadata struct {
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Make        string `json:"camera_make,omitempty"`
+	Model       string `json:"camera_model,omitempty"`
+	Orientation int    `json:"orientation,omitempty"`
+	CaptureTime string `json:"capture_time,omitempty"`
+	GPS         *GPS   `json:"gps,omitempty"`
+	Stripped    bool   `json:"stripped,omitempty"`
+}
+
+// GPS is the location an image was captured at, in decimal degrees.
+type GPS struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+// Parse extracts metadata from the leading bytes of an image.
+// A truncated buffer yields whatever could be read before the cut.
+func Parse(b []byte) *Metadata {
+	m := &Metadata{}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(b)); err == nil {
+		m.Width, m.Height = cfg.Width, cfg.Height
+	}
+
+	if payload := jpegExif(b); payload != nil {
+		_ = parseTIFF(payload, m)
+	}
+	return m
+}
+
+// jpegExif returns the TIFF payload of the first Exif APP1 segment, if any.
+func jpegExif(b []byte) []byte {
+	if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xFF {
+			return nil
+		}
+		marker := b[i+1]
+		if marker == 0xFF {
+			i++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			return nil
+		}
+		l := int(binary.BigEndian.Uint16(b[i+2:]))
+		end := i + 2 + l
+		if l < 2 || end > len(b) {
+			return nil
+		}
+		if marker == 0xE1 && bytes.HasPrefix(b[i+4:end], exifHeader) {
+			return b[i+4+len(exifHeader) : end]
+		}
+		i = end
+	}
+	return nil
+}
+
+type tiff struct {
+	b     []byte
+	order binary.ByteOrder
+}
+
+type entry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func parseTIFF(b []byte, m *Metadata) error {
+	if len(b) < 8 {
+		return errInvalidTIFF
+	}
+	t := tiff{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return errInvalidTIFF
+	}
+
+	ifd0, err := t.ifd(t.order.Uint32(b[4:]))
+	if err != nil {
+		return err
+	}
+	m.Make = t.ascii(ifd0[tagMake])
+	m.Model = t.ascii(ifd0[tagModel])
+	m.Orientation = int(t.uint(ifd0[tagOrientation]))
+	m.CaptureTime = captureTime(t.ascii(ifd0[tagDateTime]))
+
+	if e, ok := ifd0[tagExifIFD]; ok {
+		if sub, err := t.ifd(t.uint(e)); err == nil {
+			if ct := captureTime(t.ascii(sub[tagDateOriginal])); ct != "" {
+				m.CaptureTime = ct
+			}
+			if m.Width == 0 {
+				m.Width, m.Height = int(t.uint(sub[tagPixelX])), int(t.uint(sub[tagPixelY]))
+			}
+		}
+	}
+
+	if e, ok := ifd0[tagGPSIFD]; ok {
+		if gps, err := t.ifd(t.uint(e)); err == nil {
+			m.GPS = t.gps(gps)
+		}
+	}
+	return nil
+}
+
+func (t tiff) ifd(offset uint32) (map[uint16]entry, error) {
+	if int64(offset)+2 > int64(len(t.b)) {
+		return nil, errInvalidTIFF
+	}
+	n := int(t.order.Uint16(t.b[offset:]))
+	entries := make(map[uint16]entry, n)
+	for i := 0; i < n; i++ {
+		p := int(offset) + 2 + i*12
+		if p+12 > len(t.b) {
+			return entries, errInvalidTIFF
+		}
+		e := entry{
+			typ:   t.order.Uint16(t.b[p+2:]),
+			count: t.order.Uint32(t.b[p+4:]),
+		}
+		size := int64(typeSize(e.typ)) * int64(e.count)
+		if size <= 4 {
+			e.value = t.b[p+8 : p+8+int(size)]
+		} else {
+			off := int64(t.order.Uint32(t.b[p+8:]))
+			if off+size > int64(len(t.b)) {
+				continue
+			}
+			e.value = t.b[off : off+size]
+		}
+		entries[t.order.Uint16(t.b[p:])] = e
+	}
+	return entries, nil
+}
+
+func typeSize(typ uint16) int {
+	switch typ {
+	case 3, 8:
+		return 2
+	case 4, 9, 11:
+		return 4
+	case 5, 10, 12:
+		return 8
+	default:
+		return 1
+	}
+}
+
+func (t tiff) ascii(e entry) string {
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+func (t tiff) uint(e entry) uint32 {
+	switch {
+	case e.typ == 3 && len(e.value) >= 2:
+		return uint32(t.order.Uint16(e.value))
+	case e.typ == 4 && len(e.value) >= 4:
+		return t.order.Uint32(e.value)
+	case e.typ == 1 && len(e.value) >= 1:
+		return uint32(e.value[0])
+	}
+	return 0
+}
+
+func (t tiff) rationals(e entry) []float64 {
+	if e.typ != 5 {
+		return nil
+	}
+	var out []float64
+	for i := 0; i+8 <= len(e.value); i += 8 {
+		num, den := t.order.Uint32(e.value[i:]), t.order.Uint32(e.value[i+4:])
+		if den == 0 {
+			return nil
+		}
+		out = append(out, float64(num)/float64(den))
+	}
+	return out
+}
+
+func (t tiff) gps(ifd map[uint16]entry) *GPS {
+	lat, lon := t.rationals(ifd[tagGPSLat]), t.rationals(ifd[tagGPSLon])
+	if len(lat) != 3 || len(lon) != 3 {
+		return nil
+	}
+	g := &GPS{
+		Latitude:  degrees(lat, t.ascii(ifd[tagGPSLatRef]) == "S"),
+		Longitude: degrees(lon, t.ascii(ifd[tagGPSLonRef]) == "W"),
+	}
+	if alt := t.rationals(ifd[tagGPSAlt]); len(alt) == 1 {
+		a := alt[0]
+		if t.uint(ifd[tagGPSAltRef]) == 1 {
+			a = -a
+		}
+		g.Altitude = &a
+	}
+	return g
+}
+
+func degrees(dms []float64, negative bool) float64 {
+	d := dms[0] + dms[1]/60 + dms[2]/3600
+	if negative {
+		d = -d
+	}
+	return math.Round(d*1e6) / 1e6
+}
+
+func captureTime(s string) string {
+	ts, err := time.Parse(exifTimeLayout, s)
+	if err != nil {
+		return ""
+	}
+	return ts.Format("2006-01-02T15:04:05")
+}
+
+// orientationSegment builds a minimal Exif APP1 segment carrying only the orientation tag,
+// so stripped images are still displayed the right way up.
+func orientationSegment(o int) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0xFF, 0xE1, 0x00, 0x00})
+	b.Write(exifHeader)
+	b.Write([]byte("MM\x00\x2A"))
+	_ = binary.Write(&b, binary.BigEndian, uint32(8))
+	_ = binary.Write(&b, binary.BigEndian, uint16(1))
+	_ = binary.Write(&b, binary.BigEndian, []uint16{tagOrientation, 3})
+	_ = binary.Write(&b, binary.BigEndian, uint32(1))
+	_ = binary.Write(&b, binary.BigEndian, []uint16{uint16(o), 0})
+	_ = binary.Write(&b, binary.BigEndian, uint32(0))
+
+	seg := b.Bytes()
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(seg)-2))
+	return seg
+}
+
+// Redacted returns the metadata which survives Strip: geometry and orientation only.
+func (m *Metadata) Redacted() *Metadata {
+	return &Metadata{
+		Width:       m.Width,
+		Height:      m.Height,
+		Orientation: m.Orientation,
+		Stripped:    true,
+	}
+}
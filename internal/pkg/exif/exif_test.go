@@ -0,0 +1,220 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+type tag struct {
+	id    uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func asciiTag(id uint16, s string) tag {
+	return tag{id: id, typ: 2, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+}
+
+func shortTag(id uint16, v uint16) tag {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return tag{id: id, typ: 3, count: 1, value: b}
+}
+
+func byteTag(id uint16, v byte) tag {
+	return tag{id: id, typ: 1, count: 1, value: []byte{v}}
+}
+
+func rationalTag(id uint16, values ...[2]uint32) tag {
+	var b []byte
+	for _, v := range values {
+		b = append(b, make([]byte, 8)...)
+		binary.BigEndian.PutUint32(b[len(b)-8:], v[0])
+		binary.BigEndian.PutUint32(b[len(b)-4:], v[1])
+	}
+	return tag{id: id, typ: 5, count: uint32(len(values)), value: b}
+}
+
+func ifdSize(tags []tag) uint32 {
+	return uint32(2 + 12*len(tags) + 4)
+}
+
+// buildTIFF lays out a big endian TIFF with IFD0 pointing at the Exif and GPS IFDs, values which
+// don't fit an entry follow the IFDs.
+func buildTIFF(ifd0, exifIFD, gpsIFD []tag) []byte {
+	ifd0 = append(ifd0, tag{id: tagExifIFD, typ: 4, count: 1}, tag{id: tagGPSIFD, typ: 4, count: 1})
+	offExif := 8 + ifdSize(ifd0)
+	offGPS := offExif + ifdSize(exifIFD)
+	ifd0[len(ifd0)-2].value = make([]byte, 4)
+	ifd0[len(ifd0)-1].value = make([]byte, 4)
+	binary.BigEndian.PutUint32(ifd0[len(ifd0)-2].value, offExif)
+	binary.BigEndian.PutUint32(ifd0[len(ifd0)-1].value, offGPS)
+
+	var b, data bytes.Buffer
+	b.WriteString("MM\x00\x2A")
+	_ = binary.Write(&b, binary.BigEndian, uint32(8))
+	dataOff := offGPS + ifdSize(gpsIFD)
+	for _, ifd := range [][]tag{ifd0, exifIFD, gpsIFD} {
+		_ = binary.Write(&b, binary.BigEndian, uint16(len(ifd)))
+		for _, t := range ifd {
+			_ = binary.Write(&b, binary.BigEndian, []uint16{t.id, t.typ})
+			_ = binary.Write(&b, binary.BigEndian, t.count)
+			if len(t.value) <= 4 {
+				b.Write(append(t.value, make([]byte, 4-len(t.value))...))
+				continue
+			}
+			_ = binary.Write(&b, binary.BigEndian, dataOff+uint32(data.Len()))
+			data.Write(t.value)
+		}
+		_ = binary.Write(&b, binary.BigEndian, uint32(0))
+	}
+	b.Write(data.Bytes())
+	return b.Bytes()
+}
+
+func segment(marker byte, payload []byte) []byte {
+	seg := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 4))
+	for x := 0; x < 8; x++ {
+		img.Set(x, x%4, color.RGBA{R: 255, A: 255})
+	}
+	return img
+}
+
+// testJPEG returns a JPEG carrying Exif with camera, capture time and GPS, IPTC and a comment.
+func testJPEG(t *testing.T) []byte {
+	t.Helper()
+	var enc bytes.Buffer
+	if err := jpeg.Encode(&enc, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	tiffData := buildTIFF(
+		[]tag{asciiTag(tagMake, "Canon"), asciiTag(tagModel, "EOS 5D"), shortTag(tagOrientation, 6), asciiTag(tagDateTime, "2021:05:06 07:08:09")},
+		[]tag{asciiTag(tagDateOriginal, "2020:01:02 03:04:05")},
+		[]tag{
+			asciiTag(tagGPSLatRef, "N"), rationalTag(tagGPSLat, [2]uint32{52, 1}, [2]uint32{30, 1}, [2]uint32{0, 1}),
+			asciiTag(tagGPSLonRef, "W"), rationalTag(tagGPSLon, [2]uint32{13, 1}, [2]uint32{24, 1}, [2]uint32{3600, 100}),
+			byteTag(tagGPSAltRef, 1), rationalTag(tagGPSAlt, [2]uint32{69, 2}),
+		},
+	)
+	b := append([]byte(nil), enc.Bytes()[:2]...)
+	b = append(b, segment(0xE1, append(append([]byte(nil), exifHeader...), tiffData...))...)
+	b = append(b, segment(0xED, []byte("Photoshop 3.0\x00secret iptc"))...)
+	b = append(b, segment(0xFE, []byte("secret comment"))...)
+	return append(b, enc.Bytes()[2:]...)
+}
+
+func TestParse(t *testing.T) {
+	m := Parse(testJPEG(t))
+	if m.Width != 8 || m.Height != 4 {
+		t.Errorf("size %dx%d, want 8x4", m.Width, m.Height)
+	}
+	if m.Make != "Canon" || m.Model != "EOS 5D" || m.Orientation != 6 {
+		t.Errorf("camera %q %q, orientation %d", m.Make, m.Model, m.Orientation)
+	}
+	if m.CaptureTime != "2020-01-02T03:04:05" {
+		t.Errorf("capture time %q, want the original time", m.CaptureTime)
+	}
+	if m.GPS == nil {
+		t.Fatal("no gps")
+	}
+	if m.GPS.Latitude != 52.5 || m.GPS.Longitude != -13.41 || m.GPS.Altitude == nil || *m.GPS.Altitude != -34.5 {
+		t.Errorf("gps %+v, altitude %v", m.GPS, m.GPS.Altitude)
+	}
+}
+
+func TestParseTruncated(t *testing.T) {
+	b := testJPEG(t)
+	// Any prefix parses without panicking, e.g. when the peeked head ends within the Exif segment.
+	for n := 0; n < 400 && n < len(b); n++ {
+		_ = Parse(b[:n])
+	}
+	for _, b := range [][]byte{nil, []byte("not an image"), {0xFF, 0xD8, 0xFF, 0xE1, 0xFF, 0xFF}} {
+		if m := Parse(b); m.Make != "" || m.GPS != nil {
+			t.Errorf("Parse(%q) = %+v", b, m)
+		}
+	}
+}
+
+func TestStripJPEG(t *testing.T) {
+	in := testJPEG(t)
+	out, err := ioutil.ReadAll(Strip(bytes.NewReader(in)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"Canon", "secret iptc", "secret comment"} {
+		if bytes.Contains(out, []byte(secret)) {
+			t.Errorf("%q survived stripping", secret)
+		}
+	}
+	if m := Parse(out); m.Orientation != 6 || m.GPS != nil || m.Make != "" || m.Width != 8 {
+		t.Errorf("stripped metadata %+v, want only the geometry and orientation", m)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != testImage().Bounds() {
+		t.Fatalf("bounds %v after stripping", img.Bounds())
+	}
+	// The image data is copied through unchanged.
+	sos := bytes.Index(in, []byte{0xFF, 0xDA})
+	if !bytes.HasSuffix(out, in[sos:]) {
+		t.Fatal("the image data changed")
+	}
+}
+
+func TestStripPNG(t *testing.T) {
+	var enc bytes.Buffer
+	if err := png.Encode(&enc, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	// A tEXt chunk right after IHDR, the crc isn't checked by the stripper.
+	ihdrEnd := len(pngSignature) + 8 + 13 + 4
+	text := []byte("\x00\x00\x00\x0etEXtComment\x00secret\x00\x00\x00\x00")
+	binary.BigEndian.PutUint32(text, uint32(len("Comment\x00secret")))
+	in := append(append(append([]byte(nil), enc.Bytes()[:ihdrEnd]...), text...), enc.Bytes()[ihdrEnd:]...)
+
+	out, err := ioutil.ReadAll(Strip(bytes.NewReader(in)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, enc.Bytes()) {
+		t.Fatalf("stripped png differs from the original without the text chunk")
+	}
+}
+
+func TestStripPassesOtherFormatsThrough(t *testing.T) {
+	in := "GIF89a not really a gif"
+	out, err := ioutil.ReadAll(Strip(strings.NewReader(in)))
+	if err != nil || string(out) != in {
+		t.Fatalf("Strip changed %q to %q, err = %v", in, out, err)
+	}
+}
+
+func TestStripTruncatedJPEG(t *testing.T) {
+	in := testJPEG(t)
+	if _, err := ioutil.ReadAll(Strip(bytes.NewReader(in[:30]))); err == nil {
+		t.Fatal("a jpeg cut off within a segment was stripped without an error")
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	m := Parse(testJPEG(t)).Redacted()
+	if *m != (Metadata{Width: 8, Height: 4, Orientation: 6, Stripped: true}) {
+		t.Fatalf("redacted %+v", m)
+	}
+}
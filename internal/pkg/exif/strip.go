@@ -0,0 +1,150 @@
+package exif
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+	errInvalidJPEG = errors.New("invalid jpeg stream")
+)
+
+// stripper is a streaming filter which drops metadata segments/chunks
+// and copies everything else through without buffering the image data.
+type stripper struct {
+	r     *bufio.Reader
+	out   []byte
+	copyN int64
+	rest  bool
+	next  func() error
+	err   error
+}
+
+// Strip returns a reader yielding the image from r without personal metadata
+// (Exif incl. GPS, XMP, IPTC, comments). Formats other than JPEG and PNG pass through unchanged.
+func Strip(r io.Reader) io.Reader {
+	s := &stripper{r: bufio.NewReader(r)}
+	head, _ := s.r.Peek(len(pngSignature))
+	switch {
+	case len(head) >= 2 && head[0] == 0xFF && head[1] == 0xD8:
+		s.next = s.jpegSegment
+	case bytes.Equal(head, pngSignature):
+		_, _ = s.r.Discard(len(pngSignature))
+		s.out = pngSignature
+		s.next = s.pngChunk
+	default:
+		s.rest = true
+	}
+	return s
+}
+
+func (s *stripper) Read(p []byte) (int, error) {
+	for {
+		if len(s.out) > 0 {
+			n := copy(p, s.out)
+			s.out = s.out[n:]
+			return n, nil
+		}
+		if s.copyN > 0 {
+			if int64(len(p)) > s.copyN {
+				p = p[:s.copyN]
+			}
+			n, err := s.r.Read(p)
+			s.copyN -= int64(n)
+			if err == io.EOF && s.copyN > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		if s.rest {
+			return s.r.Read(p)
+		}
+		if s.err != nil {
+			return 0, s.err
+		}
+		s.err = s.next()
+	}
+}
+
+func (s *stripper) jpegSegment() error {
+	b, err := s.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b != 0xFF {
+		return errInvalidJPEG
+	}
+	marker := byte(0xFF)
+	for marker == 0xFF {
+		if marker, err = s.r.ReadByte(); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+	}
+
+	switch {
+	case marker == 0xD8 || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+		s.out = []byte{0xFF, marker}
+		return nil
+	case marker == 0xD9 || marker == 0xDA:
+		// Entropy coded data follows SOS, nothing after it is metadata we handle.
+		s.out = []byte{0xFF, marker}
+		s.rest = true
+		return nil
+	}
+
+	var l [2]byte
+	if _, err = io.ReadFull(s.r, l[:]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	n := int64(binary.BigEndian.Uint16(l[:])) - 2
+	if n < 0 {
+		return errInvalidJPEG
+	}
+
+	// APP1 (Exif/XMP), APP13 (IPTC) and COM carry personal metadata.
+	if marker != 0xE1 && marker != 0xED && marker != 0xFE {
+		s.out = []byte{0xFF, marker, l[0], l[1]}
+		s.copyN = n
+		return nil
+	}
+
+	payload := make([]byte, n)
+	if _, err = io.ReadFull(s.r, payload); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if marker == 0xE1 && bytes.HasPrefix(payload, exifHeader) {
+		var m Metadata
+		if parseTIFF(payload[len(exifHeader):], &m) == nil && m.Orientation > 1 {
+			s.out = orientationSegment(m.Orientation)
+		}
+	}
+	return nil
+}
+
+func (s *stripper) pngChunk() error {
+	var hdr [8]byte
+	if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+		if err == io.EOF {
+			return io.EOF
+		}
+		return io.ErrUnexpectedEOF
+	}
+	n := int64(binary.BigEndian.Uint32(hdr[:4])) + 4 // data plus crc
+
+	switch string(hdr[4:]) {
+	case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		if _, err := io.CopyN(ioutil.Discard, s.r, n); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+	default:
+		s.out = append([]byte(nil), hdr[:]...)
+		s.copyN = n
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+// Package imaging provides pure Go image resizing, cropping and format conversion.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	FitContain = "contain"
+	FitCover   = "cover"
+	FitFill    = "fill"
+
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatGIF  = "gif"
+
+	MaxDimension = 4096
+	MaxPixels    = 50 * 1000 * 1000
+
+	defaultQuality = 80
+)
+
+var (
+	errOptionsInvalid = errors.New("invalid transform options")
+
+	ErrTooLarge = errors.New("source image is too large")
+)
+
+// Options describes a single image transformation.
+type Options struct {
+	Width   int
+	Height  int
+	Fit     string
+	Format  string
+	Quality int
+}
+
+// ParseOptions reads transform options from query params (w, h, fit, format, q).
+func ParseOptions(v url.Values) (Options, error) {
+	var o Options
+	var err error
+	if s := v.Get("w"); s != "" {
+		if o.Width, err = strconv.Atoi(s); err != nil {
+			return o, fmt.Errorf("%v: w: %w", errOptionsInvalid, err)
+		}
+	}
+	if s := v.Get("h"); s != "" {
+		if o.Height, err = strconv.Atoi(s); err != nil {
+			return o, fmt.Errorf("%v: h: %w", errOptionsInvalid, err)
+		}
+	}
+	if s := v.Get("q"); s != "" {
+		if o.Quality, err = strconv.Atoi(s); err != nil {
+			return o, fmt.Errorf("%v: q: %w", errOptionsInvalid, err)
+		}
+	}
+	o.Fit = strings.ToLower(v.Get("fit"))
+	o.Format = strings.ToLower(v.Get("format"))
+	return o.normalize()
+}
+
+func (o Options) normalize() (Options, error) {
+	if o.Width < 0 || o.Height < 0 || o.Width > MaxDimension || o.Height > MaxDimension {
+		return o, fmt.Errorf("%v: dimensions must be between 0 and %d", errOptionsInvalid, MaxDimension)
+	}
+	if o.Width == 0 && o.Height == 0 {
+		return o, fmt.Errorf("%v: w or h is required", errOptionsInvalid)
+	}
+	switch o.Fit {
+	case "":
+		o.Fit = FitContain
+	case FitContain, FitCover, FitFill:
+	default:
+		return o, fmt.Errorf("%v: unknown fit %q", errOptionsInvalid, o.Fit)
+	}
+	switch o.Format {
+	case "", "jpg":
+		o.Format = FormatJPEG
+	case FormatJPEG, FormatPNG, FormatGIF:
+	default:
+		return o, fmt.Errorf("%v: unknown format %q", errOptionsInvalid, o.Format)
+	}
+	if o.Quality == 0 {
+		o.Quality = defaultQuality
+	}
+	if o.Quality < 1 || o.Quality > 100 {
+		return o, fmt.Errorf("%v: q must be between 1 and 100", errOptionsInvalid)
+	}
+	return o, nil
+}
+
+// Canonical returns a stable string representation of the options,
+// used both for signing and as a cache key.
+func (o Options) Canonical() string {
+	return fmt.Sprintf("fit=%s&format=%s&h=%d&q=%d&w=%d", o.Fit, o.Format, o.Height, o.Quality, o.Width)
+}
+
+// ContentType returns the mime type of the output format.
+func (o Options) ContentType() string {
+	return "image/" + o.Format
+}
+
+// ReadSource reads an encoded image of at most maxBytes into memory. The header is checked first,
+// so an image which would decode to more than MaxPixels is rejected before the rest is read.
+func ReadSource(r io.Reader, maxBytes int64) ([]byte, error) {
+	var buf bytes.Buffer
+	limited := io.LimitReader(r, maxBytes+1)
+	if err := checkConfig(io.TeeReader(limited, &buf)); err != nil {
+		return nil, err
+	}
+	if _, err := buf.ReadFrom(limited); err != nil {
+		return nil, err
+	}
+	if int64(buf.Len()) > maxBytes {
+		return nil, ErrTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
+func checkConfig(r io.Reader) error {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > MaxPixels {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+// Transform decodes the source image, resizes it according to o,
+// and encodes the result to w.
+func Transform(src io.ReadSeeker, w io.Writer, o Options) error {
+	if err := checkConfig(src); err != nil {
+		return err
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return err
+	}
+
+	return encode(w, resize(img, o), o)
+}
+
+func encode(w io.Writer, img image.Image, o Options) error {
+	switch o.Format {
+	case FormatPNG:
+		return png.Encode(w, img)
+	case FormatGIF:
+		return gif.Encode(w, img, nil)
+	default:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: o.Quality})
+	}
+}
+
+// resize computes the target geometry for the fit mode and scales the source into it.
+func resize(img image.Image, o Options) image.Image {
+	sb := img.Bounds()
+	sw, sh := float64(sb.Dx()), float64(sb.Dy())
+	tw, th := float64(o.Width), float64(o.Height)
+
+	// A missing dimension keeps the aspect ratio, for very wide or tall images it is clamped like
+	// the requested one.
+	if tw == 0 {
+		tw = clamp(math.Round(sw * th / sh))
+	}
+	if th == 0 {
+		th = clamp(math.Round(sh * tw / sw))
+	}
+
+	crop := sb
+	switch o.Fit {
+	case FitContain:
+		ratio := math.Min(tw/sw, th/sh)
+		tw, th = math.Max(1, math.Round(sw*ratio)), math.Max(1, math.Round(sh*ratio))
+	case FitCover:
+		ratio := math.Max(tw/sw, th/sh)
+		cw := int(math.Max(1, math.Round(tw/ratio)))
+		ch := int(math.Max(1, math.Round(th/ratio)))
+		x0 := sb.Min.X + (sb.Dx()-cw)/2
+		y0 := sb.Min.Y + (sb.Dy()-ch)/2
+		crop = image.Rect(x0, y0, x0+cw, y0+ch)
+	}
+
+	return scale(img, crop, int(tw), int(th))
+}
+
+// scale resamples the src rectangle of img into a w x h image using bilinear interpolation.
+func scale(img image.Image, src image.Rectangle, w, h int) *image.RGBA {
+	in := image.NewRGBA(image.Rect(0, 0, src.Dx(), src.Dy()))
+	draw.Draw(in, in.Bounds(), img, src.Min, draw.Src)
+
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	xr := float64(src.Dx()) / float64(w)
+	yr := float64(src.Dy()) / float64(h)
+	maxX, maxY := src.Dx()-1, src.Dy()-1
+
+	for y := 0; y < h; y++ {
+		fy := math.Max(0, (float64(y)+0.5)*yr-0.5)
+		y0 := int(fy)
+		y1 := minInt(y0+1, maxY)
+		dy := fy - float64(y0)
+		for x := 0; x < w; x++ {
+			fx := math.Max(0, (float64(x)+0.5)*xr-0.5)
+			x0 := int(fx)
+			x1 := minInt(x0+1, maxX)
+			dx := fx - float64(x0)
+
+			c00 := in.RGBAAt(x0, y0)
+			c10 := in.RGBAAt(x1, y0)
+			c01 := in.RGBAAt(x0, y1)
+			c11 := in.RGBAAt(x1, y1)
+			out.SetRGBA(x, y, color.RGBA{
+				R: lerp(c00.R, c10.R, c01.R, c11.R, dx, dy),
+				G: lerp(c00.G, c10.G, c01.G, c11.G, dx, dy),
+				B: lerp(c00.B, c10.B, c01.B, c11.B, dx, dy),
+				A: lerp(c00.A, c10.A, c01.A, c11.A, dx, dy),
+			})
+		}
+	}
+	return out
+}
+
+func lerp(c00, c10, c01, c11 uint8, dx, dy float64) uint8 {
+	top := float64(c00)*(1-dx) + float64(c10)*dx
+	bottom := float64(c01)*(1-dx) + float64(c11)*dx
+	return uint8(math.Round(top*(1-dy) + bottom*dy))
+}
+
+func clamp(d float64) float64 {
+	return math.Min(MaxDimension, math.Max(1, d))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,141 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"net/url"
+	"testing"
+)
+
+func encodePNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 0x80, A: 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// hugeGIF returns a GIF whose header claims a 65535x65535 canvas, about 4.3 billion pixels.
+func hugeGIF(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	img := image.NewPaletted(image.Rect(0, 0, 1, 1), []color.Color{color.Black, color.White})
+	if err := gif.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	// The logical screen width and height follow the 6 byte signature, little endian.
+	b[6], b[7], b[8], b[9] = 0xff, 0xff, 0xff, 0xff
+	return b
+}
+
+// countingReader fails the test when more than max bytes are read.
+type countingReader struct {
+	r   *bytes.Reader
+	n   int
+	max int
+	t   *testing.T
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	if c.n > c.max {
+		c.t.Fatalf("read %d bytes, the header should have been enough", c.n)
+	}
+	return n, err
+}
+
+func TestReadSourceRejectsHugeImagesFromTheHeader(t *testing.T) {
+	// Padding stands in for the pixel data, it must not be read.
+	src := append(hugeGIF(t), make([]byte, 1<<20)...)
+	r := &countingReader{r: bytes.NewReader(src), max: 64 << 10, t: t}
+	if _, err := ReadSource(r, 64<<20); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("err = %v, want %v", err, ErrTooLarge)
+	}
+}
+
+func TestReadSourceLimitsBytes(t *testing.T) {
+	src := encodePNG(t, 64, 64)
+	if _, err := ReadSource(bytes.NewReader(src), int64(len(src)-1)); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("err = %v, want %v", err, ErrTooLarge)
+	}
+	b, err := ReadSource(bytes.NewReader(src), int64(len(src)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, src) {
+		t.Fatal("the source was not read completely")
+	}
+}
+
+func TestReadSourceRejectsNonImages(t *testing.T) {
+	if _, err := ReadSource(bytes.NewReader([]byte("not an image")), 1<<20); err == nil {
+		t.Fatal("a non image was accepted")
+	}
+}
+
+func TestTransformDimensions(t *testing.T) {
+	tests := []struct {
+		name         string
+		srcW, srcH   int
+		query        string
+		wantW, wantH int
+	}{
+		{name: "contain keeps the aspect ratio", srcW: 200, srcH: 100, query: "w=100&h=100", wantW: 100, wantH: 50},
+		{name: "cover fills the box", srcW: 200, srcH: 100, query: "w=50&h=50&fit=cover", wantW: 50, wantH: 50},
+		{name: "fill stretches", srcW: 200, srcH: 100, query: "w=30&h=70&fit=fill", wantW: 30, wantH: 70},
+		{name: "missing height is derived", srcW: 200, srcH: 100, query: "w=100&fit=fill", wantW: 100, wantH: 50},
+		{name: "derived height is at least 1", srcW: 2000, srcH: 1, query: "w=10&fit=fill", wantW: 10, wantH: 1},
+		{name: "derived width is at most MaxDimension", srcW: 2000, srcH: 1, query: "h=100&fit=cover", wantW: MaxDimension, wantH: 100},
+		{name: "contained width is at most MaxDimension", srcW: 2000, srcH: 1, query: "h=100", wantW: MaxDimension, wantH: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, _ := url.ParseQuery(tt.query + "&format=png")
+			o, err := ParseOptions(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			if err = Transform(bytes.NewReader(encodePNG(t, tt.srcW, tt.srcH)), &out, o); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := png.DecodeConfig(&out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Width != tt.wantW || cfg.Height != tt.wantH {
+				t.Fatalf("got %dx%d, want %dx%d", cfg.Width, cfg.Height, tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	for _, q := range []string{"", "w=-1", "w=5000", "w=10&fit=stretch", "w=10&format=bmp", "w=10&q=101", "w=x"} {
+		v, _ := url.ParseQuery(q)
+		if _, err := ParseOptions(v); err == nil {
+			t.Errorf("ParseOptions(%q) succeeded", q)
+		}
+	}
+	v, _ := url.ParseQuery("w=10&format=JPG")
+	o, err := ParseOptions(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := o.Canonical(), "fit=contain&format=jpeg&h=0&q=80&w=10"; got != want {
+		t.Fatalf("Canonical() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,175 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is a plain text SMTP server accepting a single connection, it records the commands and the data it
+// received. It doesn't offer STARTTLS.
+type fakeSMTP struct {
+	ln       net.Listener
+	commands []string
+	data     string
+	done     chan struct{}
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{ln: ln, done: make(chan struct{})}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeSMTP) serve() {
+	defer close(s.done)
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		_, _ = conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+	}
+
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimSpace(line)
+		s.commands = append(s.commands, strings.ToUpper(strings.SplitN(cmd, " ", 2)[0]))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			reply("250-fake", "250 8BITMIME")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			var b strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				b.WriteString(l)
+			}
+			s.data = b.String()
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *fakeSMTP) wait(t *testing.T) {
+	t.Helper()
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection wasn't closed")
+	}
+}
+
+// hasPrefix reports whether err is target with details appended.
+func hasPrefix(err error, target error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), target.Error())
+}
+
+func TestSMTPInsecureDelivers(t *testing.T) {
+	srv := newFakeSMTP(t)
+	m, err := New("smtp://"+srv.ln.Addr().String()+"?insecure=true", "ekanek <no-reply@ekanek.local>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Send(context.Background(), Message{To: "user@example.com", Subject: "Reset your password", Body: "token\nline"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.wait(t)
+
+	if got, want := strings.Join(srv.commands, " "), "EHLO MAIL RCPT DATA QUIT"; got != want {
+		t.Fatalf("commands %q, want %q", got, want)
+	}
+	for _, want := range []string{"To: user@example.com\r\n", "Subject: Reset your password\r\n", "\r\n\r\ntoken\r\nline\r\n"} {
+		if !strings.Contains(srv.data, want) {
+			t.Errorf("data %q doesn't contain %q", srv.data, want)
+		}
+	}
+}
+
+func TestSMTPRequiresSTARTTLS(t *testing.T) {
+	srv := newFakeSMTP(t)
+	m, err := New("smtp://"+srv.ln.Addr().String(), "no-reply@ekanek.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Send(context.Background(), Message{To: "user@example.com", Subject: "Reset your password", Body: "token"})
+	if !hasPrefix(err, errTLSRequired) {
+		t.Fatalf("err = %v, want %v", err, errTLSRequired)
+	}
+	srv.wait(t)
+	for _, c := range srv.commands {
+		if c == "MAIL" || c == "DATA" {
+			t.Fatalf("sent %s without TLS", c)
+		}
+	}
+}
+
+func TestFormatRejectsHeaderInjection(t *testing.T) {
+	for _, m := range []Message{
+		{To: "user@example.com\r\nBcc: other@example.com", Subject: "hi"},
+		{To: "user@example.com", Subject: "hi\nBcc: other@example.com"},
+		{To: "", Subject: "hi"},
+	} {
+		if _, err := format("no-reply@ekanek.local", m); !hasPrefix(err, errMessageInvalid) {
+			t.Errorf("format(%q) err = %v, want %v", m, err, errMessageInvalid)
+		}
+	}
+}
+
+func TestLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := &Log{From: "no-reply@ekanek.local", W: &buf}
+	if err := l.Send(context.Background(), Message{To: "user@example.com", Subject: "hi", Body: "body"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "To: user@example.com\r\n") || !strings.HasSuffix(buf.String(), "body\r\n\r\n") {
+		t.Fatalf("wrote %q", buf.String())
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, addr := range []string{"smtp://", "file://", "http://example.com", "smtp://%zz"} {
+		if _, err := New(addr, "no-reply@ekanek.local"); err == nil {
+			t.Errorf("New(%q) succeeded", addr)
+		}
+	}
+	m, err := New("smtp://mailhog:1025?insecure=true", "no-reply@ekanek.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := m.(*SMTP); !ok || !s.Insecure || s.Address != "mailhog:1025" {
+		t.Fatalf("New returned %#v", m)
+	}
+	if m, _ = New("smtp://mail.example.com:587", "no-reply@ekanek.local"); m.(*SMTP).Insecure {
+		t.Fatal("smtp is insecure without opting in")
+	}
+}
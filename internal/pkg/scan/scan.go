@@ -0,0 +1,147 @@
+// Package scan provides malware scanning of asset content.
+package scan
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultChunkSize = 64 << 10
+	defaultTimeout   = 5 * time.Minute
+)
+
+var (
+	errConfigInvalid = errors.New("invalid clamd address")
+	errClamd         = errors.New("clamd scan failed")
+)
+
+// Result is the verdict for a scanned stream.
+type Result struct {
+	Infected  bool
+	Signature string
+}
+
+// Scanner inspects content for malware.
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
+
+// Nop is the default scanner, it reports every stream as clean.
+type Nop struct{}
+
+// Scan drains r and reports it clean.
+func (Nop) Scan(_ context.Context, r io.Reader) (Result, error) {
+	_, err := io.Copy(ioutil.Discard, r)
+	return Result{}, err
+}
+
+// Clamd speaks the clamd INSTREAM protocol over a TCP or Unix socket.
+type Clamd struct {
+	Network   string
+	Address   string
+	ChunkSize int
+	Timeout   time.Duration
+}
+
+// NewClamd parses an address of the form tcp://host:port or unix:///path/to/clamd.sock.
+func NewClamd(addr string) (*Clamd, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", errConfigInvalid, err)
+	}
+
+	c := &Clamd{
+		Network:   u.Scheme,
+		ChunkSize: defaultChunkSize,
+		Timeout:   defaultTimeout,
+	}
+	switch u.Scheme {
+	case "tcp":
+		c.Address = u.Host
+	case "unix":
+		c.Address = u.Path
+	default:
+		return nil, errConfigInvalid
+	}
+	if c.Address == "" {
+		return nil, errConfigInvalid
+	}
+	return c, nil
+}
+
+// Scan streams r to clamd in length prefixed chunks and parses the verdict.
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(c.Timeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	if err = conn.SetDeadline(deadline); err != nil {
+		return Result{}, err
+	}
+
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return Result{}, err
+	}
+
+	buf := make([]byte, 4+c.ChunkSize)
+	for {
+		n, rerr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err = conn.Write(buf[:4+n]); err != nil {
+				// clamd closes the connection early when the stream exceeds its size limit,
+				// the reply explaining why is still readable.
+				break
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return Result{}, rerr
+		}
+	}
+	if err == nil {
+		if _, err = conn.Write([]byte{0, 0, 0, 0}); err != nil {
+			return Result{}, err
+		}
+	}
+
+	reply, rerr := ioutil.ReadAll(conn)
+	if rerr != nil && len(reply) == 0 {
+		return Result{}, rerr
+	}
+	return parseReply(reply)
+}
+
+// parseReply reads replies like "stream: OK" or "stream: Eicar-Signature FOUND".
+func parseReply(b []byte) (Result, error) {
+	reply := strings.TrimSpace(string(bytes.TrimRight(b, "\x00")))
+	reply = strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case reply == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	default:
+		return Result{}, fmt.Errorf("%v: %s", errClamd, reply)
+	}
+}
@@ -0,0 +1,163 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd accepts a single INSTREAM connection and answers with reply once the stream ended,
+// or as soon as more than limit bytes were streamed when limit is set.
+type fakeClamd struct {
+	ln       net.Listener
+	reply    string
+	limit    int
+	command  string
+	received []byte
+	chunks   int
+	done     chan struct{}
+}
+
+func newFakeClamd(t *testing.T, reply string, limit int) *fakeClamd {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &fakeClamd{ln: ln, reply: reply, limit: limit, done: make(chan struct{})}
+	t.Cleanup(func() { ln.Close() })
+	go c.serve()
+	return c
+}
+
+func (c *fakeClamd) serve() {
+	defer close(c.done)
+	conn, err := c.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	if c.command, err = r.ReadString(0); err != nil {
+		return
+	}
+	for {
+		var size uint32
+		if err = binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		chunk := make([]byte, size)
+		if _, err = io.ReadFull(r, chunk); err != nil {
+			return
+		}
+		c.chunks++
+		c.received = append(c.received, chunk...)
+		if c.limit > 0 && len(c.received) > c.limit {
+			break
+		}
+	}
+	_, _ = conn.Write([]byte(c.reply + "\x00"))
+}
+
+func (c *fakeClamd) scanner(t *testing.T) *Clamd {
+	t.Helper()
+	s, err := NewClamd("tcp://" + c.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ChunkSize = 4
+	return s
+}
+
+func TestClamdScan(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		limit int
+		want  Result
+		err   error
+	}{
+		{name: "clean", reply: "stream: OK", want: Result{}},
+		{name: "infected", reply: "stream: Eicar-Signature FOUND", want: Result{Infected: true, Signature: "Eicar-Signature"}},
+		{name: "error", reply: "stream: Can't allocate memory ERROR", err: errClamd},
+		{name: "size limit", reply: "INSTREAM size limit exceeded. ERROR", limit: 4, err: errClamd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clamd := newFakeClamd(t, tt.reply, tt.limit)
+			content := []byte("0123456789")
+			got, err := clamd.scanner(t).Scan(context.Background(), bytes.NewReader(content))
+			<-clamd.done
+			if tt.err != nil {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err.Error()) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("result %+v, want %+v", got, tt.want)
+			}
+			if clamd.command != "zINSTREAM\x00" || !bytes.Equal(clamd.received, content) || clamd.chunks != 3 {
+				t.Fatalf("clamd got %q in %d chunks after %q", clamd.received, clamd.chunks, clamd.command)
+			}
+		})
+	}
+}
+
+func TestClamdScanFailsOnReadErrors(t *testing.T) {
+	clamd := newFakeClamd(t, "stream: OK", 0)
+	broken := io.MultiReader(strings.NewReader("0123"), errReader{})
+	if _, err := clamd.scanner(t).Scan(context.Background(), broken); !errors.Is(err, errBroken) {
+		t.Fatalf("err = %v, want %v", err, errBroken)
+	}
+}
+
+var errBroken = errors.New("broken")
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errBroken
+}
+
+func TestNewClamd(t *testing.T) {
+	for addr, want := range map[string]Clamd{
+		"tcp://clamd:3310":                 {Network: "tcp", Address: "clamd:3310"},
+		"unix:///var/run/clamav/clamd.ctl": {Network: "unix", Address: "/var/run/clamav/clamd.ctl"},
+	} {
+		c, err := NewClamd(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Network != want.Network || c.Address != want.Address {
+			t.Errorf("NewClamd(%q) = %s %s, want %s %s", addr, c.Network, c.Address, want.Network, want.Address)
+		}
+	}
+	for _, addr := range []string{"clamd:3310", "http://clamd:3310", "tcp://", "unix://", "%zz"} {
+		if _, err := NewClamd(addr); err == nil {
+			t.Errorf("NewClamd(%q) succeeded", addr)
+		}
+	}
+}
+
+func TestNop(t *testing.T) {
+	res, err := Nop{}.Scan(context.Background(), strings.NewReader("content"))
+	if err != nil || res.Infected {
+		t.Fatalf("Nop reported %+v, %v", res, err)
+	}
+}
@@ -0,0 +1,262 @@
+// Package queue provides a durable Postgres backed job queue with a worker pool,
+// retries with exponential backoff and a dead-letter state.
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Job states.
+const (
+	StatusQueued  = "queued"
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusDead    = "dead"
+)
+
+const (
+	defaultMaxAttempts = 5
+	baseBackoff        = 10 * time.Second
+	maxBackoff         = time.Hour
+)
+
+var (
+	errConfigInvalid = errors.New("invalid queue config")
+	errNoHandler     = errors.New("no handler registered for job kind")
+)
+
+// Querier is satisfied by both *sql.DB and *sql.Tx, so jobs can be enqueued
+// in the same transaction as the change which caused them.
+type Querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Job is a unit of work claimed by a worker.
+type Job struct {
+	ID          string
+	UserID      string
+	Kind        string
+	Payload     json.RawMessage
+	Attempts    int
+	MaxAttempts int
+}
+
+// Decode unmarshals the job payload into v.
+func (j Job) Decode(v interface{}) error {
+	return json.Unmarshal(j.Payload, v)
+}
+
+// Handler processes a job, a returned error schedules a retry.
+type Handler func(ctx context.Context, j Job) error
+
+// Entry describes a job to enqueue.
+type Entry struct {
+	UserID      string
+	Kind        string
+	Payload     interface{}
+	RunAt       time.Time
+	MaxAttempts int
+}
+
+// Config represents the configuration necessary for this pkg.
+type Config struct {
+	Workers      int
+	PollInterval time.Duration
+	LockTimeout  time.Duration
+}
+
+func (c Config) isValid() bool {
+	return c.Workers > 0 && c.PollInterval > 0 && c.LockTimeout > 0
+}
+
+// Queue claims jobs from the jobs table and dispatches them to registered handlers.
+type Queue struct {
+	db       *sql.DB
+	c        Config
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+// New initializes a queue.
+func New(c Config, db *sql.DB) (*Queue, error) {
+	if !c.isValid() {
+		return nil, errConfigInvalid
+	}
+	return &Queue{
+		db:       db,
+		c:        c,
+		handlers: make(map[string]Handler),
+	}, nil
+}
+
+// Register sets the handler for a job kind.
+func (q *Queue) Register(kind string, h Handler) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handlers[kind] = h
+}
+
+// Enqueue inserts a job and returns its id.
+func Enqueue(ctx context.Context, db Querier, e Entry) (string, error) {
+	payload, err := json.Marshal(e.Payload)
+	if err != nil {
+		return "", err
+	}
+	if e.MaxAttempts == 0 {
+		e.MaxAttempts = defaultMaxAttempts
+	}
+	if e.RunAt.IsZero() {
+		e.RunAt = time.Now()
+	}
+	var uid sql.NullString
+	if e.UserID != "" {
+		uid = sql.NullString{String: e.UserID, Valid: true}
+	}
+
+	var query = `
+		INSERT INTO jobs (
+            uid,
+            kind,
+            payload,
+            run_at,
+            max_attempts
+        ) VALUES (
+            $1,
+            $2,
+            $3,
+            $4,
+            $5
+        ) RETURNING id`
+	id := ""
+	err = db.QueryRowContext(ctx, query, uid, e.Kind, payload, e.RunAt, e.MaxAttempts).Scan(&id)
+	return id, err
+}
+
+// Run starts the worker pool and blocks until ctx is cancelled and all workers have returned.
+func (q *Queue) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < q.c.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *Queue) work(ctx context.Context) {
+	for {
+		j, err := q.claim(ctx)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) && ctx.Err() == nil {
+			log.Println("Error claiming job: ", err.Error())
+		}
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(q.c.PollInterval):
+			}
+			continue
+		}
+		stop := q.heartbeat(ctx, j.ID)
+		err = q.execute(ctx, j)
+		stop()
+		q.finish(j, err)
+	}
+}
+
+// heartbeat renews the lock of a running job until stop is called, so jobs running longer than
+// the lock timeout aren't claimed by another worker while they're still in progress.
+func (q *Queue) heartbeat(ctx context.Context, id string) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(q.c.LockTimeout / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			_, err := q.db.ExecContext(ctx, `UPDATE jobs SET locked_at = NOW() WHERE id = $1 AND status = $2`, id, StatusRunning)
+			if err != nil && ctx.Err() == nil {
+				log.Println("Error renewing job lock: ", id, err.Error())
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// claim locks the next runnable job. Jobs left running by a crashed worker
+// become claimable again once their lock times out, running jobs renew their lock.
+func (q *Queue) claim(ctx context.Context) (Job, error) {
+	var query = `
+		UPDATE jobs SET status = $1, locked_at = NOW(), attempts = attempts + 1
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE (status = $2 AND run_at <= NOW())
+			   OR (status = $1 AND locked_at < NOW() - make_interval(secs => $3))
+			ORDER BY run_at
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		) RETURNING id, COALESCE(uid::text, ''), kind, payload, attempts, max_attempts`
+	var j Job
+	err := q.db.QueryRowContext(ctx, query, StatusRunning, StatusQueued, q.c.LockTimeout.Seconds()).
+		Scan(&j.ID, &j.UserID, &j.Kind, &j.Payload, &j.Attempts, &j.MaxAttempts)
+	return j, err
+}
+
+func (q *Queue) execute(ctx context.Context, j Job) (err error) {
+	q.mu.RLock()
+	h, ok := q.handlers[j.Kind]
+	q.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", errNoHandler, j.Kind)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("job panicked: %v", p)
+		}
+	}()
+	return h(ctx, j)
+}
+
+// finish records the outcome. Failed jobs are retried with backoff until
+// they run out of attempts, then they are moved to the dead state.
+func (q *Queue) finish(j Job, jobErr error) {
+	var err error
+	switch {
+	case jobErr == nil:
+		_, err = q.db.Exec(`UPDATE jobs SET status = $1, locked_at = NULL, last_error = NULL WHERE id = $2`, StatusDone, j.ID)
+	case j.Attempts >= j.MaxAttempts || errors.Is(jobErr, errNoHandler):
+		log.Println("Job moved to dead letter: ", j.ID, j.Kind, jobErr.Error())
+		_, err = q.db.Exec(`UPDATE jobs SET status = $1, locked_at = NULL, last_error = $2 WHERE id = $3`, StatusDead, jobErr.Error(), j.ID)
+	default:
+		log.Println("Job failed, retrying: ", j.ID, j.Kind, jobErr.Error())
+		runAt := time.Now().Add(backoff(j.Attempts))
+		_, err = q.db.Exec(`UPDATE jobs SET status = $1, locked_at = NULL, last_error = $2, run_at = $3 WHERE id = $4`,
+			StatusQueued, jobErr.Error(), runAt, j.ID)
+	}
+	if err != nil {
+		log.Println("Error updating job status: ", j.ID, err.Error())
+	}
+}
+
+// backoff doubles the delay on every attempt, with up to 20% jitter.
+func backoff(attempts int) time.Duration {
+	d := baseBackoff << uint(attempts-1)
+	if d <= 0 || d > maxBackoff {
+		d = maxBackoff
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
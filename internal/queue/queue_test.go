@@ -0,0 +1,150 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/hitesh-goel/ekanek/internal/pkg/dbtest"
+	"testing"
+	"time"
+)
+
+func newTestQueue(t *testing.T, db *sql.DB, lockTimeout time.Duration) *Queue {
+	t.Helper()
+	q, err := New(Config{Workers: 1, PollInterval: time.Second, LockTimeout: lockTimeout}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func claim(t *testing.T, q *Queue) Job {
+	t.Helper()
+	j, err := q.claim(context.Background())
+	if err != nil {
+		t.Fatalf("claiming a job: %v", err)
+	}
+	return j
+}
+
+func status(t *testing.T, db *sql.DB, id string) (string, sql.NullString) {
+	t.Helper()
+	var s string
+	var lastError sql.NullString
+	if err := db.QueryRow(`SELECT status, last_error FROM jobs WHERE id = $1`, id).Scan(&s, &lastError); err != nil {
+		t.Fatal(err)
+	}
+	return s, lastError
+}
+
+func TestNew(t *testing.T) {
+	for _, c := range []Config{
+		{PollInterval: time.Second, LockTimeout: time.Minute},
+		{Workers: 1, LockTimeout: time.Minute},
+		{Workers: 1, PollInterval: time.Second},
+	} {
+		if _, err := New(c, nil); !errors.Is(err, errConfigInvalid) {
+			t.Errorf("New(%+v) err = %v, want %v", c, err, errConfigInvalid)
+		}
+	}
+}
+
+func TestExecute(t *testing.T) {
+	q := newTestQueue(t, nil, time.Minute)
+	q.Register("panic", func(context.Context, Job) error {
+		panic("boom")
+	})
+	if err := q.execute(context.Background(), Job{Kind: "panic"}); err == nil {
+		t.Fatal("a panicking job succeeded")
+	}
+	if err := q.execute(context.Background(), Job{Kind: "unknown"}); !errors.Is(err, errNoHandler) {
+		t.Fatalf("err = %v, want %v", err, errNoHandler)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempts, base := range map[int]time.Duration{1: baseBackoff, 2: 2 * baseBackoff, 9: 256 * baseBackoff, 64: maxBackoff} {
+		got := backoff(attempts)
+		if got < base || got > base+base/5 {
+			t.Errorf("backoff(%d) = %v, want between %v and %v", attempts, got, base, base+base/5)
+		}
+	}
+}
+
+func TestRetriesThenDeadLetters(t *testing.T) {
+	db := dbtest.New(t)
+	q := newTestQueue(t, db, time.Minute)
+	ctx := context.Background()
+	q.Register("fail", func(context.Context, Job) error {
+		return errors.New("unavailable")
+	})
+	id, err := Enqueue(ctx, db, Entry{Kind: "fail", Payload: map[string]string{"a": "b"}, MaxAttempts: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j := claim(t, q)
+	if j.ID != id || j.Attempts != 1 || string(j.Payload) != `{"a": "b"}` {
+		t.Fatalf("claimed %+v", j)
+	}
+	q.finish(j, q.execute(ctx, j))
+	if s, lastError := status(t, db, id); s != StatusQueued || lastError.String != "unavailable" {
+		t.Fatalf("status %s, last error %q after the first attempt, want %s", s, lastError.String, StatusQueued)
+	}
+	if _, err = q.claim(ctx); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("claimed a job before its backoff passed, err = %v", err)
+	}
+
+	if _, err = db.Exec(`UPDATE jobs SET run_at = NOW() WHERE id = $1`, id); err != nil {
+		t.Fatal(err)
+	}
+	j = claim(t, q)
+	q.finish(j, q.execute(ctx, j))
+	if s, _ := status(t, db, id); s != StatusDead {
+		t.Fatalf("status %s after the last attempt, want %s", s, StatusDead)
+	}
+}
+
+func TestReclaimsExpiredLocks(t *testing.T) {
+	db := dbtest.New(t)
+	q := newTestQueue(t, db, time.Minute)
+	ctx := context.Background()
+	id, err := Enqueue(ctx, db, Entry{Kind: "crash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claim(t, q)
+	if _, err = q.claim(ctx); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("claimed a running job, err = %v", err)
+	}
+	// The worker died without finishing the job.
+	if _, err = db.Exec(`UPDATE jobs SET locked_at = NOW() - INTERVAL '2 minutes' WHERE id = $1`, id); err != nil {
+		t.Fatal(err)
+	}
+	if j := claim(t, q); j.ID != id || j.Attempts != 2 {
+		t.Fatalf("claimed %+v, want the abandoned job on its second attempt", j)
+	}
+}
+
+func TestHeartbeatKeepsLongJobsLocked(t *testing.T) {
+	db := dbtest.New(t)
+	q := newTestQueue(t, db, 300*time.Millisecond)
+	ctx := context.Background()
+	if _, err := Enqueue(ctx, db, Entry{Kind: "long"}); err != nil {
+		t.Fatal(err)
+	}
+
+	j := claim(t, q)
+	stop := q.heartbeat(ctx, j.ID)
+	time.Sleep(time.Second)
+	if _, err := q.claim(ctx); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("claimed a job which is still running, err = %v", err)
+	}
+	stop()
+
+	time.Sleep(time.Second)
+	if j2 := claim(t, q); j2.ID != j.ID {
+		t.Fatalf("claimed %s, want %s once its worker stopped renewing the lock", j2.ID, j.ID)
+	}
+}
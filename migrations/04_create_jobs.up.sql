@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS jobs
+(
+    id           UUID PRIMARY KEY     DEFAULT uuid_generate_v1mc(),
+    uid          UUID,
+    kind         TEXT        NOT NULL,
+    payload      JSONB       NOT NULL DEFAULT '{}',
+    status       TEXT        NOT NULL DEFAULT 'queued',
+    attempts     INT         NOT NULL DEFAULT 0,
+    max_attempts INT         NOT NULL DEFAULT 5,
+    run_at       TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    locked_at    TIMESTAMPTZ,
+    last_error   TEXT,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT fk_uid
+        FOREIGN KEY (uid)
+            REFERENCES users (uid)
+);
+
+CREATE INDEX IF NOT EXISTS jobs_status_run_at_idx ON jobs (status, run_at);
+
+CREATE TRIGGER jobs_updated_at_trigger
+    BEFORE UPDATE
+    ON jobs
+    FOR EACH ROW
+EXECUTE PROCEDURE updated_at_fn();
@@ -0,0 +1 @@
+ALTER TABLE assets ADD COLUMN checksum TEXT;
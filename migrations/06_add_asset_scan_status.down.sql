@@ -0,0 +1,2 @@
+DELETE FROM jobs WHERE kind = 'asset.scan';
+ALTER TABLE assets DROP COLUMN scan_status, DROP COLUMN scan_signature;
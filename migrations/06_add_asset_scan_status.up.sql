@@ -0,0 +1,7 @@
+ALTER TABLE assets ADD COLUMN scan_status TEXT NOT NULL DEFAULT 'pending', ADD COLUMN scan_signature TEXT;
+
+-- Existing assets were never scanned, queue them for the scanner.
+INSERT INTO jobs (uid, kind, payload)
+SELECT uid, 'asset.scan', json_build_object('asset_id', id)
+FROM assets
+WHERE is_active = true;
@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN quota_bytes;
+ALTER TABLE assets DROP COLUMN original_bytes, DROP COLUMN stored_bytes;
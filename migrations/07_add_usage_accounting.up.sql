@@ -0,0 +1,9 @@
+ALTER TABLE assets ADD COLUMN original_bytes BIGINT NOT NULL DEFAULT 0, ADD COLUMN stored_bytes BIGINT NOT NULL DEFAULT 0;
+
+-- NULL means the quota configured on the server applies.
+ALTER TABLE users ADD COLUMN quota_bytes BIGINT;
+
+-- Backfill sizes of existing assets, the hash job records them along with the checksum.
+INSERT INTO jobs (uid, kind, payload)
+SELECT uid, 'asset.hash', json_build_object('asset_id', id)
+FROM assets;
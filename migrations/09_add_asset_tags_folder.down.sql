@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS assets_uid_folder_idx;
+DROP INDEX IF EXISTS assets_tags_idx;
+ALTER TABLE assets DROP COLUMN tags, DROP COLUMN folder;
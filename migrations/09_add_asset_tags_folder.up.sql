@@ -0,0 +1,4 @@
+ALTER TABLE assets ADD COLUMN tags TEXT[] NOT NULL DEFAULT '{}', ADD COLUMN folder TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS assets_tags_idx ON assets USING GIN (tags);
+CREATE INDEX IF NOT EXISTS assets_uid_folder_idx ON assets (uid, folder);
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS asset_events
+(
+    id         BIGSERIAL PRIMARY KEY,
+    asset_id   UUID        NOT NULL,
+    kind       TEXT        NOT NULL,
+    via        TEXT        NOT NULL,
+    uid        UUID,
+    bytes_sent BIGINT      NOT NULL DEFAULT 0,
+    user_agent TEXT,
+    client_ip  TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT fk_asset_id
+        FOREIGN KEY (asset_id)
+            REFERENCES assets (id)
+            ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS asset_events_asset_id_created_at_idx ON asset_events (asset_id, created_at);
@@ -0,0 +1,49 @@
+CREATE TABLE IF NOT EXISTS webhooks
+(
+    id         UUID PRIMARY KEY     DEFAULT uuid_generate_v1mc(),
+    uid        UUID        NOT NULL,
+    url        TEXT        NOT NULL,
+    secret     TEXT        NOT NULL,
+    events     TEXT[]      NOT NULL,
+    is_active  BOOLEAN     NOT NULL DEFAULT true,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT fk_uid
+        FOREIGN KEY (uid)
+            REFERENCES users (uid)
+);
+
+CREATE INDEX IF NOT EXISTS webhooks_uid_idx ON webhooks (uid);
+
+CREATE TRIGGER webhooks_updated_at_trigger
+    BEFORE UPDATE
+    ON webhooks
+    FOR EACH ROW
+EXECUTE PROCEDURE updated_at_fn();
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+    id              UUID PRIMARY KEY     DEFAULT uuid_generate_v1mc(),
+    webhook_id      UUID        NOT NULL,
+    event           TEXT        NOT NULL,
+    payload         JSONB       NOT NULL,
+    status          TEXT        NOT NULL DEFAULT 'pending',
+    attempts        INT         NOT NULL DEFAULT 0,
+    response_status INT,
+    last_error      TEXT,
+    delivered_at    TIMESTAMPTZ,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT fk_webhook_id
+        FOREIGN KEY (webhook_id)
+            REFERENCES webhooks (id)
+            ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_created_at_idx ON webhook_deliveries (webhook_id, created_at);
+
+CREATE TRIGGER webhook_deliveries_updated_at_trigger
+    BEFORE UPDATE
+    ON webhook_deliveries
+    FOR EACH ROW
+EXECUTE PROCEDURE updated_at_fn();
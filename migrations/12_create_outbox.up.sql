@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS outbox
+(
+    id             BIGSERIAL PRIMARY KEY,
+    aggregate_type TEXT        NOT NULL,
+    aggregate_id   TEXT        NOT NULL,
+    uid            UUID,
+    type           TEXT        NOT NULL,
+    payload        JSONB       NOT NULL DEFAULT '{}',
+    attempts       INT         NOT NULL DEFAULT 0,
+    last_error     TEXT,
+    available_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    published_at   TIMESTAMPTZ,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS outbox_unpublished_idx ON outbox (id) WHERE published_at IS NULL;
+CREATE INDEX IF NOT EXISTS outbox_unpublished_aggregate_idx ON outbox (aggregate_type, aggregate_id, id) WHERE published_at IS NULL;
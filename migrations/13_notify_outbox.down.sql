@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS outbox_notify_trigger ON outbox;
+DROP FUNCTION IF EXISTS outbox_notify_fn();
+DROP INDEX IF EXISTS outbox_uid_id_idx;
@@ -0,0 +1,17 @@
+CREATE INDEX IF NOT EXISTS outbox_uid_id_idx ON outbox (uid, id);
+
+-- Listeners are only woken up with the ids, they read the events from the outbox table.
+CREATE OR REPLACE FUNCTION outbox_notify_fn()
+    RETURNS TRIGGER AS
+$$
+BEGIN
+    PERFORM pg_notify('outbox_events', json_build_object('id', NEW.id, 'uid', NEW.uid)::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER outbox_notify_trigger
+    AFTER INSERT
+    ON outbox
+    FOR EACH ROW
+EXECUTE PROCEDURE outbox_notify_fn();
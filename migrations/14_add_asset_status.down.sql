@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS jobs_asset_id_idx;
+ALTER TABLE assets DROP COLUMN status;
@@ -0,0 +1,8 @@
+ALTER TABLE assets ADD COLUMN status TEXT NOT NULL DEFAULT 'ready';
+
+UPDATE assets SET status = 'processing' WHERE scan_status = 'pending';
+UPDATE assets SET status = 'failed' WHERE scan_status = 'infected';
+
+ALTER TABLE assets ALTER COLUMN status SET DEFAULT 'uploading';
+
+CREATE INDEX IF NOT EXISTS jobs_asset_id_idx ON jobs ((payload ->> 'asset_id'));
@@ -0,0 +1 @@
+ALTER TABLE assets DROP COLUMN key_id, DROP COLUMN data_key;
@@ -0,0 +1 @@
+ALTER TABLE assets ADD COLUMN key_id TEXT, ADD COLUMN data_key BYTEA;
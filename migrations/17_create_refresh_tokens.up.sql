@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS refresh_tokens
+(
+    id         UUID PRIMARY KEY     DEFAULT uuid_generate_v1mc(),
+    uid        UUID        NOT NULL,
+    family_id  UUID        NOT NULL,
+    token_hash TEXT        NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at    TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (token_hash),
+    CONSTRAINT fk_uid
+        FOREIGN KEY (uid)
+            REFERENCES users (uid)
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+CREATE INDEX IF NOT EXISTS refresh_tokens_uid_idx ON refresh_tokens (uid);
@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS api_keys
+(
+    id           UUID PRIMARY KEY     DEFAULT uuid_generate_v1mc(),
+    uid          UUID        NOT NULL,
+    name         TEXT        NOT NULL,
+    prefix       TEXT        NOT NULL,
+    key_hash     TEXT        NOT NULL,
+    scopes       TEXT[]      NOT NULL DEFAULT '{}',
+    expires_at   TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    revoked_at   TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (key_hash),
+    CONSTRAINT fk_uid
+        FOREIGN KEY (uid)
+            REFERENCES users (uid)
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_uid_idx ON api_keys (uid);
+
+CREATE TRIGGER api_keys_updated_at_trigger
+    BEFORE UPDATE
+    ON api_keys
+    FOR EACH ROW
+EXECUTE PROCEDURE updated_at_fn();
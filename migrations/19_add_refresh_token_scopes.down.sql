@@ -0,0 +1,2 @@
+UPDATE api_keys SET scopes = '{}' WHERE scopes = '{*}';
+ALTER TABLE refresh_tokens DROP COLUMN scopes;
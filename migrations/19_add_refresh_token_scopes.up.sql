@@ -0,0 +1,4 @@
+-- Sessions and API keys created before scopes were enforced keep full access.
+ALTER TABLE refresh_tokens ADD COLUMN scopes TEXT[] NOT NULL DEFAULT '{*}';
+ALTER TABLE refresh_tokens ALTER COLUMN scopes SET DEFAULT '{}';
+UPDATE api_keys SET scopes = '{*}' WHERE scopes = '{}';
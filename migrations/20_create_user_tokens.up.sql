@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS user_tokens
+(
+    id         UUID PRIMARY KEY     DEFAULT uuid_generate_v1mc(),
+    uid        UUID        NOT NULL,
+    purpose    TEXT        NOT NULL,
+    token_hash TEXT        NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at    TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (token_hash),
+    CONSTRAINT fk_uid
+        FOREIGN KEY (uid)
+            REFERENCES users (uid)
+);
+
+CREATE INDEX IF NOT EXISTS user_tokens_uid_purpose_idx ON user_tokens (uid, purpose);
@@ -0,0 +1,5 @@
+-- Existing users keep uploading and sharing, only new signups have to verify their email.
+ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT true;
+ALTER TABLE users ALTER COLUMN email_verified SET DEFAULT false;
+
+ALTER TABLE user_tokens ADD COLUMN email TEXT;
@@ -0,0 +1,43 @@
+ALTER TABLE assets
+    DROP CONSTRAINT fk_uid,
+    ADD CONSTRAINT fk_uid
+        FOREIGN KEY (uid)
+            REFERENCES users (uid);
+
+ALTER TABLE revoked_tokens
+    DROP CONSTRAINT fk_uid,
+    ADD CONSTRAINT fk_uid
+        FOREIGN KEY (uid)
+            REFERENCES users (uid);
+
+ALTER TABLE webhooks
+    DROP CONSTRAINT fk_uid,
+    ADD CONSTRAINT fk_uid
+        FOREIGN KEY (uid)
+            REFERENCES users (uid);
+
+ALTER TABLE api_keys
+    DROP CONSTRAINT fk_uid,
+    ADD CONSTRAINT fk_uid
+        FOREIGN KEY (uid)
+            REFERENCES users (uid);
+
+ALTER TABLE user_tokens
+    DROP CONSTRAINT fk_uid,
+    ADD CONSTRAINT fk_uid
+        FOREIGN KEY (uid)
+            REFERENCES users (uid);
+
+ALTER TABLE refresh_tokens
+    DROP CONSTRAINT fk_uid,
+    ADD CONSTRAINT fk_uid
+        FOREIGN KEY (uid)
+            REFERENCES users (uid);
+
+ALTER TABLE jobs
+    DROP CONSTRAINT fk_uid,
+    ADD CONSTRAINT fk_uid
+        FOREIGN KEY (uid)
+            REFERENCES users (uid);
+
+ALTER TABLE users DROP COLUMN deleted_at;
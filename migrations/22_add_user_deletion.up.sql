@@ -0,0 +1,51 @@
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMPTZ;
+
+-- Removing a user removes everything they own, jobs are kept for their history.
+ALTER TABLE assets
+    DROP CONSTRAINT fk_uid,
+    ADD CONSTRAINT fk_uid
+        FOREIGN KEY (uid)
+            REFERENCES users (uid)
+            ON DELETE CASCADE;
+
+ALTER TABLE revoked_tokens
+    DROP CONSTRAINT fk_uid,
+    ADD CONSTRAINT fk_uid
+        FOREIGN KEY (uid)
+            REFERENCES users (uid)
+            ON DELETE CASCADE;
+
+ALTER TABLE webhooks
+    DROP CONSTRAINT fk_uid,
+    ADD CONSTRAINT fk_uid
+        FOREIGN KEY (uid)
+            REFERENCES users (uid)
+            ON DELETE CASCADE;
+
+ALTER TABLE api_keys
+    DROP CONSTRAINT fk_uid,
+    ADD CONSTRAINT fk_uid
+        FOREIGN KEY (uid)
+            REFERENCES users (uid)
+            ON DELETE CASCADE;
+
+ALTER TABLE user_tokens
+    DROP CONSTRAINT fk_uid,
+    ADD CONSTRAINT fk_uid
+        FOREIGN KEY (uid)
+            REFERENCES users (uid)
+            ON DELETE CASCADE;
+
+ALTER TABLE refresh_tokens
+    DROP CONSTRAINT fk_uid,
+    ADD CONSTRAINT fk_uid
+        FOREIGN KEY (uid)
+            REFERENCES users (uid)
+            ON DELETE CASCADE;
+
+ALTER TABLE jobs
+    DROP CONSTRAINT fk_uid,
+    ADD CONSTRAINT fk_uid
+        FOREIGN KEY (uid)
+            REFERENCES users (uid)
+            ON DELETE SET NULL;
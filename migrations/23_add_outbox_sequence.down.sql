@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS outbox_published_at_idx;
+CREATE INDEX IF NOT EXISTS outbox_unpublished_aggregate_idx ON outbox (aggregate_type, aggregate_id, id) WHERE published_at IS NULL;
+ALTER TABLE outbox DROP CONSTRAINT outbox_aggregate_seq_key;
+ALTER TABLE outbox DROP COLUMN seq;
+DROP TABLE IF EXISTS outbox_aggregates;
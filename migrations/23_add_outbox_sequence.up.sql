@@ -0,0 +1,31 @@
+-- Writers of an aggregate's events take the lock on its row, so its sequence numbers are committed in order and
+-- without gaps. published_seq is the relay's cursor, the last sequence number handed to the sinks.
+CREATE TABLE IF NOT EXISTS outbox_aggregates
+(
+    aggregate_type TEXT   NOT NULL,
+    aggregate_id   TEXT   NOT NULL,
+    last_seq       BIGINT NOT NULL DEFAULT 0,
+    published_seq  BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (aggregate_type, aggregate_id)
+);
+
+ALTER TABLE outbox ADD COLUMN seq BIGINT;
+
+UPDATE outbox o
+SET seq = n.seq
+FROM (SELECT id, ROW_NUMBER() OVER (PARTITION BY aggregate_type, aggregate_id ORDER BY id) AS seq FROM outbox) n
+WHERE o.id = n.id;
+
+INSERT INTO outbox_aggregates (aggregate_type, aggregate_id, last_seq, published_seq)
+SELECT aggregate_type,
+       aggregate_id,
+       MAX(seq),
+       COALESCE(MIN(seq) FILTER (WHERE published_at IS NULL) - 1, MAX(seq))
+FROM outbox
+GROUP BY aggregate_type, aggregate_id;
+
+ALTER TABLE outbox ALTER COLUMN seq SET NOT NULL;
+ALTER TABLE outbox ADD CONSTRAINT outbox_aggregate_seq_key UNIQUE (aggregate_type, aggregate_id, seq);
+
+DROP INDEX IF EXISTS outbox_unpublished_aggregate_idx;
+CREATE INDEX IF NOT EXISTS outbox_published_at_idx ON outbox (published_at) WHERE published_at IS NOT NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE webhook_deliveries DROP CONSTRAINT webhook_deliveries_webhook_id_event_id_key;
+ALTER TABLE webhook_deliveries DROP COLUMN event_id;
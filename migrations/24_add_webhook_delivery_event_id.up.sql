@@ -0,0 +1,3 @@
+-- Deliveries recorded before the event id was stored have none, they never conflict.
+ALTER TABLE webhook_deliveries ADD COLUMN event_id TEXT;
+ALTER TABLE webhook_deliveries ADD CONSTRAINT webhook_deliveries_webhook_id_event_id_key UNIQUE (webhook_id, event_id);
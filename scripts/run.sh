@@ -10,15 +10,38 @@ sleep 5
 
 migrate -database postgres://${DB_USER}:${DB_PASS}@${DB_HOST}:${DB_PORT}/${DB_NAME}?sslmode=${DB_SSL_MODE} -path migrations/ up
 
-./bin/ekanek \
--db-host "${DB_HOST}" \
--db-name "${DB_NAME}" \
--db-pass "${DB_PASS}" \
--db-port "${DB_PORT}" \
--db-user "${DB_USER}" \
--log-level "${LOG_LEVEL}" \
--srv-timeout "${SRV_TIMEOUT}" \
--aws-region "${AWS_DEFAULT_REGION}" \
--aws-key "${AWS_ACCESS_KEY_ID}" \
--aws-secret "${AWS_SECRET_ACCESS_KEY}" \
--private-key "${PRIVATE_KEY}"
+# Flags are only passed when their variable is set, unset ones keep the defaults of the binary.
+set --
+[ -n "${DB_HOST}" ] && set -- "$@" -db-host "${DB_HOST}"
+[ -n "${DB_NAME}" ] && set -- "$@" -db-name "${DB_NAME}"
+[ -n "${DB_PASS}" ] && set -- "$@" -db-pass "${DB_PASS}"
+[ -n "${DB_PORT}" ] && set -- "$@" -db-port "${DB_PORT}"
+[ -n "${DB_USER}" ] && set -- "$@" -db-user "${DB_USER}"
+[ -n "${LOG_LEVEL}" ] && set -- "$@" -log-level "${LOG_LEVEL}"
+[ -n "${SRV_TIMEOUT}" ] && set -- "$@" -srv-timeout "${SRV_TIMEOUT}"
+[ -n "${AWS_DEFAULT_REGION}" ] && set -- "$@" -aws-region "${AWS_DEFAULT_REGION}"
+[ -n "${AWS_ACCESS_KEY_ID}" ] && set -- "$@" -aws-key "${AWS_ACCESS_KEY_ID}"
+[ -n "${AWS_SECRET_ACCESS_KEY}" ] && set -- "$@" -aws-secret "${AWS_SECRET_ACCESS_KEY}"
+[ -n "${PRIVATE_KEY}" ] && set -- "$@" -private-key "${PRIVATE_KEY}"
+[ -n "${TRANSFORM_KEY}" ] && set -- "$@" -transform-key "${TRANSFORM_KEY}"
+[ -n "${JOB_WORKERS}" ] && set -- "$@" -job-workers "${JOB_WORKERS}"
+[ -n "${PURGE_AFTER}" ] && set -- "$@" -purge-after "${PURGE_AFTER}"
+[ -n "${CLAMD_ADDR}" ] && set -- "$@" -clamd-addr "${CLAMD_ADDR}"
+[ -n "${DEFAULT_QUOTA}" ] && set -- "$@" -default-quota "${DEFAULT_QUOTA}"
+[ -n "${UPLOAD_LIMITS}" ] && set -- "$@" -upload-limits "${UPLOAD_LIMITS}"
+[ -n "${OUTBOX_SINKS}" ] && set -- "$@" -outbox-sinks "${OUTBOX_SINKS}"
+[ -n "${OUTBOX_RETENTION}" ] && set -- "$@" -outbox-retention "${OUTBOX_RETENTION}"
+[ -n "${KMS_KEY_FILE}" ] && set -- "$@" -kms-key-file "${KMS_KEY_FILE}"
+[ -n "${AUTH_CACHE_TTL}" ] && set -- "$@" -auth-cache-ttl "${AUTH_CACHE_TTL}"
+[ -n "${ACCESS_TOKEN_TTL}" ] && set -- "$@" -access-token-ttl "${ACCESS_TOKEN_TTL}"
+[ -n "${REFRESH_TOKEN_TTL}" ] && set -- "$@" -refresh-token-ttl "${REFRESH_TOKEN_TTL}"
+[ -n "${JWT_SIGNING_KEY}" ] && set -- "$@" -jwt-signing-key "${JWT_SIGNING_KEY}"
+[ -n "${JWT_VERIFY_KEYS}" ] && set -- "$@" -jwt-verify-keys "${JWT_VERIFY_KEYS}"
+[ -n "${MAIL_URL}" ] && set -- "$@" -mail-url "${MAIL_URL}"
+[ -n "${MAIL_FROM}" ] && set -- "$@" -mail-from "${MAIL_FROM}"
+[ -n "${RESET_TOKEN_TTL}" ] && set -- "$@" -reset-token-ttl "${RESET_TOKEN_TTL}"
+[ -n "${VERIFY_TOKEN_TTL}" ] && set -- "$@" -verify-token-ttl "${VERIFY_TOKEN_TTL}"
+[ -n "${REQUIRE_VERIFIED_EMAIL}" ] && set -- "$@" -require-verified-email "${REQUIRE_VERIFIED_EMAIL}"
+[ -n "${DELETE_AFTER}" ] && set -- "$@" -delete-after "${DELETE_AFTER}"
+
+./bin/ekanek "$@"